@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"flag"
 	"fmt"
 	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
 	"github.com/ricdeau/gitlab-extension/app/pkg/caching"
+	"github.com/ricdeau/gitlab-extension/app/pkg/commands"
 	"github.com/ricdeau/gitlab-extension/app/pkg/config"
 	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/fanout"
 	"github.com/ricdeau/gitlab-extension/app/pkg/handlers"
+	"github.com/ricdeau/gitlab-extension/app/pkg/hooks"
+	"github.com/ricdeau/gitlab-extension/app/pkg/journal"
 	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
 	"github.com/ricdeau/gitlab-extension/app/pkg/telegram"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -18,19 +26,25 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/olahol/melody.v1"
+	"net/http"
 )
 
 const (
 	timestampFormat       = "02-01-2006 15:04:05.999 -0700"
 	defaultConfigFilePath = "config.yaml"
 	configFileFlagUsage   = "Configuration file path"
+	shutdownTimeout       = 30 * time.Second
+	deadLettersCapacity   = 1000
+	cacheExpiration       = 1 * time.Hour
+	pipelinesNumber       = 5
 )
 
-// topic names
+// subscriber names
 const (
-	UpdateCacheTopic = "cache"
-	SocketTopic      = "ws"
-	BotTopic         = "telegram_bot"
+	CacheSubscriber   = "cache"
+	JournalSubscriber = "journal"
+	FanoutSubscriber  = "fanout"
+	StreamSubscriber  = "stream"
 )
 
 func main() {
@@ -46,32 +60,157 @@ func main() {
 	conf := config.Get(*configFile, logger)
 
 	router := gin.New()
-	msgBroker := broker.New()
-	cache := caching.New(1 * time.Hour)
+	msgBroker := newBroker(conf, logger)
+	cache := newCache(conf, logger)
 
 	setRouter(router, conf, logger)
-	setCache(cache, msgBroker, logger)
-	setTelegramBot(conf, logger, msgBroker)
+	stream := handlers.NewPipelineStream(conf.SocketReplaySize, logger)
+	setCache(conf, cache, stream, msgBroker, logger)
+	snapshotter := setSnapshotter(conf, logger, cache)
+	setTelegramBot(conf, logger, msgBroker, cache)
+	eventsJournal := setJournal(conf, logger, msgBroker)
+	hooksManager := setHooksManager(conf, logger)
+	dispatcher := setFanout(conf, logger, msgBroker)
+	deadLetters := setDeadLetters(logger, msgBroker)
 
 	//set html handler
 	router.Use(static.Serve("/", static.LocalFile("./www", true)))
-	router.GET("/projects", handlers.NewProxy(conf, cache, logger).Handler())
-	router.GET("/ws", handlers.NewSocket(SocketTopic, melody.New(), msgBroker, logger).Handler())
-	router.POST("/webhook", handlers.NewWebhook(msgBroker, SocketTopic, UpdateCacheTopic, BotTopic).Handler())
+	router.GET("/projects", handlers.NewProxy(cache, logger).Handler())
+	socket := newSocket(conf)
+	connections := handlers.NewSocketConnections(handlers.SocketLimits{
+		MaxConnections:      conf.SocketMaxConns,
+		MaxConnectionsPerIp: conf.SocketMaxIpConns,
+		MaxPending:          conf.SocketMaxPending,
+	})
+	executor := commands.New(conf, cache, stream.Send, logger)
+	router.GET("/ws", handlers.NewSocket(stream, socket, connections, cache, executor, logger).Handler())
+	router.GET("/events", handlers.NewServerEvents(stream, cache, conf.SseHeartbeat, logger).Handler())
+	router.POST("/webhook", handlers.NewWebhook(msgBroker, conf).Handler())
 
-	err := router.Run(fmt.Sprintf(":%d", conf.Port))
-	if err != nil {
-		logger.Fatalf("Unable to start server: %v", err)
+	// admin endpoints change state of the service, so they aren't exposed without token
+	if conf.AdminToken == "" {
+		logger.Warnf("Admin token is not configured, admin endpoints are disabled")
+	} else {
+		admin := router.Group("/admin", adminAuth(conf.AdminToken))
+		admin.GET("/events", handlers.NewEvents(eventsJournal, logger).Handler())
+		admin.POST("/events/:id/replay", handlers.NewEventReplay(eventsJournal, msgBroker, conf, logger).Handler())
+		admin.GET("/hooks", handlers.NewHooks(hooksManager).Handler())
+		admin.POST("/hooks/sync", handlers.NewHooksSync(hooksManager).Handler())
+		admin.GET("/fanout/dead-letters", handlers.NewDeadLetters(dispatcher).Handler())
+		admin.GET("/broker", handlers.NewBrokerStats(msgBroker).Handler())
+		admin.GET("/broker/dead-letters", handlers.NewBrokerDeadLetters(deadLetters, msgBroker).Handler())
+		admin.POST("/broker/dead-letters/:id/replay", handlers.NewBrokerDeadLetterReplay(deadLetters).Handler())
+		admin.GET("/ws", handlers.NewSocketStats(connections).Handler())
+		admin.GET("/cache", handlers.NewCacheStats(cache).Handler())
+		admin.POST("/cache/refresh", handlers.NewCacheRefresh(cache).Handler())
+		admin.DELETE("/cache", handlers.NewCacheClear(cache).Handler())
+	}
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", conf.Port),
+		Handler: router,
+	}
+	// streaming responses never become idle, so they are ended when shutdown starts
+	server.RegisterOnShutdown(stream.Close)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("Unable to start server: %v", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	logger.Infof("Shutting down server")
+
+	// stop accepting webhooks first, then deliver everything that has been accepted
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Errorf("Server shutdown error: %v", err)
+	}
+	if err := msgBroker.Close(ctx); err != nil {
+		logger.Errorf("Message broker close error: %v", err)
+	}
+	if err := socket.Close(); err != nil {
+		logger.Errorf("Websocket close error: %v", err)
+	}
+	if err := hooksManager.Close(); err != nil {
+		logger.Errorf("Hooks manager close error: %v", err)
+	}
+	if err := dispatcher.Close(); err != nil {
+		logger.Errorf("Fan-out dispatcher close error: %v", err)
+	}
+	if err := eventsJournal.Close(); err != nil {
+		logger.Errorf("Events journal close error: %v", err)
+	}
+	if err := snapshotter.Close(); err != nil {
+		logger.Errorf("Projects cache snapshot error: %v", err)
 	}
 }
 
-func setTelegramBot(conf *config.Config, logger *logrus.Logger, broker broker.MessageBroker) {
+// Creates message broker of configured type.
+func newBroker(conf *config.Config, logger *logrus.Logger) broker.MessageBroker {
+	switch conf.BrokerType {
+	case config.BrokerMemory:
+		return broker.New()
+	case config.BrokerDisk:
+		msgBroker, err := broker.NewDurable(conf.BrokerPath)
+		if err != nil {
+			logger.Fatalf("Unable to open message broker store: %v", err)
+		}
+		return msgBroker
+	case config.BrokerRedis:
+		msgBroker, err := broker.NewRedis(conf.RedisUrl)
+		if err != nil {
+			logger.Fatalf("Unable to connect to redis message broker: %v", err)
+		}
+		return msgBroker
+	default:
+		logger.Fatalf("Unknown message broker type: %s", conf.BrokerType)
+		return nil
+	}
+}
+
+// Creates projects cache of configured type.
+func newCache(conf *config.Config, logger *logrus.Logger) caching.ProjectsCache {
+	loader := caching.NewGitlabLoader(conf, pipelinesNumber, logger)
+	switch conf.CacheType {
+	case config.CacheMemory:
+		return caching.New(cacheExpiration, pipelinesNumber, loader, logger)
+	case config.CacheRedis:
+		cache, err := caching.NewRedis(conf.RedisUrl, cacheExpiration, pipelinesNumber, loader, logger)
+		if err != nil {
+			logger.Fatalf("Unable to connect to redis projects cache: %v", err)
+		}
+		return cache
+	default:
+		logger.Fatalf("Unknown projects cache type: %s", conf.CacheType)
+		return nil
+	}
+}
+
+// Creates websocket broadcaster with configured heartbeats and write timeouts.
+func newSocket(conf *config.Config) *melody.Melody {
+	socket := melody.New()
+	socket.Config.PingPeriod = conf.SocketPingPeriod
+	socket.Config.PongWait = conf.SocketPongWait
+	socket.Config.WriteWait = conf.SocketWriteWait
+	socket.Config.MessageBufferSize = conf.SocketBufferSize
+	return socket
+}
+
+func setTelegramBot(conf *config.Config, logger *logrus.Logger, msgBroker broker.MessageBroker, cache caching.ProjectsCache) {
+	if !conf.RunConsumers {
+		logger.Infof("Consumers are disabled, telegram bot runs on another instance")
+		return
+	}
 	db, err := telegram.NewBotDb()
 	if err != nil {
 		logger.Errorf("Unable to create bot db: %v", err)
 		return
 	}
-	bot, err := telegram.NewBot(BotTopic, conf, db, broker, logger)
+	bot, err := telegram.NewBot(broker.PipelinesPattern, conf, db, msgBroker, cache, logger)
 	if err != nil {
 		logger.Errorf("Unable to authorize to telegram bot API: %v", err)
 		return
@@ -96,21 +235,136 @@ func setRouter(router *gin.Engine, conf *config.Config, logger *logrus.Logger) {
 	}))
 }
 
-func setCache(cache caching.ProjectsCache, broker broker.MessageBroker, logger *logrus.Logger) {
-	if err := broker.AddTopic(UpdateCacheTopic); err != nil {
+// Applies pipeline events to projects cache and sends changes of cached projects to websocket and SSE clients.
+// Redis cache shared over redis broker is updated only by instance with consumers,
+// other instances receive its changes from broker.
+func setCache(
+	conf *config.Config,
+	cache caching.ProjectsCache,
+	stream *handlers.PipelineStream,
+	msgBroker broker.MessageBroker,
+	logger *logrus.Logger) {
 
-	}
-	err := broker.Subscribe(UpdateCacheTopic, func(message interface{}) {
-		push, ok := message.(contracts.PipelinePush)
-		if !ok {
-			logger.Errorf("Invalid message type: %T", message)
+	shared := conf.CacheType == config.CacheRedis && conf.BrokerType == config.BrokerRedis
+	if shared {
+		if err := msgBroker.AddTopic(broker.CacheChangesTopic); err != nil {
+			logger.Fatalf("Set cache error: %v", err)
 		}
-		err := cache.UpdatePipeline(push)
+		_, err := broker.SubscribeCacheChanges(msgBroker, broker.CacheChangesTopic, func(_ broker.Envelope, change contracts.CacheChange) {
+			stream.Send(change)
+		}, logger, broker.WithName(StreamSubscriber))
+		if err != nil {
+			logger.Fatalf("Set cache error: %v", err)
+		}
+		if !conf.RunConsumers {
+			logger.Infof("Consumers are disabled, shared cache is updated on another instance")
+			return
+		}
+	}
+
+	_, err := broker.SubscribePipelines(msgBroker, broker.PipelinesPattern, func(envelope broker.Envelope, push contracts.PipelinePush) {
+		change, err := cache.UpdatePipeline(push)
 		if err != nil {
 			logger.Errorf("ErrorResponse while updating cache: %v", err)
+			return
 		}
-	})
+		if !shared {
+			stream.Send(change)
+			return
+		}
+		if change.Type == "" {
+			return
+		}
+		changeEnvelope := broker.NewCacheChangeEnvelope(conf.InstanceName, envelope.CorrelationId, change)
+		if err := msgBroker.Publish(broker.CacheChangesTopic, changeEnvelope); err != nil {
+			logger.Errorf("Unable to publish cache change: %v", err)
+		}
+	}, logger, broker.WithName(CacheSubscriber))
 	if err != nil {
 		logger.Fatalf("Set cache error: %v", err)
 	}
 }
+
+// Warms projects cache from snapshot and starts saving snapshots periodically.
+func setSnapshotter(conf *config.Config, logger *logrus.Logger, cache caching.ProjectsCache) caching.Snapshotter {
+	snapshotter := caching.NewSnapshotter(cache, conf.CachePath, logger)
+	if err := snapshotter.Warm(); err != nil {
+		logger.Errorf("Unable to warm projects cache: %v", err)
+	}
+	if err := snapshotter.Start(conf.CacheSnapshot); err != nil {
+		logger.Fatalf("Unable to start projects cache snapshots: %v", err)
+	}
+	return snapshotter
+}
+
+func setJournal(conf *config.Config, logger *logrus.Logger, msgBroker broker.MessageBroker) journal.Journal {
+	eventsJournal, err := journal.New(conf.JournalPath, conf.JournalRetention, conf.JournalMaxEvents)
+	if err != nil {
+		logger.Fatalf("Unable to open events journal: %v", err)
+	}
+	// replayed messages are already in journal
+	_, err = msgBroker.Subscribe(broker.WebhookPipelinesPattern, func(envelope broker.Envelope) {
+		if _, err := eventsJournal.Append(envelope); err != nil {
+			logger.Errorf("Unable to append event to journal: %v", err)
+		}
+	}, broker.WithName(JournalSubscriber), broker.WithLogger(logger))
+	if err != nil {
+		logger.Fatalf("Set journal error: %v", err)
+	}
+	return eventsJournal
+}
+
+// Forwards normalized pipeline events to configured downstream targets.
+// Without consumers dispatcher only serves its dead letters.
+func setFanout(conf *config.Config, logger *logrus.Logger, msgBroker broker.MessageBroker) fanout.Dispatcher {
+	deadLetters, err := fanout.NewDeadLetterStore(conf.FanoutPath)
+	if err != nil {
+		logger.Fatalf("Unable to open fan-out dead letters store: %v", err)
+	}
+	if !conf.RunConsumers {
+		logger.Infof("Consumers are disabled, fan-out runs on another instance")
+		return fanout.New(nil, deadLetters, logger)
+	}
+	dispatcher := fanout.New(conf.FanoutTargets, deadLetters, logger)
+	_, err = broker.SubscribePipelines(msgBroker, broker.PipelinesPattern, func(_ broker.Envelope, push contracts.PipelinePush) {
+		dispatcher.Dispatch(contracts.NewPipelineEvent(push))
+	}, logger, broker.WithName(FanoutSubscriber))
+	if err != nil {
+		logger.Fatalf("Set fan-out error: %v", err)
+	}
+	return dispatcher
+}
+
+// Keeps messages that subscribers failed to process, so they can be inspected and replayed.
+func setDeadLetters(logger *logrus.Logger, msgBroker broker.MessageBroker) broker.DeadLetterStore {
+	store, err := broker.NewDeadLetterStore(msgBroker, deadLettersCapacity, logger)
+	if err != nil {
+		logger.Fatalf("Set dead letters error: %v", err)
+	}
+	return store
+}
+
+// Starts hooks manager if public url of the service is configured.
+func setHooksManager(conf *config.Config, logger *logrus.Logger) hooks.Manager {
+	manager := hooks.New(conf, logger)
+	if conf.PublicUrl == "" {
+		logger.Warnf("Public url is not configured, gitlab hooks won't be managed")
+		return manager
+	}
+	if err := manager.Start(conf.HookSyncInterval); err != nil {
+		logger.Fatalf("Unable to start gitlab hooks sync: %v", err)
+	}
+	return manager
+}
+
+// Rejects admin requests without valid 'Authorization: Bearer <token>' header.
+func adminAuth(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
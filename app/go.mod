@@ -3,12 +3,14 @@ module github.com/ricdeau/gitlab-extension/app
 go 1.13
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/gin-contrib/cors v1.3.0
 	github.com/gin-contrib/static v0.0.0-20191128031702-f81c604d8ac2
 	github.com/gin-gonic/gin v1.5.0
+	github.com/go-redis/redis v6.14.1+incompatible
 	github.com/go-telegram-bot-api/telegram-bot-api v4.6.4+incompatible
 	github.com/google/uuid v1.1.1
-	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/gorilla/websocket v1.4.0
 	github.com/prologic/bitcask v0.3.5
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0
@@ -1,80 +1,606 @@
 package broker
 
 import (
+	"context"
 	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	consumerIsNil    = "consumer can't be nil"
-	topicNameIsEmpty = "topic name can't be empty"
-	noTopic          = "there is no topic named '%s'"
-	publishNoTopic   = "publish: " + noTopic
-	subscribeNoTopic = "subscribe: " + noTopic
+	consumerIsNil      = "consumer can't be nil"
+	topicNameIsEmpty   = "topic name can't be empty"
+	noTopic            = "there is no topic named '%s'"
+	noSubscription     = "there is no subscription %d on topic '%s'"
+	publishNoTopic     = "publish: " + noTopic
+	subscribeNoTopic   = "subscribe: " + noTopic
+	unsubscribeNoTopic = "unsubscribe: " + noTopic
+	brokerClosed       = "broker is closed"
+	topicIsPattern     = "topic name '%s' can't contain wildcards"
+	consumerPanic      = "consumer panic: %v"
+	noSubscriber       = "there is no subscriber '%s' of topic '%s'"
+	subscriberBusy     = "queue of subscriber '%s' is full"
 )
 
-type Consumer func(interface{})
+// Topic where messages that consumers failed to process are published.
+const DeadLetterTopic = "dead_letter"
+
+// Topic where changes of shared projects cache are published, so every instance sends them to its clients.
+const CacheChangesTopic = "cache_changes"
+
+const (
+	// Size of the queue of every subscriber.
+	subscriberQueueSize = 64
+	// How often processed messages are removed from durable broker store.
+	compactInterval = 10 * time.Minute
+)
+
+type Consumer func(Envelope)
+
+type SubscribeOption func(*subscriber)
+
+// Subscription identifies consumer bound to topic.
+type Subscription struct {
+	Topic string
+	Name  string
+	Id    uint64
+}
 
 type MessageBroker interface {
 	AddTopic(name string) error
-	Publish(topicName string, message interface{}) error
-	Subscribe(topicName string, consumer Consumer) error
+	Publish(topicName string, envelope Envelope) error
+	Subscribe(topicName string, consumer Consumer, options ...SubscribeOption) (Subscription, error)
+	Unsubscribe(subscription Subscription) error
+	Redeliver(topicName, subscriberName string, envelope Envelope) error
+	Failures() map[string]uint64
+	Stats() []TopicStats
+	Close(ctx context.Context) error
 }
 
 // messageBroker consists of several topics,
-// consumers can subscribe on them.
+// consumers can subscribe on them or on topic patterns.
+// Every subscriber of topic receives every message published to the topic.
+// Subscriber of pattern receives messages published to every topic matching the pattern.
+// Durable broker writes messages to store before delivery, subscribers read them from store.
 type messageBroker struct {
-	topics map[string]chan interface{}
-	lock   *sync.Mutex
+	topics     map[string]*topic
+	patterns   map[string]*topic
+	lock       *sync.RWMutex
+	lastId     uint64
+	closed     bool
+	publishing sync.WaitGroup
+	store      *store
+	done       chan struct{}
+}
+
+type topic struct {
+	counters
+	subscribers map[uint64]*subscriber
+}
+
+// subscriber consumes messages of topic or pattern from its own buffered queue.
+// Closing queue lets consumer finish queued messages, closing done makes it discard them.
+// Consumer panics are recovered, message is retried and then sent to DeadLetterTopic.
+// Subscriber of durable broker reads messages from store starting after offset,
+// its queue is used only to stop it and notify tells it about new messages.
+type subscriber struct {
+	failures uint64
+	offset   uint64
+	notify   chan struct{}
+	topic    string
+	name     string
+	retries  int
+	queue    chan Envelope
+	done     chan struct{}
+	stopped  chan struct{}
+	consumer Consumer
+	counters *counters
+	broker   MessageBroker
+	store    *store
+	logger   logging.Logger
+}
+
+// Sets subscriber name, that is used in failure counters and dead letters.
+// By default subscription id is used.
+func WithName(name string) SubscribeOption {
+	return func(s *subscriber) {
+		s.name = name
+	}
+}
+
+// Sets logger of messages that are lost because their dead letters can't be published,
+// e.g. when consumer fails while broker is closing. By default they are only counted as failures.
+func WithLogger(logger logging.Logger) SubscribeOption {
+	return func(s *subscriber) {
+		s.logger = logger
+	}
+}
+
+// Sets how many times message is passed to consumer again after consumer panic.
+func WithRetries(retries int) SubscribeOption {
+	return func(s *subscriber) {
+		s.retries = retries
+	}
 }
 
 // Returns pointer to new messageBroker instance.
 func New() MessageBroker {
 	result := messageBroker{}
-	result.topics = make(map[string]chan interface{})
-	result.lock = new(sync.Mutex)
+	result.topics = make(map[string]*topic)
+	result.patterns = make(map[string]*topic)
+	result.lock = new(sync.RWMutex)
 	return &result
 }
 
+// Returns pointer to new messageBroker instance that keeps messages in bitcask store at given path.
+// Messages survive restart, subscriber resumes after the last message it processed.
+// Offsets are tracked by subscriber name, so durable subscribers should be given stable names by WithName.
+func NewDurable(path string) (MessageBroker, error) {
+	s, err := openStore(path)
+	if err != nil {
+		return nil, err
+	}
+	result := New().(*messageBroker)
+	result.store = s
+	result.done = make(chan struct{})
+	go result.compactPeriodically()
+	return result, nil
+}
+
 // Adds new topic in queue, if topic with given name exists nothing will happen.
 func (b *messageBroker) AddTopic(name string) error {
 	if name == "" {
 		return fmt.Errorf(topicNameIsEmpty)
 	}
+	if IsPattern(name) {
+		return fmt.Errorf(topicIsPattern, name)
+	}
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	if b.closed {
+		return fmt.Errorf(brokerClosed)
+	}
 	if _, ok := b.topics[name]; !ok {
-		b.topics[name] = make(chan interface{})
+		b.topics[name] = &topic{subscribers: make(map[uint64]*subscriber)}
 	}
 	return nil
 }
 
-// Publishes message in topic.
-// Blocks if subscriber for this topicName hasn't been set.
-func (b *messageBroker) Publish(topicName string, message interface{}) error {
-	topic, ok := b.topics[topicName]
-	if ok {
-		topic <- message
-	} else {
+// Publishes message to every subscriber of topic.
+// Blocks while queue of any subscriber is full.
+// If neither topic nor matching patterns have subscribers, message is discarded.
+// Envelope topic is set to the name of topic.
+func (b *messageBroker) Publish(topicName string, envelope Envelope) error {
+	b.lock.RLock()
+	if b.closed {
+		b.lock.RUnlock()
+		return fmt.Errorf(brokerClosed)
+	}
+	t, ok := b.topics[topicName]
+	if !ok {
+		b.lock.RUnlock()
 		return fmt.Errorf(publishNoTopic, topicName)
 	}
+	t.publish()
+	subscribers := make([]*subscriber, 0, len(t.subscribers))
+	for _, s := range t.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	for pattern, p := range b.patterns {
+		if MatchTopic(pattern, topicName) {
+			p.publish()
+			for _, s := range p.subscribers {
+				subscribers = append(subscribers, s)
+			}
+		}
+	}
+	b.publishing.Add(1)
+	defer b.publishing.Done()
+	b.lock.RUnlock()
+
+	envelope.Topic = topicName
+	if b.store != nil {
+		if err := b.store.append(topicName, envelope); err != nil {
+			return err
+		}
+		for _, s := range subscribers {
+			s.wake()
+		}
+		return nil
+	}
+	if len(subscribers) == 0 {
+		t.drop(1)
+	}
+	for _, s := range subscribers {
+		select {
+		case s.queue <- envelope:
+		case <-s.done:
+			s.counters.drop(1)
+		}
+	}
 	return nil
 }
 
-// Binds consuming functions to queue topic.
-func (b *messageBroker) Subscribe(topicName string, consumer Consumer) error {
+// Binds consuming functions to queue topic or topic pattern.
+// Pattern subscription doesn't require matching topics to exist.
+// Returned subscription can be used to unbind consumer.
+func (b *messageBroker) Subscribe(
+	topicName string,
+	consumer Consumer,
+	options ...SubscribeOption) (subscription Subscription, err error) {
+
 	if consumer == nil {
-		return fmt.Errorf(consumerIsNil)
+		return subscription, fmt.Errorf(consumerIsNil)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return subscription, fmt.Errorf(brokerClosed)
 	}
-	topic, ok := b.topics[topicName]
-	if ok {
-		go func() {
-			for message := range topic {
-				consumer(message)
+	t, ok := b.topics[topicName]
+	if IsPattern(topicName) {
+		if t, ok = b.patterns[topicName]; !ok {
+			t = &topic{subscribers: make(map[uint64]*subscriber)}
+			b.patterns[topicName] = t
+		}
+	} else if !ok {
+		return subscription, fmt.Errorf(subscribeNoTopic, topicName)
+	}
+	b.lastId++
+	s := newSubscriber(b, b.lastId, topicName, &t.counters, consumer, options)
+	if b.store != nil {
+		if IsPattern(topicName) {
+			if err = b.store.addPattern(topicName); err != nil {
+				return
+			}
+		}
+		if s.offset, err = b.store.offset(topicName, s.name); err != nil {
+			return
+		}
+		s.notify = make(chan struct{}, 1)
+		s.store = b.store
+		t.subscribers[b.lastId] = s
+		go s.consumeStored()
+		return Subscription{topicName, s.name, b.lastId}, nil
+	}
+	t.subscribers[b.lastId] = s
+	go s.consume()
+	return Subscription{topicName, s.name, b.lastId}, nil
+}
+
+// Unbinds consumer from topic, messages that weren't consumed yet are discarded.
+func (b *messageBroker) Unsubscribe(subscription Subscription) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return fmt.Errorf(brokerClosed)
+	}
+	t, ok := b.topics[subscription.Topic]
+	if IsPattern(subscription.Topic) {
+		t, ok = b.patterns[subscription.Topic]
+	}
+	if !ok {
+		return fmt.Errorf(unsubscribeNoTopic, subscription.Topic)
+	}
+	s, ok := t.subscribers[subscription.Id]
+	if !ok {
+		return fmt.Errorf(noSubscription, subscription.Id, subscription.Topic)
+	}
+	delete(t.subscribers, subscription.Id)
+	t.drop(s.depth())
+	close(s.done)
+	if b.store != nil {
+		return b.store.remove(s.topic, s.name)
+	}
+	return nil
+}
+
+// Stops accepting new messages and subscriptions, waits for running publishes,
+// then waits until consumers process all queued messages.
+// If ctx is done earlier, queued messages are discarded and ctx error is returned.
+// Durable broker keeps unprocessed messages in store and closes it.
+func (b *messageBroker) Close(ctx context.Context) (err error) {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return fmt.Errorf(brokerClosed)
+	}
+	b.closed = true
+	if b.store != nil {
+		close(b.done)
+		defer func() {
+			if closeErr := b.store.close(); err == nil {
+				err = closeErr
 			}
 		}()
-	} else {
-		return fmt.Errorf(subscribeNoTopic, topicName)
+	}
+	var subscribers []*subscriber
+	for _, topics := range []map[string]*topic{b.topics, b.patterns} {
+		for _, t := range topics {
+			for _, s := range t.subscribers {
+				subscribers = append(subscribers, s)
+			}
+		}
+	}
+	b.lock.Unlock()
+
+	published := make(chan struct{})
+	go func() {
+		b.publishing.Wait()
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-ctx.Done():
+		abort(subscribers)
+		return ctx.Err()
+	}
+
+	for _, s := range subscribers {
+		close(s.queue)
+	}
+	for _, s := range subscribers {
+		select {
+		case <-s.stopped:
+		case <-ctx.Done():
+			abort(subscribers)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Passes message of topic to subscribers with given name of the topic or matching patterns only,
+// e.g. to retry message that one of subscribers failed to process.
+// Message isn't written to store of durable broker. Fails if queue of any subscriber is full.
+func (b *messageBroker) Redeliver(topicName, subscriberName string, envelope Envelope) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		return fmt.Errorf(brokerClosed)
+	}
+	var subscribers []*subscriber
+	if t, ok := b.topics[topicName]; ok {
+		for _, s := range t.subscribers {
+			subscribers = append(subscribers, s)
+		}
+	}
+	for pattern, p := range b.patterns {
+		if MatchTopic(pattern, topicName) {
+			for _, s := range p.subscribers {
+				subscribers = append(subscribers, s)
+			}
+		}
+	}
+	envelope.Topic = topicName
+	return redeliver(subscribers, subscriberName, envelope)
+}
+
+// Returns stats of every topic and subscribed pattern, sorted by name.
+func (b *messageBroker) Stats() []TopicStats {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	result := make([]TopicStats, 0, len(b.topics)+len(b.patterns))
+	for _, topics := range []map[string]*topic{b.topics, b.patterns} {
+		for name, t := range topics {
+			queueDepth := 0
+			for _, s := range t.subscribers {
+				queueDepth += s.depth()
+			}
+			result = append(result, t.stats(name, len(t.subscribers), queueDepth))
+		}
+	}
+	return sortStats(result)
+}
+
+// Returns number of consumer failures for every subscriber, keyed by 'topic/name'.
+func (b *messageBroker) Failures() map[string]uint64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	result := make(map[string]uint64)
+	for _, topics := range []map[string]*topic{b.topics, b.patterns} {
+		for _, t := range topics {
+			for _, s := range t.subscribers {
+				result[s.topic+"/"+s.name] = atomic.LoadUint64(&s.failures)
+			}
+		}
+	}
+	return result
+}
+
+func (b *messageBroker) compactPeriodically() {
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = b.store.compact()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Creates subscriber, that publishes dead letters to given broker.
+func newSubscriber(
+	b MessageBroker,
+	id uint64,
+	topicName string,
+	topicCounters *counters,
+	consumer Consumer,
+	options []SubscribeOption) *subscriber {
+
+	s := &subscriber{
+		topic:    topicName,
+		name:     fmt.Sprint(id),
+		queue:    make(chan Envelope, subscriberQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		consumer: consumer,
+		counters: topicCounters,
+		broker:   b,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// Returns number of messages waiting for consumer.
+func (s *subscriber) depth() int {
+	if s.store != nil {
+		return int(s.store.head(s.topic) - atomic.LoadUint64(&s.offset))
+	}
+	return len(s.queue)
+}
+
+func (s *subscriber) consume() {
+	defer close(s.stopped)
+	for {
+		select {
+		case envelope, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			s.deliver(envelope)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Reads messages from store one by one and commits offset after every message.
+// Once queue is closed, reads remaining messages and stops.
+func (s *subscriber) consumeStored() {
+	defer close(s.stopped)
+	closing := false
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		offset := atomic.LoadUint64(&s.offset) + 1
+		envelope, found, err := s.store.read(s.topic, offset)
+		if found {
+			if err == nil {
+				s.deliver(envelope)
+			} else {
+				atomic.AddUint64(&s.failures, 1)
+				s.counters.drop(1)
+			}
+			atomic.StoreUint64(&s.offset, offset)
+			if err := s.store.commit(s.topic, s.name, offset); err != nil {
+				atomic.AddUint64(&s.failures, 1)
+			}
+			continue
+		}
+		if err != nil {
+			atomic.AddUint64(&s.failures, 1)
+		}
+		if closing {
+			return
+		}
+		select {
+		case <-s.notify:
+		case envelope, open := <-s.queue:
+			// queue of durable subscriber receives only redelivered messages
+			if closing = !open; open {
+				s.deliver(envelope)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Tells subscriber of durable broker that there are new messages in store.
+func (s *subscriber) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Passes message to consumer, retries on panic and publishes message to DeadLetterTopic
+// when retries are exhausted. Failures of dead letters consumers are only counted.
+func (s *subscriber) deliver(envelope Envelope) {
+	var (
+		err   error
+		stack string
+	)
+	attempts := 0
+	for attempts <= s.retries {
+		attempts++
+		if err, stack = s.call(envelope); err == nil {
+			s.counters.deliver()
+			return
+		}
+		atomic.AddUint64(&s.failures, 1)
+	}
+	s.counters.drop(1)
+	if envelope.Topic == DeadLetterTopic {
+		return
+	}
+	deadLetter := DeadLetter{
+		Topic:      envelope.Topic,
+		Subscriber: s.name,
+		Error:      err.Error(),
+		Stack:      stack,
+		Attempts:   attempts,
+		FailedAt:   time.Now().UTC(),
+		Envelope:   envelope,
+	}
+	publishErr := s.broker.AddTopic(DeadLetterTopic)
+	if publishErr == nil {
+		publishErr = s.broker.Publish(DeadLetterTopic, NewDeadLetterEnvelope(envelope.Source, envelope.CorrelationId, deadLetter))
+	}
+	if publishErr != nil && s.logger != nil {
+		s.logger.Errorf("Message %s of topic %s is lost, subscriber %s failed to process it after %d attempts: %v, "+
+			"dead letter isn't published: %v", envelope.Id, envelope.Topic, s.name, attempts, err, publishErr)
+	}
+}
+
+// Calls consumer and converts its panic to error.
+func (s *subscriber) call(envelope Envelope) (err error, stack string) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf(consumerPanic, r)
+			stack = string(debug.Stack())
+		}
+	}()
+	s.consumer(envelope)
+	return
+}
+
+// Enqueues message to subscribers with given name without blocking.
+// Queues of subscribers must not be closed until it returns.
+func redeliver(subscribers []*subscriber, name string, envelope Envelope) error {
+	found := false
+	for _, s := range subscribers {
+		if s.name != name {
+			continue
+		}
+		found = true
+		select {
+		case s.queue <- envelope:
+			s.counters.publish()
+		default:
+			return fmt.Errorf(subscriberBusy, name)
+		}
+	}
+	if !found {
+		return fmt.Errorf(noSubscriber, name, envelope.Topic)
 	}
 	return nil
 }
+
+// Makes subscribers discard queued messages and unblocks publishers waiting for them.
+func abort(subscribers []*subscriber) {
+	for _, s := range subscribers {
+		close(s.done)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 	"time"
 )
@@ -38,13 +39,13 @@ func TestMessageBroker_PubSub_Success(t *testing.T) {
 	assert.NoError(t, err)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	err = b.Subscribe(topic1, func(msg interface{}) {
-		expected = msg
+	_, err = b.Subscribe(topic1, func(msg Envelope) {
+		expected = msg.Payload
 		cancel()
 	})
 	assert.NoError(t, err)
 
-	err = b.Publish(topic1, actual)
+	err = b.Publish(topic1, testEnvelope(actual))
 	assert.NoError(t, err)
 
 	<-ctx.Done()
@@ -53,21 +54,366 @@ func TestMessageBroker_PubSub_Success(t *testing.T) {
 
 func TestMessageBroker_Publish_NoTopic(t *testing.T) {
 	b := New()
-	actualErr := b.Publish(topic1, "test")
+	actualErr := b.Publish(topic1, testEnvelope("test"))
 	expectedErr := fmt.Sprintf(publishNoTopic, topic1)
 	assert.EqualError(t, actualErr, expectedErr)
 }
 
 func TestMessageBroker_Subscribe_NilConsumer(t *testing.T) {
 	b := New()
-	actualErr := b.Subscribe(topic1, nil)
+	_, actualErr := b.Subscribe(topic1, nil)
 	assert.EqualError(t, actualErr, consumerIsNil)
 }
 
 func TestMessageBroker_Subscribe_NoTopic(t *testing.T) {
 	b := New()
-	consumer := func(interface{}) {}
-	actualErr := b.Subscribe(topic1, consumer)
+	consumer := func(Envelope) {}
+	_, actualErr := b.Subscribe(topic1, consumer)
 	expectedErr := fmt.Sprintf(subscribeNoTopic, topic1)
 	assert.EqualError(t, actualErr, expectedErr)
 }
+
+func TestMessageBroker_PubSub_MultipleSubscribers(t *testing.T) {
+	const (
+		subscribers = 3
+		messages    = 10
+	)
+	b := New()
+	err := b.AddTopic(topic1)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(subscribers * messages)
+	received := make([][]interface{}, subscribers)
+	for i := 0; i < subscribers; i++ {
+		i := i
+		_, err = b.Subscribe(topic1, func(msg Envelope) {
+			received[i] = append(received[i], msg.Payload)
+			wg.Done()
+		})
+		assert.NoError(t, err)
+	}
+
+	var expected []interface{}
+	for i := 0; i < messages; i++ {
+		expected = append(expected, i)
+		assert.NoError(t, b.Publish(topic1, testEnvelope(i)))
+	}
+
+	waitGroup(t, &wg)
+	for i := 0; i < subscribers; i++ {
+		assert.Equal(t, expected, received[i], "subscriber %d", i)
+	}
+}
+
+func TestMessageBroker_Publish_NoSubscribers(t *testing.T) {
+	b := New()
+	err := b.AddTopic(topic1)
+	assert.NoError(t, err)
+	assert.NoError(t, b.Publish(topic1, testEnvelope("test")))
+}
+
+func TestMessageBroker_Unsubscribe(t *testing.T) {
+	b := New()
+	err := b.AddTopic(topic1)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	unsubscribed, err := b.Subscribe(topic1, func(msg Envelope) {
+		assert.Fail(t, "unsubscribed consumer received message")
+	})
+	assert.NoError(t, err)
+	_, err = b.Subscribe(topic1, func(msg Envelope) {
+		wg.Done()
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, b.Unsubscribe(unsubscribed))
+	assert.Len(t, b.(*messageBroker).topics[topic1].subscribers, 1)
+	assert.NoError(t, b.Publish(topic1, testEnvelope("test")))
+	waitGroup(t, &wg)
+
+	actualErr := b.Unsubscribe(unsubscribed)
+	expectedErr := fmt.Sprintf(noSubscription, unsubscribed.Id, topic1)
+	assert.EqualError(t, actualErr, expectedErr)
+}
+
+func TestMessageBroker_Unsubscribe_NoTopic(t *testing.T) {
+	b := New()
+	actualErr := b.Unsubscribe(Subscription{Topic: topic1})
+	expectedErr := fmt.Sprintf(unsubscribeNoTopic, topic1)
+	assert.EqualError(t, actualErr, expectedErr)
+}
+
+func waitGroup(t *testing.T, wg *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "messages haven't been consumed in time")
+	}
+}
+
+func TestMessageBroker_Close_DrainsQueues(t *testing.T) {
+	const messages = 20
+	b := New()
+	err := b.AddTopic(topic1)
+	assert.NoError(t, err)
+
+	consumed := 0
+	_, err = b.Subscribe(topic1, func(msg Envelope) {
+		time.Sleep(time.Millisecond)
+		consumed++
+	})
+	assert.NoError(t, err)
+	for i := 0; i < messages; i++ {
+		assert.NoError(t, b.Publish(topic1, testEnvelope(i)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, b.Close(ctx))
+	assert.Equal(t, messages, consumed)
+
+	assert.EqualError(t, b.Publish(topic1, testEnvelope("test")), brokerClosed)
+	_, err = b.Subscribe(topic1, func(Envelope) {})
+	assert.EqualError(t, err, brokerClosed)
+	assert.EqualError(t, b.AddTopic(topic1), brokerClosed)
+	assert.EqualError(t, b.Close(ctx), brokerClosed)
+}
+
+func TestMessageBroker_Close_Deadline(t *testing.T) {
+	b := New()
+	err := b.AddTopic(topic1)
+	assert.NoError(t, err)
+
+	release := make(chan struct{})
+	defer close(release)
+	_, err = b.Subscribe(topic1, func(msg Envelope) {
+		<-release
+	})
+	assert.NoError(t, err)
+	// first message blocks consumer, the rest fill the queue and block publisher
+	published := make(chan error)
+	go func() {
+		for i := 0; i < subscriberQueueSize+2; i++ {
+			if err := b.Publish(topic1, testEnvelope(i)); err != nil {
+				published <- err
+				return
+			}
+		}
+		published <- nil
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.Close(ctx))
+
+	select {
+	case err := <-published:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "publisher hasn't been unblocked")
+	}
+}
+
+func TestMessageBroker_Concurrency(t *testing.T) {
+	const workers = 8
+	b := New()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("topic%d", i%2)
+			assert.NoError(t, b.AddTopic(name))
+			sub, err := b.Subscribe(name, func(Envelope) {})
+			assert.NoError(t, err)
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, b.Publish(name, testEnvelope(j)))
+			}
+			assert.NoError(t, b.Unsubscribe(sub))
+		}(i)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, b.Close(ctx))
+}
+
+func testEnvelope(payload interface{}) Envelope {
+	return NewEnvelope("test", "", "test", payload)
+}
+
+func TestMessageBroker_ConsumerPanic(t *testing.T) {
+	b := New()
+	err := b.AddTopic(topic1)
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddTopic(DeadLetterTopic))
+
+	deadLetters := make(chan Envelope, 1)
+	_, err = b.Subscribe(DeadLetterTopic, func(msg Envelope) {
+		deadLetters <- msg
+	})
+	assert.NoError(t, err)
+
+	consumed := make(chan interface{}, 1)
+	attempts := 0
+	sub, err := b.Subscribe(topic1, func(msg Envelope) {
+		if msg.Payload == "poison" {
+			attempts++
+			panic("poison message")
+		}
+		consumed <- msg.Payload
+	}, WithName("consumer"), WithRetries(2))
+	assert.NoError(t, err)
+	assert.Equal(t, "consumer", sub.Name)
+
+	poison := testEnvelope("poison")
+	assert.NoError(t, b.Publish(topic1, poison))
+	assert.NoError(t, b.Publish(topic1, testEnvelope("valid")))
+
+	select {
+	case payload := <-consumed:
+		assert.Equal(t, "valid", payload)
+	case <-time.After(time.Second):
+		assert.Fail(t, "subscriber has stopped after panic")
+	}
+	select {
+	case msg := <-deadLetters:
+		deadLetter, err := msg.DeadLetter()
+		if assert.NoError(t, err) {
+			assert.Equal(t, topic1, deadLetter.Topic)
+			assert.Equal(t, "consumer", deadLetter.Subscriber)
+			assert.Equal(t, 3, deadLetter.Attempts)
+			assert.Equal(t, fmt.Sprintf(consumerPanic, "poison message"), deadLetter.Error)
+			assert.NotEmpty(t, deadLetter.Stack)
+			assert.Equal(t, poison.Id, deadLetter.Envelope.Id)
+		}
+	case <-time.After(time.Second):
+		assert.Fail(t, "dead letter hasn't been published")
+	}
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, uint64(3), b.Failures()[topic1+"/consumer"])
+}
+
+func TestMessageBroker_ConsumerPanic_Closing(t *testing.T) {
+	b := New()
+	assert.NoError(t, b.AddTopic(topic1))
+	logger := new(mockLogger)
+	logger.On("Errorf").Once()
+	started, release := make(chan struct{}), make(chan struct{})
+	_, err := b.Subscribe(topic1, func(msg Envelope) {
+		close(started)
+		<-release
+		panic("failed while closing")
+	}, WithLogger(logger))
+	assert.NoError(t, err)
+	assert.NoError(t, b.Publish(topic1, testEnvelope("message")))
+	<-started
+
+	closed := make(chan error)
+	go func() {
+		closed <- b.Close(context.Background())
+	}()
+	// let broker stop accepting messages before consumer fails
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	assert.NoError(t, <-closed)
+	logger.AssertExpectations(t)
+}
+
+func TestMessageBroker_Stats(t *testing.T) {
+	b := New()
+	assert.NoError(t, b.AddTopic(topic1))
+	assert.NoError(t, b.AddTopic("topic2"))
+	assert.NoError(t, b.Publish("topic2", testEnvelope("dropped")))
+
+	release := make(chan struct{})
+	consumed := make(chan struct{}, 10)
+	_, err := b.Subscribe(topic1, func(msg Envelope) {
+		<-release
+		if msg.Payload == "poison" {
+			panic("poison message")
+		}
+		consumed <- struct{}{}
+	})
+	assert.NoError(t, err)
+	for _, payload := range []string{"first", "poison", "second"} {
+		assert.NoError(t, b.Publish(topic1, testEnvelope(payload)))
+	}
+
+	stats := b.Stats()
+	if assert.Len(t, stats, 2) {
+		assert.Equal(t, topic1, stats[0].Name)
+		assert.Equal(t, 1, stats[0].Subscribers)
+		assert.Equal(t, uint64(3), stats[0].Published)
+		assert.True(t, stats[0].QueueDepth >= 2)
+		assert.NotNil(t, stats[0].LastMessageAt)
+		assert.Equal(t, "topic2", stats[1].Name)
+		assert.Equal(t, uint64(1), stats[1].Dropped)
+	}
+
+	close(release)
+	<-consumed
+	<-consumed
+	// poison message is dropped and published to dead letters topic, that is listed first
+	assert.Eventually(t, func() bool {
+		stats := b.Stats()
+		return len(stats) == 3 && stats[0].Name == DeadLetterTopic &&
+			stats[1].Delivered == 2 && stats[1].Dropped == 1 && stats[1].QueueDepth == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMessageBroker_PatternSubscription(t *testing.T) {
+	const (
+		public  = "gitlab.main.pipeline.public"
+		replay  = "gitlab.main.pipeline.public.replay"
+		pattern = "gitlab.*.pipeline.*"
+	)
+	b := New()
+	assert.EqualError(t, b.AddTopic(pattern), fmt.Sprintf(topicIsPattern, pattern))
+	assert.NoError(t, b.AddTopic(public))
+	assert.NoError(t, b.AddTopic(replay))
+
+	consumed := make(chan Envelope, 10)
+	subscription, err := b.Subscribe(pattern, func(msg Envelope) {
+		consumed <- msg
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, pattern, subscription.Topic)
+	all := make(chan Envelope, 10)
+	_, err = b.Subscribe("gitlab.#", func(msg Envelope) {
+		all <- msg
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, b.Publish(replay, testEnvelope("replay")))
+	assert.NoError(t, b.Publish(public, testEnvelope("public")))
+	actual := receive(t, consumed)
+	assert.Equal(t, "public", actual.Payload)
+	assert.Equal(t, public, actual.Topic)
+	assert.Equal(t, replay, receive(t, all).Topic)
+	assert.Equal(t, public, receive(t, all).Topic)
+
+	stats := b.Stats()
+	if assert.Len(t, stats, 4) {
+		assert.Equal(t, "gitlab.#", stats[0].Name)
+		assert.True(t, stats[0].Pattern)
+		assert.Equal(t, uint64(2), stats[0].Published)
+		assert.Equal(t, pattern, stats[1].Name)
+		assert.Equal(t, uint64(1), stats[1].Published)
+	}
+
+	assert.NoError(t, b.Unsubscribe(subscription))
+	assert.NoError(t, b.Publish(public, testEnvelope("public")))
+	receive(t, all)
+	assert.Empty(t, consumed)
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"errors"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"sync"
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetterRecord is dead letter identified by id of its envelope.
+type DeadLetterRecord struct {
+	Id string `json:"id"`
+	DeadLetter
+}
+
+type DeadLetterStore interface {
+	List() []DeadLetterRecord
+	Replay(id string) error
+}
+
+// deadLetterStore keeps last dead letters from DeadLetterTopic in memory.
+type deadLetterStore struct {
+	broker   MessageBroker
+	logger   logging.Logger
+	capacity int
+	lock     *sync.Mutex
+	records  []DeadLetterRecord
+}
+
+// Creates dead letters store and subscribes it to DeadLetterTopic.
+// capacity - max number of kept dead letters, the oldest are removed first
+func NewDeadLetterStore(b MessageBroker, capacity int, logger logging.Logger) (DeadLetterStore, error) {
+	store := &deadLetterStore{
+		broker:   b,
+		logger:   logger,
+		capacity: capacity,
+		lock:     new(sync.Mutex),
+	}
+	if err := b.AddTopic(DeadLetterTopic); err != nil {
+		return nil, err
+	}
+	_, err := SubscribeDeadLetters(b, DeadLetterTopic, store.add, logger, WithName("dead_letter_store"))
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Returns stored dead letters, oldest first.
+func (s *deadLetterStore) List() []DeadLetterRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]DeadLetterRecord(nil), s.records...)
+}
+
+// Passes original message of dead letter again to the subscriber that failed to process it
+// and removes dead letter from store.
+func (s *deadLetterStore) Replay(id string) error {
+	s.lock.Lock()
+	index := -1
+	for i, record := range s.records {
+		if record.Id == id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		s.lock.Unlock()
+		return ErrDeadLetterNotFound
+	}
+	record := s.records[index]
+	s.records = append(s.records[:index], s.records[index+1:]...)
+	s.lock.Unlock()
+
+	if err := s.broker.Redeliver(record.Topic, record.Subscriber, record.Envelope); err != nil {
+		s.lock.Lock()
+		s.records = append(s.records, record)
+		s.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *deadLetterStore) add(envelope Envelope, deadLetter DeadLetter) {
+	s.logger.Errorf("Subscriber %s of topic %s failed to process message %s after %d attempts: %s",
+		deadLetter.Subscriber, deadLetter.Topic, deadLetter.Envelope.Id, deadLetter.Attempts, deadLetter.Error)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.records = append(s.records, DeadLetterRecord{envelope.Id, deadLetter})
+	if len(s.records) > s.capacity {
+		s.records = s.records[len(s.records)-s.capacity:]
+	}
+}
@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterStore(t *testing.T) {
+	b := New()
+	assert.NoError(t, b.AddTopic(topic1))
+	logger := new(mockLogger)
+	logger.On("Errorf")
+	store, err := NewDeadLetterStore(b, 2, logger)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	replayed := make(chan Envelope, 1)
+	_, err = b.Subscribe(topic1, func(msg Envelope) {
+		replayed <- msg
+	}, WithName("failed"))
+	assert.NoError(t, err)
+	_, err = b.Subscribe(topic1, func(msg Envelope) {
+		assert.Fail(t, "dead letter has been replayed to subscriber that processed it")
+	}, WithName("succeeded"))
+	assert.NoError(t, err)
+
+	for _, payload := range []string{"first", "second", "third"} {
+		deadLetter := DeadLetter{Topic: topic1, Subscriber: "failed", Envelope: testEnvelope(payload)}
+		assert.NoError(t, b.Publish(DeadLetterTopic, NewDeadLetterEnvelope("", "", deadLetter)))
+	}
+	assert.Eventually(t, func() bool {
+		records := store.List()
+		return len(records) == 2 && records[1].Envelope.Payload == "third"
+	}, time.Second, 10*time.Millisecond)
+
+	records := store.List()
+	assert.Equal(t, "second", records[0].Envelope.Payload)
+	assert.Equal(t, ErrDeadLetterNotFound, store.Replay("unknown"))
+	assert.NoError(t, store.Replay(records[0].Id))
+	select {
+	case msg := <-replayed:
+		assert.Equal(t, records[0].Envelope.Id, msg.Id)
+	case <-time.After(time.Second):
+		assert.Fail(t, "dead letter hasn't been replayed")
+	}
+	assert.Len(t, store.List(), 1)
+	time.Sleep(10 * time.Millisecond)
+}
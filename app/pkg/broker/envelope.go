@@ -0,0 +1,230 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"time"
+)
+
+// payload kinds
+const (
+	KindPipeline    = "pipeline"
+	KindDeadLetter  = "dead_letter"
+	KindCacheChange = "cache_change"
+)
+
+// Errors
+const (
+	invalidPayload = "envelope %s: expected %s payload, got kind '%s' with payload %T"
+)
+
+// Envelope wraps every message published to broker with its metadata.
+// Topic is set by broker on publish.
+type Envelope struct {
+	Id            string      `json:"id"`
+	Topic         string      `json:"topic"`
+	Source        string      `json:"source"`
+	ReceivedAt    time.Time   `json:"received_at"`
+	CorrelationId string      `json:"correlation_id"`
+	Kind          string      `json:"kind"`
+	Payload       interface{} `json:"payload"`
+}
+
+// DeadLetter describes message that consumer failed to process.
+type DeadLetter struct {
+	Topic      string    `json:"topic"`
+	Subscriber string    `json:"subscriber"`
+	Error      string    `json:"error"`
+	Stack      string    `json:"stack"`
+	Attempts   int       `json:"attempts"`
+	FailedAt   time.Time `json:"failed_at"`
+	Envelope   Envelope  `json:"envelope"`
+}
+
+type PipelineConsumer func(Envelope, contracts.PipelinePush)
+
+type DeadLetterConsumer func(Envelope, DeadLetter)
+
+type CacheChangeConsumer func(Envelope, contracts.CacheChange)
+
+// Creates envelope with new id for given payload.
+// source - name of the service instance that received the payload
+// correlationId - id of the request that produced the payload
+func NewEnvelope(source, correlationId, kind string, payload interface{}) Envelope {
+	return Envelope{
+		Id:            uuid.New().String(),
+		Source:        source,
+		ReceivedAt:    time.Now().UTC(),
+		CorrelationId: correlationId,
+		Kind:          kind,
+		Payload:       payload,
+	}
+}
+
+// Creates envelope with pipeline webhook message.
+func NewPipelineEnvelope(source, correlationId string, push contracts.PipelinePush) Envelope {
+	return NewEnvelope(source, correlationId, KindPipeline, push)
+}
+
+// Creates envelope with dead letter.
+func NewDeadLetterEnvelope(source, correlationId string, deadLetter DeadLetter) Envelope {
+	return NewEnvelope(source, correlationId, KindDeadLetter, deadLetter)
+}
+
+// Creates envelope with change of projects cache.
+func NewCacheChangeEnvelope(source, correlationId string, change contracts.CacheChange) Envelope {
+	return NewEnvelope(source, correlationId, KindCacheChange, change)
+}
+
+// Decodes envelope and its payload according to payload kind.
+// Payloads of unknown kinds are kept as json.RawMessage, null payload is decoded as nil.
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	type envelope Envelope
+	raw := struct {
+		envelope
+		Payload json.RawMessage `json:"payload"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*e = Envelope(raw.envelope)
+	switch e.Kind {
+	case KindPipeline:
+		var push contracts.PipelinePush
+		if err := json.Unmarshal(raw.Payload, &push); err != nil {
+			return err
+		}
+		e.Payload = push
+	case KindDeadLetter:
+		var deadLetter DeadLetter
+		if err := json.Unmarshal(raw.Payload, &deadLetter); err != nil {
+			return err
+		}
+		e.Payload = deadLetter
+	case KindCacheChange:
+		var change contracts.CacheChange
+		if err := json.Unmarshal(raw.Payload, &change); err != nil {
+			return err
+		}
+		e.Payload = change
+	default:
+		if string(raw.Payload) != "null" {
+			e.Payload = raw.Payload
+		}
+	}
+	return nil
+}
+
+// Returns pipeline webhook message, if envelope contains it.
+func (e Envelope) PipelinePush() (push contracts.PipelinePush, err error) {
+	if e.Kind == KindPipeline {
+		switch payload := e.Payload.(type) {
+		case contracts.PipelinePush:
+			return payload, nil
+		case *contracts.PipelinePush:
+			if payload != nil {
+				return *payload, nil
+			}
+		}
+	}
+	return push, fmt.Errorf(invalidPayload, e.Id, KindPipeline, e.Kind, e.Payload)
+}
+
+// Returns dead letter, if envelope contains it.
+func (e Envelope) DeadLetter() (deadLetter DeadLetter, err error) {
+	if e.Kind == KindDeadLetter {
+		switch payload := e.Payload.(type) {
+		case DeadLetter:
+			return payload, nil
+		case *DeadLetter:
+			if payload != nil {
+				return *payload, nil
+			}
+		}
+	}
+	return deadLetter, fmt.Errorf(invalidPayload, e.Id, KindDeadLetter, e.Kind, e.Payload)
+}
+
+// Returns change of projects cache, if envelope contains it.
+func (e Envelope) CacheChange() (change contracts.CacheChange, err error) {
+	if e.Kind == KindCacheChange {
+		switch payload := e.Payload.(type) {
+		case contracts.CacheChange:
+			return payload, nil
+		case *contracts.CacheChange:
+			if payload != nil {
+				return *payload, nil
+			}
+		}
+	}
+	return change, fmt.Errorf(invalidPayload, e.Id, KindCacheChange, e.Kind, e.Payload)
+}
+
+// Subscribes consumer to pipeline messages of the topic.
+// Messages with other payloads are skipped and logged.
+func SubscribePipelines(
+	b MessageBroker,
+	topicName string,
+	consumer PipelineConsumer,
+	logger logging.Logger,
+	options ...SubscribeOption) (Subscription, error) {
+
+	if consumer == nil {
+		return Subscription{}, fmt.Errorf(consumerIsNil)
+	}
+	return b.Subscribe(topicName, func(envelope Envelope) {
+		push, err := envelope.PipelinePush()
+		if err != nil {
+			logger.Errorf("Topic %s: %v", topicName, err)
+			return
+		}
+		consumer(envelope, push)
+	}, append([]SubscribeOption{WithLogger(logger)}, options...)...)
+}
+
+// Subscribes consumer to dead letters of the topic.
+// Messages with other payloads are skipped and logged.
+func SubscribeDeadLetters(
+	b MessageBroker,
+	topicName string,
+	consumer DeadLetterConsumer,
+	logger logging.Logger,
+	options ...SubscribeOption) (Subscription, error) {
+
+	if consumer == nil {
+		return Subscription{}, fmt.Errorf(consumerIsNil)
+	}
+	return b.Subscribe(topicName, func(envelope Envelope) {
+		deadLetter, err := envelope.DeadLetter()
+		if err != nil {
+			logger.Errorf("Topic %s: %v", topicName, err)
+			return
+		}
+		consumer(envelope, deadLetter)
+	}, append([]SubscribeOption{WithLogger(logger)}, options...)...)
+}
+
+// Subscribes consumer to changes of projects cache published to the topic.
+// Messages with other payloads are skipped and logged.
+func SubscribeCacheChanges(
+	b MessageBroker,
+	topicName string,
+	consumer CacheChangeConsumer,
+	logger logging.Logger,
+	options ...SubscribeOption) (Subscription, error) {
+
+	if consumer == nil {
+		return Subscription{}, fmt.Errorf(consumerIsNil)
+	}
+	return b.Subscribe(topicName, func(envelope Envelope) {
+		change, err := envelope.CacheChange()
+		if err != nil {
+			logger.Errorf("Topic %s: %v", topicName, err)
+			return
+		}
+		consumer(envelope, change)
+	}, append([]SubscribeOption{WithLogger(logger)}, options...)...)
+}
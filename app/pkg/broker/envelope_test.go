@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+// mockLogger duplicates tests.MockLogger, which can't be imported here because of import cycle.
+type mockLogger struct {
+	mock.Mock
+}
+
+func (m *mockLogger) Infof(_ string, _ ...interface{}) {
+	m.Called()
+}
+
+func (m *mockLogger) Warnf(_ string, _ ...interface{}) {
+	m.Called()
+}
+
+func (m *mockLogger) Errorf(_ string, _ ...interface{}) {
+	m.Called()
+}
+
+func TestNewPipelineEnvelope(t *testing.T) {
+	push := contracts.PipelinePush{Kind: "pipeline"}
+	envelope := NewPipelineEnvelope("instance", "correlation", push)
+	assert.NotEmpty(t, envelope.Id)
+	assert.Equal(t, "instance", envelope.Source)
+	assert.Equal(t, "correlation", envelope.CorrelationId)
+	assert.Equal(t, KindPipeline, envelope.Kind)
+	assert.False(t, envelope.ReceivedAt.IsZero())
+	assert.NotEqual(t, envelope.Id, NewPipelineEnvelope("instance", "correlation", push).Id)
+}
+
+func TestEnvelope_PipelinePush(t *testing.T) {
+	expected := contracts.PipelinePush{Kind: "pipeline"}
+
+	actual, err := NewPipelineEnvelope("", "", expected).PipelinePush()
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, actual)
+	}
+	actual, err = NewEnvelope("", "", KindPipeline, &expected).PipelinePush()
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, actual)
+	}
+
+	envelope := NewEnvelope("", "", "other", expected)
+	_, err = envelope.PipelinePush()
+	assert.EqualError(t, err, fmt.Sprintf(invalidPayload, envelope.Id, KindPipeline, "other", expected))
+
+	envelope = NewEnvelope("", "", KindPipeline, "text")
+	_, err = envelope.PipelinePush()
+	assert.EqualError(t, err, fmt.Sprintf(invalidPayload, envelope.Id, KindPipeline, KindPipeline, "text"))
+}
+
+func TestEnvelope_UnmarshalJSON(t *testing.T) {
+	push := contracts.PipelinePush{Kind: "pipeline", Attributes: &contracts.Attributes{Id: 1, Status: "success"}}
+	for _, expected := range []Envelope{
+		NewPipelineEnvelope("instance", "correlation", push),
+		NewDeadLetterEnvelope("", "", DeadLetter{Topic: topic1, Attempts: 1}),
+		NewCacheChangeEnvelope("", "", contracts.CacheChange{
+			Type:      contracts.PipelineCreated,
+			ProjectId: 1,
+			Pipeline:  &contracts.Pipeline{Id: 10, Status: "running"},
+		}),
+		NewEnvelope("", "", "other", json.RawMessage(`{"key":"value"}`)),
+	} {
+		data, err := json.Marshal(expected)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		var actual Envelope
+		if assert.NoError(t, json.Unmarshal(data, &actual)) {
+			assert.Equal(t, expected.Id, actual.Id)
+			assert.True(t, expected.ReceivedAt.Equal(actual.ReceivedAt))
+			assert.Equal(t, expected.Payload, actual.Payload)
+		}
+	}
+}
+
+func TestSubscribePipelines(t *testing.T) {
+	b := New()
+	err := b.AddTopic(topic1)
+	assert.NoError(t, err)
+	logger := new(mockLogger)
+	logger.On("Errorf").Once()
+
+	received := make(chan contracts.PipelinePush, 2)
+	_, err = SubscribePipelines(b, topic1, func(_ Envelope, push contracts.PipelinePush) {
+		received <- push
+	}, logger)
+	assert.NoError(t, err)
+
+	expected := contracts.PipelinePush{Kind: "pipeline"}
+	assert.NoError(t, b.Publish(topic1, testEnvelope("invalid")))
+	assert.NoError(t, b.Publish(topic1, NewPipelineEnvelope("", "", expected)))
+
+	assert.Equal(t, expected, <-received)
+	logger.AssertExpectations(t)
+}
+
+func TestSubscribeCacheChanges(t *testing.T) {
+	b := New()
+	assert.NoError(t, b.AddTopic(CacheChangesTopic))
+	logger := new(mockLogger)
+	logger.On("Errorf").Once()
+
+	received := make(chan contracts.CacheChange, 2)
+	_, err := SubscribeCacheChanges(b, CacheChangesTopic, func(_ Envelope, change contracts.CacheChange) {
+		received <- change
+	}, logger)
+	assert.NoError(t, err)
+
+	expected := contracts.CacheChange{Type: contracts.ProjectAdded, ProjectId: 1}
+	assert.NoError(t, b.Publish(CacheChangesTopic, NewPipelineEnvelope("", "", contracts.PipelinePush{})))
+	assert.NoError(t, b.Publish(CacheChangesTopic, NewCacheChangeEnvelope("", "", expected)))
+
+	assert.Equal(t, expected, <-received)
+	logger.AssertExpectations(t)
+}
+
+func TestSubscribePipelines_NilConsumer(t *testing.T) {
+	_, err := SubscribePipelines(New(), topic1, nil, new(mockLogger))
+	assert.EqualError(t, err, consumerIsNil)
+}
@@ -0,0 +1,292 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Prefix of redis channels used as topics.
+const redisChannelPrefix = "gitlab_extension:"
+
+// redisBroker publishes messages to redis channels, so every instance of the service
+// that subscribed to the topic receives them.
+// Patterns are subscribed with PSUBSCRIBE to all channels with the same prefix and matched locally.
+// Redis pub/sub delivers message at most once, messages published while subscriber is disconnected are lost.
+type redisBroker struct {
+	client        *redis.Client
+	topics        map[string]*counters
+	patterns      map[string]*counters
+	subscriptions map[uint64]*redisSubscription
+	lock          *sync.RWMutex
+	lastId        uint64
+	closed        bool
+	publishing    sync.WaitGroup
+}
+
+// redisSubscription forwards messages from redis channel to the queue of subscriber.
+type redisSubscription struct {
+	*subscriber
+	pubSub *redis.PubSub
+}
+
+// Returns pointer to new redisBroker instance connected to redis at given url,
+// e.g. 'redis://:password@localhost:6379/0'.
+func NewRedis(url string) (MessageBroker, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping().Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return &redisBroker{
+		client:        client,
+		topics:        make(map[string]*counters),
+		patterns:      make(map[string]*counters),
+		subscriptions: make(map[uint64]*redisSubscription),
+		lock:          new(sync.RWMutex),
+	}, nil
+}
+
+// Adds new topic, if topic with given name exists nothing will happen.
+func (b *redisBroker) AddTopic(name string) error {
+	if name == "" {
+		return fmt.Errorf(topicNameIsEmpty)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if IsPattern(name) {
+		return fmt.Errorf(topicIsPattern, name)
+	}
+	if b.closed {
+		return fmt.Errorf(brokerClosed)
+	}
+	if _, ok := b.topics[name]; !ok {
+		b.topics[name] = new(counters)
+	}
+	return nil
+}
+
+// Publishes message to redis channel of the topic.
+func (b *redisBroker) Publish(topicName string, envelope Envelope) error {
+	b.lock.RLock()
+	if b.closed {
+		b.lock.RUnlock()
+		return fmt.Errorf(brokerClosed)
+	}
+	topicCounters, ok := b.topics[topicName]
+	if !ok {
+		b.lock.RUnlock()
+		return fmt.Errorf(publishNoTopic, topicName)
+	}
+	published := []*counters{topicCounters}
+	for pattern, patternCounters := range b.patterns {
+		if MatchTopic(pattern, topicName) {
+			published = append(published, patternCounters)
+		}
+	}
+	b.publishing.Add(1)
+	defer b.publishing.Done()
+	b.lock.RUnlock()
+
+	envelope.Topic = topicName
+	value, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if err := b.client.Publish(redisChannelPrefix+topicName, value).Err(); err != nil {
+		return err
+	}
+	for _, c := range published {
+		c.publish()
+	}
+	return nil
+}
+
+// Subscribes consumer to redis channel of the topic.
+// Returns after redis confirms subscription, so consumer receives every message published after that.
+func (b *redisBroker) Subscribe(
+	topicName string,
+	consumer Consumer,
+	options ...SubscribeOption) (subscription Subscription, err error) {
+
+	if consumer == nil {
+		return subscription, fmt.Errorf(consumerIsNil)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return subscription, fmt.Errorf(brokerClosed)
+	}
+	var pubSub *redis.PubSub
+	topicCounters, ok := b.topics[topicName]
+	if IsPattern(topicName) {
+		if topicCounters, ok = b.patterns[topicName]; !ok {
+			topicCounters = new(counters)
+			b.patterns[topicName] = topicCounters
+		}
+		pubSub = b.client.PSubscribe(redisChannelPrefix + "*")
+	} else if !ok {
+		return subscription, fmt.Errorf(subscribeNoTopic, topicName)
+	} else {
+		pubSub = b.client.Subscribe(redisChannelPrefix + topicName)
+	}
+	if _, err = pubSub.Receive(); err != nil {
+		_ = pubSub.Close()
+		return
+	}
+	b.lastId++
+	s := &redisSubscription{newSubscriber(b, b.lastId, topicName, topicCounters, consumer, options), pubSub}
+	b.subscriptions[b.lastId] = s
+	go s.forward()
+	go s.consume()
+	return Subscription{topicName, s.name, b.lastId}, nil
+}
+
+// Unsubscribes consumer from redis channel, messages that weren't consumed yet are discarded.
+func (b *redisBroker) Unsubscribe(subscription Subscription) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return fmt.Errorf(brokerClosed)
+	}
+	_, ok := b.topics[subscription.Topic]
+	if IsPattern(subscription.Topic) {
+		_, ok = b.patterns[subscription.Topic]
+	}
+	if !ok {
+		return fmt.Errorf(unsubscribeNoTopic, subscription.Topic)
+	}
+	s, ok := b.subscriptions[subscription.Id]
+	if !ok || s.topic != subscription.Topic {
+		return fmt.Errorf(noSubscription, subscription.Id, subscription.Topic)
+	}
+	delete(b.subscriptions, subscription.Id)
+	s.counters.drop(s.depth())
+	close(s.done)
+	return s.pubSub.Close()
+}
+
+// Passes message of topic to subscribers with given name of this instance only, see messageBroker.Redeliver.
+func (b *redisBroker) Redeliver(topicName, subscriberName string, envelope Envelope) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		return fmt.Errorf(brokerClosed)
+	}
+	var subscribers []*subscriber
+	for _, s := range b.subscriptions {
+		if MatchTopic(s.topic, topicName) {
+			subscribers = append(subscribers, s.subscriber)
+		}
+	}
+	envelope.Topic = topicName
+	return redeliver(subscribers, subscriberName, envelope)
+}
+
+// Returns stats of every topic and subscribed pattern, sorted by name.
+// Published messages are counted only for this instance, delivered ones include messages from other instances.
+func (b *redisBroker) Stats() []TopicStats {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	subscribers := make(map[string]int)
+	queueDepth := make(map[string]int)
+	for _, s := range b.subscriptions {
+		subscribers[s.topic]++
+		queueDepth[s.topic] += s.depth()
+	}
+	result := make([]TopicStats, 0, len(b.topics)+len(b.patterns))
+	for _, topics := range []map[string]*counters{b.topics, b.patterns} {
+		for name, topicCounters := range topics {
+			result = append(result, topicCounters.stats(name, subscribers[name], queueDepth[name]))
+		}
+	}
+	return sortStats(result)
+}
+
+// Returns number of consumer failures for every subscriber, keyed by 'topic/name'.
+func (b *redisBroker) Failures() map[string]uint64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	result := make(map[string]uint64)
+	for _, s := range b.subscriptions {
+		result[s.topic+"/"+s.name] = atomic.LoadUint64(&s.failures)
+	}
+	return result
+}
+
+// Stops accepting new messages and subscriptions, waits for running publishes,
+// unsubscribes from redis and waits until consumers process received messages.
+// If ctx is done earlier, received messages are discarded and ctx error is returned.
+func (b *redisBroker) Close(ctx context.Context) (err error) {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return fmt.Errorf(brokerClosed)
+	}
+	b.closed = true
+	var subscribers []*subscriber
+	for _, s := range b.subscriptions {
+		subscribers = append(subscribers, s.subscriber)
+	}
+	b.lock.Unlock()
+	defer func() {
+		if closeErr := b.client.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	published := make(chan struct{})
+	go func() {
+		b.publishing.Wait()
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-ctx.Done():
+		abort(subscribers)
+		return ctx.Err()
+	}
+
+	for _, s := range b.subscriptions {
+		_ = s.pubSub.Close()
+	}
+	for _, s := range subscribers {
+		select {
+		case <-s.stopped:
+		case <-ctx.Done():
+			abort(subscribers)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Decodes messages from redis channel and passes them to subscriber queue until channel is closed.
+// Pattern subscriber skips messages of topics that don't match its pattern.
+func (s *redisSubscription) forward() {
+	for message := range s.pubSub.Channel() {
+		if !MatchTopic(s.topic, strings.TrimPrefix(message.Channel, redisChannelPrefix)) {
+			continue
+		}
+		var envelope Envelope
+		if err := json.Unmarshal([]byte(message.Payload), &envelope); err != nil {
+			atomic.AddUint64(&s.failures, 1)
+			s.counters.drop(1)
+			continue
+		}
+		// keep reading after unsubscribe, so redis client isn't blocked until channel is closed
+		select {
+		case s.queue <- envelope:
+		case <-s.done:
+		}
+	}
+	close(s.queue)
+}
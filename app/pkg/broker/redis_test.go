@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRedisBroker_PubSub(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := openRedis(t, server)
+	second := openRedis(t, server)
+	defer second.Close(context.Background())
+
+	consumed := make(chan Envelope, 10)
+	for _, b := range []MessageBroker{first, second} {
+		_, err := b.Subscribe(topic1, func(msg Envelope) {
+			consumed <- msg
+		})
+		assert.NoError(t, err)
+	}
+
+	expected := testEnvelope("test")
+	assert.NoError(t, first.Publish(topic1, expected))
+	for i := 0; i < 2; i++ {
+		actual := receive(t, consumed)
+		assert.Equal(t, expected.Id, actual.Id)
+		assert.Equal(t, json.RawMessage(`"test"`), actual.Payload)
+	}
+	assert.NoError(t, first.Close(context.Background()))
+	assert.EqualError(t, first.Publish(topic1, expected), brokerClosed)
+}
+
+func TestRedisBroker_Unsubscribe(t *testing.T) {
+	server := miniredis.RunT(t)
+	b := openRedis(t, server)
+	defer b.Close(context.Background())
+
+	consumed := make(chan Envelope, 10)
+	subscription, err := b.Subscribe(topic1, func(msg Envelope) {
+		consumed <- msg
+	})
+	assert.NoError(t, err)
+	other := make(chan Envelope, 10)
+	_, err = b.Subscribe(topic1, func(msg Envelope) {
+		other <- msg
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, b.Unsubscribe(subscription))
+	assert.Error(t, b.Unsubscribe(subscription))
+	assert.NoError(t, b.Publish(topic1, testEnvelope("test")))
+	receive(t, other)
+	assert.Empty(t, consumed)
+}
+
+func TestRedisBroker_NoTopic(t *testing.T) {
+	server := miniredis.RunT(t)
+	b := openRedis(t, server)
+	defer b.Close(context.Background())
+
+	assert.Error(t, b.Publish("unknown", testEnvelope("test")))
+	_, err := b.Subscribe("unknown", func(Envelope) {})
+	assert.Error(t, err)
+}
+
+func TestNewRedis_Unavailable(t *testing.T) {
+	server := miniredis.RunT(t)
+	addr := server.Addr()
+	server.Close()
+	_, err := NewRedis("redis://" + addr)
+	assert.Error(t, err)
+}
+
+func openRedis(t *testing.T, server *miniredis.Miniredis) MessageBroker {
+	b, err := NewRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddTopic(topic1); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRedisBroker_PatternSubscription(t *testing.T) {
+	server := miniredis.RunT(t)
+	b := openRedis(t, server)
+	defer b.Close(context.Background())
+	topic := PipelineTopic("main", "public")
+	assert.NoError(t, b.AddTopic(topic))
+
+	consumed := make(chan Envelope, 10)
+	_, err := b.Subscribe(PipelinesPattern, func(msg Envelope) {
+		consumed <- msg
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, b.Publish(topic1, testEnvelope("other")))
+	assert.NoError(t, b.Publish(topic, testEnvelope("public")))
+	actual := receive(t, consumed)
+	assert.Equal(t, topic, actual.Topic)
+	assert.Equal(t, json.RawMessage(`"public"`), actual.Payload)
+	assert.Empty(t, consumed)
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// TopicStats describes current state of the topic or subscribed topic pattern.
+// Pattern - name is a pattern, published messages are the ones published to matching topics
+// Published - number of messages published to the topic
+// Delivered - number of messages processed by consumers, every subscriber is counted separately
+// Dropped - number of messages discarded because topic had no subscribers,
+// subscriber was removed before processing them or consumer failed to process them
+// QueueDepth - number of messages waiting for consumers of the topic
+// LastMessageAt - time of the last published message, nil if there were no messages
+type TopicStats struct {
+	Name          string     `json:"name"`
+	Pattern       bool       `json:"pattern"`
+	Subscribers   int        `json:"subscribers"`
+	QueueDepth    int        `json:"queue_depth"`
+	Published     uint64     `json:"published"`
+	Delivered     uint64     `json:"delivered"`
+	Dropped       uint64     `json:"dropped"`
+	LastMessageAt *time.Time `json:"last_message_at"`
+}
+
+// counters of topic messages, shared by topic and its subscribers and updated atomically.
+type counters struct {
+	published     uint64
+	delivered     uint64
+	dropped       uint64
+	lastMessageAt int64
+}
+
+func (c *counters) publish() {
+	atomic.AddUint64(&c.published, 1)
+	atomic.StoreInt64(&c.lastMessageAt, time.Now().UnixNano())
+}
+
+func (c *counters) deliver() {
+	atomic.AddUint64(&c.delivered, 1)
+}
+
+func (c *counters) drop(count int) {
+	atomic.AddUint64(&c.dropped, uint64(count))
+}
+
+func (c *counters) stats(name string, subscribers, queueDepth int) TopicStats {
+	result := TopicStats{
+		Name:        name,
+		Pattern:     IsPattern(name),
+		Subscribers: subscribers,
+		QueueDepth:  queueDepth,
+		Published:   atomic.LoadUint64(&c.published),
+		Delivered:   atomic.LoadUint64(&c.delivered),
+		Dropped:     atomic.LoadUint64(&c.dropped),
+	}
+	if lastMessageAt := atomic.LoadInt64(&c.lastMessageAt); lastMessageAt != 0 {
+		at := time.Unix(0, lastMessageAt).UTC()
+		result.LastMessageAt = &at
+	}
+	return result
+}
+
+// Sorts topics stats by name.
+func sortStats(stats []TopicStats) []TopicStats {
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
@@ -0,0 +1,253 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prologic/bitcask"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	messageKeyFormat = "message/%s/%020d"
+	headKeyPrefix    = "head/"
+	offsetKeyPrefix  = "offset/"
+	patternKeyPrefix = "pattern/"
+	maxKeySize       = 512
+	maxValueSize     = 1 << 20
+)
+
+// store is an append-only log of published messages backed by bitcask.
+// Every topic has its own sequence of messages, every subscriber has its own offset in the topic.
+// Every subscribed pattern has its own sequence of messages published to matching topics,
+// patterns are remembered, so messages published after restart are kept until pattern subscribers return.
+type store struct {
+	db       *bitcask.Bitcask
+	lock     *sync.Mutex
+	heads    map[string]uint64
+	patterns map[string]struct{}
+	closed   bool
+}
+
+// Opens store at given path and loads last sequence number of every topic.
+func openStore(path string) (*store, error) {
+	db, err := bitcask.Open(path, bitcask.WithMaxKeySize(maxKeySize), bitcask.WithMaxValueSize(maxValueSize))
+	if err != nil {
+		return nil, err
+	}
+	result := &store{
+		db:       db,
+		lock:     new(sync.Mutex),
+		heads:    make(map[string]uint64),
+		patterns: make(map[string]struct{}),
+	}
+	err = db.Scan([]byte(headKeyPrefix), func(key []byte) error {
+		head, err := result.get(key)
+		if err != nil {
+			return err
+		}
+		result.heads[strings.TrimPrefix(string(key), headKeyPrefix)] = head
+		return nil
+	})
+	if err == nil {
+		err = db.Scan([]byte(patternKeyPrefix), func(key []byte) error {
+			result.patterns[strings.TrimPrefix(string(key), patternKeyPrefix)] = struct{}{}
+			return nil
+		})
+	}
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+// Appends message to the end of topic log and logs of matching patterns.
+func (s *store) append(topic string, envelope Envelope) error {
+	value, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return fmt.Errorf(brokerClosed)
+	}
+	if err := s.appendValue(topic, value); err != nil {
+		return err
+	}
+	for pattern := range s.patterns {
+		if MatchTopic(pattern, topic) {
+			if err := s.appendValue(pattern, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Remembers pattern, so messages of matching topics are added to its log.
+func (s *store) addPattern(pattern string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return fmt.Errorf(brokerClosed)
+	}
+	if _, ok := s.patterns[pattern]; ok {
+		return nil
+	}
+	if err := s.db.Put([]byte(patternKeyPrefix+pattern), []byte{}); err != nil {
+		return err
+	}
+	s.patterns[pattern] = struct{}{}
+	return nil
+}
+
+// Reads message with given sequence number, found is false if there is no such message yet.
+// Message that can't be decoded is found, but returned with error.
+func (s *store) read(topic string, seq uint64) (envelope Envelope, found bool, err error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return envelope, false, fmt.Errorf(brokerClosed)
+	}
+	value, err := s.db.Get(messageKey(topic, seq))
+	s.lock.Unlock()
+	if err == bitcask.ErrKeyNotFound {
+		return envelope, false, nil
+	}
+	if err != nil {
+		return
+	}
+	return envelope, true, json.Unmarshal(value, &envelope)
+}
+
+// Returns sequence number of the last message in topic.
+func (s *store) head(topic string) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.heads[topic]
+}
+
+// Returns offset of subscriber in topic.
+// Subscriber that is seen for the first time starts from the end of topic log.
+func (s *store) offset(topic, name string) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, fmt.Errorf(brokerClosed)
+	}
+	offset, err := s.get(offsetKey(topic, name))
+	if err == bitcask.ErrKeyNotFound {
+		offset = s.heads[topic]
+		err = s.put(offsetKey(topic, name), offset)
+	}
+	return offset, err
+}
+
+// Saves sequence number of the last message processed by subscriber.
+func (s *store) commit(topic, name string, offset uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return fmt.Errorf(brokerClosed)
+	}
+	return s.put(offsetKey(topic, name), offset)
+}
+
+// Forgets offset of subscriber, so its messages don't stay in the log.
+func (s *store) remove(topic, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return fmt.Errorf(brokerClosed)
+	}
+	return s.db.Delete(offsetKey(topic, name))
+}
+
+// Removes messages that are processed by every known subscriber of the topic and reclaims disk space.
+func (s *store) compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return fmt.Errorf(brokerClosed)
+	}
+	deleted := false
+	for topic, head := range s.heads {
+		processed := head
+		prefix := offsetKeyPrefix + topic + "/"
+		err := s.db.Scan([]byte(prefix), func(key []byte) error {
+			if strings.Contains(strings.TrimPrefix(string(key), prefix), "/") {
+				return nil
+			}
+			offset, err := s.get(key)
+			if err != nil {
+				return err
+			}
+			if offset < processed {
+				processed = offset
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for seq := processed; seq > 0 && s.db.Has(messageKey(topic, seq)); seq-- {
+			if err := s.db.Delete(messageKey(topic, seq)); err != nil {
+				return err
+			}
+			deleted = true
+		}
+	}
+	if !deleted {
+		return nil
+	}
+	return s.db.Merge()
+}
+
+func (s *store) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.db.Close()
+}
+
+func (s *store) appendValue(log string, value []byte) error {
+	seq := s.heads[log] + 1
+	if err := s.db.Put(messageKey(log, seq), value); err != nil {
+		return err
+	}
+	if err := s.put(headKey(log), seq); err != nil {
+		return err
+	}
+	s.heads[log] = seq
+	return nil
+}
+
+func (s *store) get(key []byte) (uint64, error) {
+	value, err := s.db.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(value), 10, 64)
+}
+
+func (s *store) put(key []byte, value uint64) error {
+	return s.db.Put(key, []byte(strconv.FormatUint(value, 10)))
+}
+
+func messageKey(topic string, seq uint64) []byte {
+	return []byte(fmt.Sprintf(messageKeyFormat, topic, seq))
+}
+
+func headKey(topic string) []byte {
+	return []byte(headKeyPrefix + topic)
+}
+
+func offsetKey(topic, name string) []byte {
+	return []byte(offsetKeyPrefix + topic + "/" + name)
+}
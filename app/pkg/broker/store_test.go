@@ -0,0 +1,193 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDurableBroker_ResumesAfterRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := openDurable(t, dir)
+	consumed := make(chan Envelope, 10)
+	_, err := b.Subscribe(topic1, func(msg Envelope) {
+		consumed <- msg
+	}, WithName("consumer"))
+	assert.NoError(t, err)
+	assert.NoError(t, b.Publish(topic1, testEnvelope("first")))
+	// messages are read from store, so payloads of unknown kinds are raw json
+	assert.Equal(t, json.RawMessage(`"first"`), receive(t, consumed).Payload)
+	assert.NoError(t, b.Close(context.Background()))
+
+	// messages published while consumer is not subscribed are kept
+	b = openDurable(t, dir)
+	assert.NoError(t, b.Publish(topic1, testEnvelope("second")))
+	assert.NoError(t, b.Publish(topic1, testEnvelope("third")))
+	assert.NoError(t, b.Close(context.Background()))
+
+	b = openDurable(t, dir)
+	_, err = b.Subscribe(topic1, func(msg Envelope) {
+		consumed <- msg
+	}, WithName("consumer"))
+	assert.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`"second"`), receive(t, consumed).Payload)
+	assert.Equal(t, json.RawMessage(`"third"`), receive(t, consumed).Payload)
+	assert.NoError(t, b.Close(context.Background()))
+	assert.Empty(t, consumed)
+}
+
+func TestDurableBroker_NewSubscriberStartsFromEnd(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := openDurable(t, dir)
+	defer b.Close(context.Background())
+	assert.NoError(t, b.Publish(topic1, testEnvelope("old")))
+	consumed := make(chan Envelope, 10)
+	_, err := b.Subscribe(topic1, func(msg Envelope) {
+		consumed <- msg
+	}, WithName("consumer"))
+	assert.NoError(t, err)
+	assert.NoError(t, b.Publish(topic1, testEnvelope("new")))
+	assert.Equal(t, json.RawMessage(`"new"`), receive(t, consumed).Payload)
+}
+
+func TestDurableBroker_Close_DrainsStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := openDurable(t, dir)
+	release := make(chan struct{})
+	count := 0
+	_, err := b.Subscribe(topic1, func(msg Envelope) {
+		<-release
+		count++
+	}, WithName("consumer"))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, b.Publish(topic1, testEnvelope(i)))
+	}
+	close(release)
+	assert.NoError(t, b.Close(context.Background()))
+	assert.Equal(t, 3, count)
+}
+
+func TestDurableBroker_Redeliver(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := openDurable(t, dir)
+	consumed := make(chan Envelope, 10)
+	_, err := b.Subscribe(topic1, func(msg Envelope) {
+		consumed <- msg
+	}, WithName("consumer"))
+	assert.NoError(t, err)
+	assert.EqualError(t, b.Redeliver(topic1, "other", testEnvelope("first")),
+		"there is no subscriber 'other' of topic 'topic1'")
+	assert.NoError(t, b.Redeliver(topic1, "consumer", testEnvelope("first")))
+	msg := receive(t, consumed)
+	assert.Equal(t, "first", msg.Payload)
+	assert.Equal(t, topic1, msg.Topic)
+	assert.NoError(t, b.Close(context.Background()))
+}
+
+func TestStore_Compact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := openStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.close()
+	_, err = s.offset(topic1, "slow")
+	assert.NoError(t, err)
+	_, err = s.offset(topic1, "fast")
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, s.append(topic1, testEnvelope(i)))
+	}
+	assert.NoError(t, s.commit(topic1, "fast", 3))
+	assert.NoError(t, s.commit(topic1, "slow", 2))
+
+	assert.NoError(t, s.compact())
+	for seq, expected := range map[uint64]bool{1: false, 2: false, 3: true} {
+		_, found, err := s.read(topic1, seq)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, found, "message %d", seq)
+	}
+
+	assert.NoError(t, s.remove(topic1, "slow"))
+	assert.NoError(t, s.compact())
+	_, found, err := s.read(topic1, 3)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.NoError(t, s.append(topic1, testEnvelope(4)))
+	_, found, err = s.read(topic1, 4)
+	assert.NoError(t, err)
+	assert.True(t, found)
+}
+
+func openDurable(t *testing.T, dir string) MessageBroker {
+	b, err := NewDurable(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddTopic(topic1); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func receive(t *testing.T, messages chan Envelope) (msg Envelope) {
+	select {
+	case msg = <-messages:
+	case <-time.After(time.Second):
+		assert.Fail(t, "message hasn't been received")
+	}
+	return
+}
+
+func TestDurableBroker_PatternSubscription(t *testing.T) {
+	const pattern = "gitlab.*.pipeline.#"
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := openDurable(t, dir)
+	consumed := make(chan Envelope, 10)
+	_, err := b.Subscribe(pattern, func(msg Envelope) {
+		consumed <- msg
+	}, WithName("consumer"))
+	assert.NoError(t, err)
+	assert.NoError(t, b.Close(context.Background()))
+
+	// messages of matching topics are kept for pattern subscriber until it subscribes again
+	b = openDurable(t, dir)
+	topic := PipelineTopic("main", "public")
+	assert.NoError(t, b.AddTopic(topic))
+	assert.NoError(t, b.Publish(topic, testEnvelope("public")))
+	assert.NoError(t, b.Publish(topic1, testEnvelope("other")))
+	_, err = b.Subscribe(pattern, func(msg Envelope) {
+		consumed <- msg
+	}, WithName("consumer"))
+	assert.NoError(t, err)
+	actual := receive(t, consumed)
+	assert.Equal(t, topic, actual.Topic)
+	assert.Equal(t, json.RawMessage(`"public"`), actual.Payload)
+	assert.NoError(t, b.Close(context.Background()))
+	assert.Empty(t, consumed)
+}
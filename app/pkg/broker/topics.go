@@ -0,0 +1,88 @@
+package broker
+
+import "strings"
+
+// Topic names consist of segments separated by TopicSeparator, e.g. 'gitlab.main.pipeline.public'.
+// Subscription topic may be a pattern, where AnySegment matches exactly one segment
+// and AnySegments matches zero or more segments, e.g. 'gitlab.*.pipeline.#'.
+const (
+	TopicSeparator = "."
+	AnySegment     = "*"
+	AnySegments    = "#"
+)
+
+// Pipeline messages topics
+const (
+	// Matches webhook and replayed pipeline messages of every instance and namespace.
+	PipelinesPattern = "gitlab.*.pipeline.#"
+	// Matches only webhook pipeline messages of every instance and namespace.
+	WebhookPipelinesPattern = "gitlab.*.pipeline.*"
+)
+
+const (
+	pipelineSegment = "pipeline"
+	replaySegment   = "replay"
+)
+
+// Joins segments to topic name.
+// Separators and wildcards inside segments are replaced, so every segment stays a single literal segment.
+func TopicName(segments ...string) string {
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		segment = strings.NewReplacer(TopicSeparator, "_", AnySegment, "_", AnySegments, "_").Replace(segment)
+		if segment == "" {
+			segment = "_"
+		}
+		escaped[i] = segment
+	}
+	return strings.Join(escaped, TopicSeparator)
+}
+
+// Returns topic of pipeline webhook messages of gitlab namespace received by service instance.
+func PipelineTopic(instance, namespace string) string {
+	return TopicName("gitlab", instance, pipelineSegment, namespace)
+}
+
+// Returns topic of replayed pipeline messages of gitlab namespace.
+func PipelineReplayTopic(instance, namespace string) string {
+	return TopicName("gitlab", instance, pipelineSegment, namespace, replaySegment)
+}
+
+// Reports whether topic name contains wildcard segments.
+func IsPattern(name string) bool {
+	for _, segment := range strings.Split(name, TopicSeparator) {
+		if segment == AnySegment || segment == AnySegments {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether topic name matches pattern.
+func MatchTopic(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, TopicSeparator), strings.Split(name, TopicSeparator))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case AnySegments:
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case AnySegment:
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
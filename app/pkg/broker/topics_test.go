@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTopicName(t *testing.T) {
+	assert.Equal(t, "gitlab.main_host.pipeline.Gitlab Org", TopicName("gitlab", "main.host", "pipeline", "Gitlab Org"))
+	assert.Equal(t, "a._._._", TopicName("a", "*", "#", ""))
+	assert.Equal(t, "gitlab.instance.pipeline.public", PipelineTopic("instance", "public"))
+	assert.Equal(t, "gitlab.instance.pipeline.public.replay", PipelineReplayTopic("instance", "public"))
+}
+
+func TestIsPattern(t *testing.T) {
+	assert.True(t, IsPattern("gitlab.*.pipeline"))
+	assert.True(t, IsPattern("#"))
+	assert.False(t, IsPattern("gitlab.instance.pipeline"))
+	assert.False(t, IsPattern("gitlab.a*b"))
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		expected      bool
+	}{
+		{"gitlab.main.pipeline.public", "gitlab.main.pipeline.public", true},
+		{"gitlab.main.pipeline.public", "gitlab.main.pipeline.private", false},
+		{"gitlab.*.pipeline.*", "gitlab.main.pipeline.public", true},
+		{"gitlab.*.pipeline.*", "gitlab.main.pipeline.public.replay", false},
+		{"gitlab.*.pipeline.*", "gitlab.main.pipeline", false},
+		{"gitlab.*.pipeline.#", "gitlab.main.pipeline.public.replay", true},
+		{"gitlab.*.pipeline.#", "gitlab.main.pipeline", true},
+		{"gitlab.*.pipeline.#", "gitlab.main.push.public", false},
+		{"#.replay", "gitlab.main.pipeline.public.replay", true},
+		{"#", "dead_letter", true},
+		{"gitlab.#.public", "gitlab.public", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, MatchTopic(c.pattern, c.name), "%s matches %s", c.pattern, c.name)
+	}
+}
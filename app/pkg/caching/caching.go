@@ -1,94 +1,515 @@
 package caching
 
 import (
+	"errors"
 	"fmt"
-	externalCache "github.com/patrickmn/go-cache"
 	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const cacheKey = "GitlabProjects"
-
 // Errors
 const (
-	cacheNoObject    = "cache doesn't contains object"
-	cacheInvalidType = "cached object type is invalid: %T"
+	cacheNoObject = "cache doesn't contains object"
+	pushInvalid   = "pipeline event has no attributes or project"
 )
 
+var errNoObject = errors.New(cacheNoObject)
+
+// ProjectsCache keeps every project as separate entry with its own TTL.
+// Expired or invalidated project is loaded again on the next read, other projects stay cached.
+// Returned projects are copies, so callers may modify them.
 type ProjectsCache interface {
-	GetProjects() (projects []contracts.Project, exists bool)
+	// Returns cached projects ordered by namespace and name, loads expired ones.
+	GetProjects() ([]contracts.Project, error)
+	// Returns cached project, loads it if it's expired.
+	GetProject(id int64) (contracts.Project, error)
+	// Returns consistent state of the cache: cached projects ordered by namespace and name
+	// without expired ones, and version of the cache that is incremented by every change.
+	Snapshot() (projects []contracts.Project, version uint64)
 	SetProjects(projects []contracts.Project)
-	UpdatePipeline(pipelinePush contracts.PipelinePush) error
+	SetProject(project contracts.Project)
+	Invalidate(id int64)
+	Refresh(id int64) error
+	// Loads all projects and replaces cached ones.
+	Reload() error
+	// Removes all projects, so they are loaded again on the next read.
+	Clear()
+	UpdatePipeline(pipelinePush contracts.PipelinePush) (contracts.CacheChange, error)
+	Stats() contracts.CacheStats
+}
+
+// indexEntry is position of the project in the ordered list of cached projects.
+type indexEntry struct {
+	Id        int64  `json:"id"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// entry is cached project with its expiration time, zero time means that entry never expires.
+type entry struct {
+	project    contracts.Project
+	expiration time.Time
+}
+
+// state is immutable version of cached projects and their index.
+// Index lives for default expiration, after it expires whole projects list is loaded again,
+// so new and removed projects are noticed.
+type state struct {
+	version         uint64
+	loaded          bool
+	loadedAt        time.Time
+	index           []indexEntry
+	indexExpiration time.Time
+	entries         map[int64]entry
 }
 
+// cache replaces its state on every change and never modifies published one,
+// so readers don't need a lock and never observe partial updates.
+// Writers build next state from a copy of the current one under the lock.
 type cache struct {
-	*externalCache.Cache
-	*sync.Mutex
+	hits               uint64
+	misses             uint64
+	state              atomic.Value
+	lock               *sync.Mutex
+	defaultExpiration  time.Duration
+	pipelinesPerBranch int
+	loader             Loader
+	logger             logging.Logger
 }
 
-func New(defaultExpiration time.Duration) ProjectsCache {
+// Creates new projects cache.
+// defaultExpiration - TTL of index and every project entry, non-positive value means that entries never expire
+// pipelinesPerBranch - max number of pipelines of every branch kept after webhook event
+// loader - loads projects that are missing in cache
+// logger - Logging module
+func New(
+	defaultExpiration time.Duration,
+	pipelinesPerBranch int,
+	loader Loader,
+	logger logging.Logger) ProjectsCache {
+
 	result := new(cache)
-	result.Cache = externalCache.New(defaultExpiration, 0)
-	result.Mutex = new(sync.Mutex)
+	result.state.Store(&state{entries: make(map[int64]entry)})
+	result.lock = new(sync.Mutex)
+	result.defaultExpiration = defaultExpiration
+	result.pipelinesPerBranch = pipelinesPerBranch
+	result.loader = loader
+	result.logger = logger
 	return result
 }
 
-func (c *cache) GetProjects() (projects []contracts.Project, exists bool) {
-	c.Lock()
-	defer c.Unlock()
-	cached, exists := c.Get(cacheKey)
-	if exists {
-		projects = cached.([]contracts.Project)
+// Returns cached projects ordered by namespace and name.
+// If index is expired all projects are loaded, otherwise only expired projects are loaded.
+// Projects that can't be loaded are skipped.
+func (c *cache) GetProjects() ([]contracts.Project, error) {
+	current := c.current()
+	if !current.indexValid() {
+		if err := c.Reload(); err != nil {
+			return nil, err
+		}
+		current = c.current()
+	}
+	result := make([]contracts.Project, 0, len(current.index))
+	for _, e := range current.index {
+		project, ok := current.project(e.Id)
+		c.count(ok)
+		if !ok {
+			var err error
+			if project, err = c.load(e.Id); err != nil {
+				c.logger.Errorf("Error while loading project %d: %v", e.Id, err)
+				continue
+			}
+		}
+		result = append(result, project)
+	}
+	return result, nil
+}
+
+func (c *cache) GetProject(id int64) (contracts.Project, error) {
+	project, ok := c.current().project(id)
+	c.count(ok)
+	if ok {
+		return project, nil
 	}
-	return
+	return c.load(id)
 }
 
+func (c *cache) Snapshot() ([]contracts.Project, uint64) {
+	current := c.current()
+	projects := make([]contracts.Project, 0, len(current.index))
+	for _, e := range current.index {
+		if project, ok := current.project(e.Id); ok {
+			projects = append(projects, project)
+		}
+	}
+	return projects, current.version
+}
+
+// Replaces all cached projects and index.
 func (c *cache) SetProjects(projects []contracts.Project) {
-	c.Lock()
-	defer c.Unlock()
-	c.SetDefault(cacheKey, projects)
-}
-
-func (c *cache) UpdatePipeline(pipelinePush contracts.PipelinePush) (err error) {
-	c.Lock()
-	defer c.Unlock()
-	cached, expiration, exists := c.GetWithExpiration(cacheKey)
-	if !exists {
-		return fmt.Errorf(cacheNoObject)
-	}
-	projects, ok := cached.([]contracts.Project)
-	if !ok {
-		return fmt.Errorf(cacheInvalidType, cached)
-	}
-	for i := 0; i < len(projects); i++ {
-		if projects[i].Id == pipelinePush.Project.Id {
-			pipelineExists := false
-			for j := 0; j < len(projects[i].Pipelines); j++ {
-				if projects[i].Pipelines[j].Id == pipelinePush.Attributes.Id {
-					projects[i].Pipelines[j].Status = pipelinePush.Attributes.Status
-					pipelineExists = true
-				}
-			}
-			if !pipelineExists {
-				newPipeline := contracts.Pipeline{
-					Id:     pipelinePush.Attributes.Id,
-					Sha:    pipelinePush.Attributes.Sha,
-					Branch: pipelinePush.Attributes.Branch,
-					Status: pipelinePush.Attributes.Status,
-					WebUrl: pipelinePush.Commit.Url,
-					Commit: &contracts.Commit{
-						Title:     pipelinePush.Commit.Message,
-						CreatedAt: pipelinePush.Commit.Timestamp,
-						Author:    pipelinePush.Commit.Author.Name,
-					},
-				}
-				projects[i].Pipelines = append(projects[i].Pipelines, newPipeline)
+	_ = c.update(func(next *state) error {
+		expiration := c.expiration()
+		next.loaded = true
+		next.loadedAt = time.Now().UTC()
+		next.indexExpiration = expiration
+		next.index = make([]indexEntry, 0, len(projects))
+		next.entries = make(map[int64]entry, len(projects))
+		for _, project := range projects {
+			next.entries[project.Id] = entry{cloneProject(project), expiration}
+			next.index = append(next.index, newIndexEntry(project))
+		}
+		sort.Slice(next.index, func(i, j int) bool {
+			return next.index[i].less(next.index[j])
+		})
+		return nil
+	})
+}
+
+// Caches single project and adds it to the index.
+// Project isn't added to expired index, it will be added by the next load of all projects.
+func (c *cache) SetProject(project contracts.Project) {
+	_ = c.update(func(next *state) error {
+		next.entries[project.Id] = entry{cloneProject(project), c.expiration()}
+		if next.indexValid() {
+			next.index = addToIndex(next.index, newIndexEntry(project))
+		}
+		return nil
+	})
+}
+
+// Expires cached project, so it's loaded again on the next read.
+func (c *cache) Invalidate(id int64) {
+	_ = c.update(func(next *state) error {
+		delete(next.entries, id)
+		return nil
+	})
+}
+
+// Loads project and replaces cached one.
+func (c *cache) Refresh(id int64) error {
+	_, err := c.load(id)
+	return err
+}
+
+func (c *cache) Reload() error {
+	projects, err := c.loader.Projects()
+	if err != nil {
+		return err
+	}
+	c.SetProjects(projects)
+	return nil
+}
+
+func (c *cache) Clear() {
+	_ = c.update(func(next *state) error {
+		*next = state{version: next.version, entries: make(map[int64]entry)}
+		return nil
+	})
+}
+
+// Returns counters of this cache and state of every project in the index.
+func (c *cache) Stats() contracts.CacheStats {
+	current := c.current()
+	result := contracts.CacheStats{
+		Version: current.version,
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: make([]contracts.CacheEntry, 0, len(current.index)),
+	}
+	if current.loaded {
+		loadedAt := current.loadedAt
+		result.LoadedAt = &loadedAt
+		result.Age = int64(time.Since(loadedAt) / time.Second)
+		result.Ttl = ttlSeconds(current.indexExpiration)
+	}
+	for _, e := range current.index {
+		cacheEntry := contracts.CacheEntry{ProjectId: e.Id, Project: e.Name, Namespace: e.Namespace}
+		if cached, ok := current.entries[e.Id]; ok {
+			cacheEntry.Pipelines = len(cached.project.Pipelines)
+			cacheEntry.Ttl = ttlSeconds(cached.expiration)
+		}
+		result.Entries = append(result.Entries, cacheEntry)
+	}
+	return result
+}
+
+// Updates pipeline of cached project from webhook event or adds new pipeline, TTL of project isn't changed.
+// Project that isn't cached is loaded first, so pipelines of new projects appear without full reload.
+// Project keeps only pipelinesPerBranch newest pipelines of every branch, ordered by id from the newest.
+// Returns the change, so clients can apply it instead of the raw webhook event.
+func (c *cache) UpdatePipeline(pipelinePush contracts.PipelinePush) (change contracts.CacheChange, err error) {
+	if pipelinePush.Attributes == nil || pipelinePush.Project == nil {
+		return change, fmt.Errorf(pushInvalid)
+	}
+	var project contracts.Project
+	apply := func(next *state) error {
+		cached, ok := next.entries[pipelinePush.Project.Id]
+		if !ok || cached.expired() {
+			return errNoObject
+		}
+		project, change = applyPipeline(cached.project, pipelinePush, c.pipelinesPerBranch)
+		next.entries[project.Id] = entry{project, cached.expiration}
+		return nil
+	}
+	err = c.update(apply)
+	if err != errNoObject {
+		return
+	}
+	if _, err = c.load(pipelinePush.Project.Id); err != nil {
+		return
+	}
+	if err = c.update(apply); err != nil {
+		return
+	}
+	return addedProject(cloneProject(project)), nil
+}
+
+// Loads project and caches it.
+func (c *cache) load(id int64) (contracts.Project, error) {
+	project, err := c.loader.Project(id)
+	if err != nil {
+		return project, err
+	}
+	c.SetProject(project)
+	return project, nil
+}
+
+// Counts cache hit or miss.
+func (c *cache) count(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+func (c *cache) current() *state {
+	return c.state.Load().(*state)
+}
+
+// Applies change to a copy of the current state and publishes it as the next version.
+// Nothing is published if change returns error.
+func (c *cache) update(change func(next *state) error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	current := c.current()
+	next := *current
+	next.entries = make(map[int64]entry, len(current.entries))
+	for id, e := range current.entries {
+		next.entries[id] = e
+	}
+	if err := change(&next); err != nil {
+		return err
+	}
+	next.version++
+	c.state.Store(&next)
+	return nil
+}
+
+// Returns expiration time of entry added now.
+func (c *cache) expiration() time.Time {
+	if c.defaultExpiration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.defaultExpiration)
+}
+
+// Applies pipeline event to project and keeps only the newest pipelines of every branch,
+// returns changed project and the change with created, updated and removed pipelines.
+// Change has empty type if pipeline from event is older than cached ones.
+func applyPipeline(
+	project contracts.Project,
+	pipelinePush contracts.PipelinePush,
+	pipelinesPerBranch int) (contracts.Project, contracts.CacheChange) {
+
+	change := contracts.CacheChange{ProjectId: project.Id, Namespace: project.Namespace}
+	before := make(map[int64]bool, len(project.Pipelines))
+	for _, pipeline := range project.Pipelines {
+		before[pipeline.Id] = true
+	}
+	project.Pipelines = trimPipelines(updatePipelines(project.Pipelines, pipelinePush), pipelinesPerBranch)
+	for _, pipeline := range project.Pipelines {
+		if pipeline.Id == pipelinePush.Attributes.Id {
+			cloned := clonePipeline(pipeline)
+			change.Pipeline = &cloned
+			change.Type = contracts.PipelineCreated
+			if before[pipeline.Id] {
+				change.Type = contracts.PipelineUpdated
 			}
-			ttl := expiration.Sub(time.Now())
-			c.Set(cacheKey, projects, ttl)
-			return
 		}
+		delete(before, pipeline.Id)
+	}
+	for id := range before {
+		change.RemovedPipelines = append(change.RemovedPipelines, id)
+	}
+	sort.Slice(change.RemovedPipelines, func(i, j int) bool {
+		return change.RemovedPipelines[i] < change.RemovedPipelines[j]
+	})
+	return project, change
+}
+
+// Creates change of project that wasn't cached before pipeline event.
+func addedProject(project contracts.Project) contracts.CacheChange {
+	return contracts.CacheChange{
+		Type:      contracts.ProjectAdded,
+		ProjectId: project.Id,
+		Namespace: project.Namespace,
+		Project:   &project,
+	}
+}
+
+// Sorts pipelines from the newest and removes old pipelines of every branch.
+func trimPipelines(pipelines []contracts.Pipeline, pipelinesPerBranch int) []contracts.Pipeline {
+	sort.SliceStable(pipelines, func(i, j int) bool {
+		return pipelines[i].Id > pipelines[j].Id
+	})
+	result := pipelines[:0]
+	branches := make(map[string]int)
+	for _, pipeline := range pipelines {
+		if branches[pipeline.Branch] < pipelinesPerBranch {
+			branches[pipeline.Branch]++
+			result = append(result, pipeline)
+		}
+	}
+	return result
+}
+
+func (s *state) indexValid() bool {
+	return s.loaded && !expired(s.indexExpiration)
+}
+
+// Returns copy of cached project, ok is false if project isn't cached or expired.
+func (s *state) project(id int64) (project contracts.Project, ok bool) {
+	cached, ok := s.entries[id]
+	if !ok || cached.expired() {
+		return project, false
+	}
+	return cloneProject(cached.project), true
+}
+
+func (e entry) expired() bool {
+	return expired(e.expiration)
+}
+
+func expired(expiration time.Time) bool {
+	return !expiration.IsZero() && time.Now().After(expiration)
+}
+
+// Returns seconds until expiration time, zero time means that entry never expires.
+func ttlSeconds(expiration time.Time) int64 {
+	if expiration.IsZero() {
+		return contracts.NoExpiration
+	}
+	if ttl := time.Until(expiration); ttl > 0 {
+		return int64(ttl / time.Second)
+	}
+	return 0
+}
+
+func newIndexEntry(project contracts.Project) indexEntry {
+	return indexEntry{project.Id, project.Namespace, project.Name}
+}
+
+// Returns copy of index with inserted entry keeping its order, entry's position is updated if it exists.
+func addToIndex(index []indexEntry, entry indexEntry) []indexEntry {
+	result := make([]indexEntry, 0, len(index)+1)
+	for _, e := range index {
+		if e.Id != entry.Id {
+			result = append(result, e)
+		}
+	}
+	position := sort.Search(len(result), func(i int) bool {
+		return entry.less(result[i])
+	})
+	result = append(result, indexEntry{})
+	copy(result[position+1:], result[position:])
+	result[position] = entry
+	return result
+}
+
+func (e indexEntry) less(other indexEntry) bool {
+	if e.Namespace != other.Namespace {
+		return e.Namespace < other.Namespace
+	}
+	if e.Name != other.Name {
+		return e.Name < other.Name
+	}
+	return e.Id < other.Id
+}
+
+// Returns copy of pipelines with pipeline from webhook event updated or added.
+// Existing pipeline keeps its web url, commit is replaced only if event has it.
+func updatePipelines(pipelines []contracts.Pipeline, pipelinePush contracts.PipelinePush) []contracts.Pipeline {
+	attributes := pipelinePush.Attributes
+	result := append(make([]contracts.Pipeline, 0, len(pipelines)+1), pipelines...)
+	index := -1
+	for i := range result {
+		if result[i].Id == attributes.Id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		result = append(result, contracts.Pipeline{Id: attributes.Id})
+		index = len(result) - 1
+		if pipelinePush.Commit != nil {
+			result[index].WebUrl = pipelinePush.Commit.Url
+		}
+	}
+	pipeline := &result[index]
+	pipeline.Sha = attributes.Sha
+	pipeline.Branch = attributes.Branch
+	pipeline.Status = attributes.Status
+	if pipelinePush.Commit != nil {
+		pipeline.Commit = &contracts.Commit{
+			Title:     pipelinePush.Commit.Message,
+			CreatedAt: pipelinePush.Commit.Timestamp,
+		}
+		if pipelinePush.Commit.Author != nil {
+			pipeline.Commit.Author = pipelinePush.Commit.Author.Name
+		}
+	}
+	if len(pipelinePush.Builds) > 0 {
+		pipeline.Jobs = make([]contracts.Job, 0, len(pipelinePush.Builds))
+		for _, build := range pipelinePush.Builds {
+			pipeline.Jobs = append(pipeline.Jobs, contracts.Job{
+				Id:     build.Id,
+				Stage:  build.Stage,
+				Name:   build.Name,
+				Status: build.Status,
+			})
+		}
+		sort.Slice(pipeline.Jobs, func(i, j int) bool {
+			return pipeline.Jobs[i].Id < pipeline.Jobs[j].Id
+		})
+	}
+	return result
+}
+
+// Returns deep copy of project, so neither cache nor caller can change the other's data.
+func cloneProject(project contracts.Project) contracts.Project {
+	if project.Pipelines == nil {
+		return project
+	}
+	pipelines := make([]contracts.Pipeline, len(project.Pipelines))
+	for i, pipeline := range project.Pipelines {
+		pipelines[i] = clonePipeline(pipeline)
+	}
+	project.Pipelines = pipelines
+	return project
+}
+
+func clonePipeline(pipeline contracts.Pipeline) contracts.Pipeline {
+	if pipeline.Commit != nil {
+		commit := *pipeline.Commit
+		pipeline.Commit = &commit
+	}
+	if pipeline.Jobs != nil {
+		pipeline.Jobs = append([]contracts.Job(nil), pipeline.Jobs...)
 	}
-	return
+	return pipeline
 }
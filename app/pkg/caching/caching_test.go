@@ -3,7 +3,9 @@ package caching
 import (
 	"fmt"
 	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/tests"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,90 +16,450 @@ const (
 )
 
 func TestNew(t *testing.T) {
-	c := New(-1)
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
 	assert.NotNil(t, c)
 	assert.IsType(t, &cache{}, c)
 }
 
 func TestCache_SetProjects(t *testing.T) {
-	c := New(-1)
-	expected := make([]contracts.Project, 0)
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
+	expected := createProjects(false)
 	c.SetProjects(expected)
 
-	actual, exists := c.(*cache).Get(cacheKey)
+	current := c.(*cache).current()
+	actual, exists := current.project(projectId)
 	assert.True(t, exists)
-	assert.Equal(t, expected, actual)
+	assert.Equal(t, expected[0], actual)
+	assert.True(t, current.indexValid())
+	assert.Equal(t, []indexEntry{{projectId, expected[0].Namespace, expected[0].Name}}, current.index)
 }
 
 func TestCache_GetProjects(t *testing.T) {
-	c := New(200 * time.Millisecond)
-	actual, exists := c.GetProjects()
-	assert.False(t, exists)
-	assert.Nil(t, actual)
+	loader := &testLoader{projects: createProjects(false)}
+	c := New(200*time.Millisecond, 5, loader, new(tests.MockLogger))
 
-	expected := make([]contracts.Project, 0)
-	c.SetProjects(expected)
+	actual, err := c.GetProjects()
+	if assert.NoError(t, err) {
+		assert.Equal(t, loader.projects, actual)
+	}
+	assert.Equal(t, 1, loader.projectsCalls)
 
-	actual, exists = c.GetProjects()
-	assert.True(t, exists)
-	assert.Equal(t, expected, actual)
+	actual, err = c.GetProjects()
+	if assert.NoError(t, err) {
+		assert.Equal(t, loader.projects, actual)
+	}
+	assert.Equal(t, 1, loader.projectsCalls)
 
 	time.Sleep(200 * time.Millisecond)
 
-	actual, exists = c.GetProjects()
-	assert.False(t, exists)
+	_, err = c.GetProjects()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loader.projectsCalls)
+	assert.Zero(t, loader.projectCalls)
+}
+
+func TestCache_GetProjects_Error(t *testing.T) {
+	loader := &testLoader{err: fmt.Errorf("load error")}
+	c := New(-1, 5, loader, new(tests.MockLogger))
+	actual, err := c.GetProjects()
+	assert.EqualError(t, err, "load error")
 	assert.Nil(t, actual)
 }
 
+func TestCache_GetProjects_Order(t *testing.T) {
+	projects := []contracts.Project{
+		{Id: 3, Namespace: "b", Name: "a"},
+		{Id: 2, Namespace: "a", Name: "b"},
+		{Id: 1, Namespace: "a", Name: "c"},
+	}
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
+	c.SetProjects(projects)
+	c.SetProject(contracts.Project{Id: 4, Namespace: "a", Name: "a"})
+	c.SetProject(contracts.Project{Id: 1, Namespace: "c", Name: "c"})
+
+	actual, err := c.GetProjects()
+	if assert.NoError(t, err) {
+		ids := make([]int64, 0, len(actual))
+		for _, project := range actual {
+			ids = append(ids, project.Id)
+		}
+		assert.Equal(t, []int64{4, 2, 3, 1}, ids)
+	}
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	projects := []contracts.Project{{Id: 1, Name: "a"}, {Id: 2, Name: "b"}}
+	loader := &testLoader{projects: []contracts.Project{{Id: 1, Name: "a", WebUrl: "refreshed"}}}
+	c := New(-1, 5, loader, new(tests.MockLogger))
+	c.SetProjects(projects)
+
+	c.Invalidate(1)
+	actual, err := c.GetProjects()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []contracts.Project{loader.projects[0], projects[1]}, actual)
+	}
+	assert.Equal(t, 1, loader.projectCalls)
+	assert.Zero(t, loader.projectsCalls)
+
+	// project that can't be loaded is skipped
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Errorf").Once()
+	c.(*cache).logger = mockLogger
+	c.Invalidate(2)
+	actual, err = c.GetProjects()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []contracts.Project{loader.projects[0]}, actual)
+	}
+	mockLogger.AssertExpectations(t)
+}
+
+func TestCache_Refresh(t *testing.T) {
+	loader := &testLoader{projects: []contracts.Project{{Id: 1, Name: "a", WebUrl: "refreshed"}}}
+	c := New(-1, 5, loader, new(tests.MockLogger))
+	c.SetProjects([]contracts.Project{{Id: 1, Name: "a"}})
+
+	if assert.NoError(t, c.Refresh(1)) {
+		actual, err := c.GetProject(1)
+		assert.NoError(t, err)
+		assert.Equal(t, loader.projects[0], actual)
+	}
+	assert.Error(t, c.Refresh(2))
+}
+
 func TestCache_UpdatePipeline_ExistingPipeline(t *testing.T) {
 	const success = "success"
-	c := New(-1)
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
 	before := createProjects(true)
 	assert.Len(t, before[0].Pipelines, 1)
 	assert.NotEqual(t, success, before[0].Pipelines[0].Status)
 
 	c.SetProjects(before)
-	err := c.UpdatePipeline(createTestPipelinePush())
+	change, err := c.UpdatePipeline(createTestPipelinePush())
 	if assert.NoError(t, err) {
-		after, exists := c.GetProjects()
-		assert.True(t, exists)
+		after, err := c.GetProjects()
+		assert.NoError(t, err)
 		assert.Len(t, after, 1)
 		pipelines := after[0].Pipelines
 		assert.Len(t, pipelines, 1)
 		assert.Equal(t, success, pipelines[0].Status)
+		assert.NotEqual(t, success, before[0].Pipelines[0].Status)
+		assert.Equal(t, contracts.CacheChange{
+			Type:      contracts.PipelineUpdated,
+			ProjectId: projectId,
+			Namespace: before[0].Namespace,
+			Pipeline:  &pipelines[0],
+		}, change)
 	}
 }
 
 func TestCache_UpdatePipeline_NewPipeline(t *testing.T) {
-	c := New(-1)
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
 	before := createProjects(false)
 	assert.Nil(t, before[0].Pipelines)
 
 	c.SetProjects(before)
-	err := c.UpdatePipeline(createTestPipelinePush())
+	change, err := c.UpdatePipeline(createTestPipelinePush())
 	if assert.NoError(t, err) {
-		after, exists := c.GetProjects()
-		assert.True(t, exists)
+		after, err := c.GetProjects()
+		assert.NoError(t, err)
 		assert.Len(t, after, 1)
 		pipelines := after[0].Pipelines
 		assert.Len(t, pipelines, 1)
 		assert.Equal(t, pipelineId, pipelines[0].Id)
+		assert.Equal(t, contracts.PipelineCreated, change.Type)
+		assert.Equal(t, &pipelines[0], change.Pipeline)
+	}
+}
+
+func TestCache_UpdatePipeline_KeepsTTL(t *testing.T) {
+	c := New(200*time.Millisecond, 5, new(testLoader), new(tests.MockLogger))
+	c.SetProjects(createProjects(false))
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, updatePipeline(c, createTestPipelinePush()))
+	time.Sleep(100 * time.Millisecond)
+
+	_, exists := c.(*cache).current().project(projectId)
+	assert.False(t, exists)
+}
+
+func TestCache_UpdatePipeline_UnknownProject(t *testing.T) {
+	loader := &testLoader{projects: createProjects(false)}
+	c := New(-1, 5, loader, new(tests.MockLogger))
+	c.SetProjects(nil)
+
+	change, err := c.UpdatePipeline(createTestPipelinePush())
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, loader.projectCalls)
+		actual, err := c.GetProjects()
+		if assert.NoError(t, err) {
+			assert.Len(t, actual, 1)
+			assert.Len(t, actual[0].Pipelines, 1)
+			assert.Equal(t, pipelineId, actual[0].Pipelines[0].Id)
+			assert.Equal(t, contracts.ProjectAdded, change.Type)
+			assert.Equal(t, &actual[0], change.Project)
+			assert.Nil(t, change.Pipeline)
+		}
 	}
+
+	push := createTestPipelinePush()
+	push.Project.Id = 2
+	_, err = c.UpdatePipeline(push)
+	assert.EqualError(t, err, "project 2 not found")
 }
 
-func TestCache_UpdatePipeline_NoObject(t *testing.T) {
-	c := New(-1)
-	err := c.UpdatePipeline(createTestPipelinePush())
-	assert.EqualError(t, err, cacheNoObject)
+func TestCache_UpdatePipeline_Invalid(t *testing.T) {
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
+	_, err := c.UpdatePipeline(contracts.PipelinePush{})
+	assert.EqualError(t, err, pushInvalid)
 }
 
-func TestCache_UpdatePipeline_InvalidObjectType(t *testing.T) {
-	obj := struct{}{}
-	c := New(-1)
-	c.(*cache).SetDefault(cacheKey, obj)
-	err := c.UpdatePipeline(createTestPipelinePush())
-	expectedError := fmt.Sprintf(cacheInvalidType, obj)
-	assert.EqualError(t, err, expectedError)
+func TestCache_UpdatePipeline_Details(t *testing.T) {
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
+	c.SetProjects(createProjects(true))
+	push := createTestPipelinePush()
+	push.Builds = append(push.Builds, contracts.Build{Id: 200, Stage: "build", Name: "compile", Status: "success"})
+
+	if _, err := c.UpdatePipeline(push); assert.NoError(t, err) {
+		actual, err := c.GetProject(projectId)
+		assert.NoError(t, err)
+		pipeline := actual.Pipelines[0]
+		assert.Equal(t, push.Attributes.Sha, pipeline.Sha)
+		assert.Equal(t, push.Attributes.Branch, pipeline.Branch)
+		assert.Equal(t, &contracts.Commit{Title: "test\n", CreatedAt: push.Commit.Timestamp, Author: "User"}, pipeline.Commit)
+		assert.Equal(t, []contracts.Job{
+			{Id: 200, Stage: "build", Name: "compile", Status: "success"},
+			{Id: 300, Stage: "deploy", Name: "production", Status: "success"},
+		}, pipeline.Jobs)
+	}
+}
+
+func TestCache_UpdatePipeline_KeepsNewestPerBranch(t *testing.T) {
+	c := New(-1, 2, new(testLoader), new(tests.MockLogger))
+	c.SetProjects(createProjects(false))
+	for _, p := range []struct {
+		id     int64
+		branch string
+	}{{5, "master"}, {1, "master"}, {7, "dev"}, {3, "master"}, {2, "dev"}, {9, "master"}, {4, "dev"}} {
+		push := createTestPipelinePush()
+		push.Attributes.Id = p.id
+		push.Attributes.Branch = p.branch
+		assert.NoError(t, updatePipeline(c, push))
+	}
+
+	actual, err := c.GetProject(projectId)
+	if assert.NoError(t, err) {
+		ids := make([]int64, 0, len(actual.Pipelines))
+		for _, pipeline := range actual.Pipelines {
+			ids = append(ids, pipeline.Id)
+		}
+		assert.Equal(t, []int64{9, 7, 5, 4}, ids)
+	}
+}
+
+func TestCache_GetProjects_ReturnsCopies(t *testing.T) {
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
+	c.SetProjects(createProjects(true))
+
+	actual, err := c.GetProjects()
+	if assert.NoError(t, err) {
+		actual[0].Pipelines[0].Status = "changed"
+		actual[0].Pipelines = append(actual[0].Pipelines, contracts.Pipeline{Id: 1})
+	}
+	project, err := c.GetProject(projectId)
+	if assert.NoError(t, err) {
+		assert.Equal(t, createProjects(true)[0], project)
+	}
+}
+
+func TestCache_UpdatePipeline_RemovedPipelines(t *testing.T) {
+	c := New(-1, 2, new(testLoader), new(tests.MockLogger))
+	c.SetProjects(createProjects(false))
+	update := func(id int64) contracts.CacheChange {
+		push := createTestPipelinePush()
+		push.Attributes.Id = id
+		change, err := c.UpdatePipeline(push)
+		assert.NoError(t, err)
+		return change
+	}
+	update(1)
+	update(2)
+
+	change := update(3)
+	assert.Equal(t, contracts.PipelineCreated, change.Type)
+	assert.Equal(t, int64(3), change.Pipeline.Id)
+	assert.Equal(t, []int64{1}, change.RemovedPipelines)
+
+	// pipeline older than cached ones isn't kept
+	change = update(1)
+	assert.Empty(t, change.Type)
+	assert.Nil(t, change.Pipeline)
+	assert.Nil(t, change.RemovedPipelines)
+}
+
+func TestCache_Snapshot_Version(t *testing.T) {
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
+	projects, version := c.Snapshot()
+	assert.Empty(t, projects)
+	assert.Zero(t, version)
+
+	c.SetProjects(createProjects(false))
+	assert.NoError(t, updatePipeline(c, createTestPipelinePush()))
+	projects, version = c.Snapshot()
+	assert.Equal(t, uint64(2), version)
+	assert.Len(t, projects[0].Pipelines, 1)
+
+	// failed update doesn't change version
+	c.Invalidate(projectId)
+	_, err := c.UpdatePipeline(createTestPipelinePush())
+	assert.Error(t, err)
+	_, version = c.Snapshot()
+	assert.Equal(t, uint64(3), version)
+}
+
+func TestCache_Stats(t *testing.T) {
+	loader := &testLoader{projects: createProjects(true)}
+	c := New(time.Hour, 5, loader, new(tests.MockLogger))
+	stats := c.Stats()
+	assert.Nil(t, stats.LoadedAt)
+	assert.Empty(t, stats.Entries)
+
+	_, err := c.GetProjects()
+	assert.NoError(t, err)
+	_, err = c.GetProject(projectId)
+	assert.NoError(t, err)
+	c.Invalidate(projectId)
+	_, err = c.GetProject(projectId)
+	assert.NoError(t, err)
+
+	stats = c.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(3), stats.Version)
+	assert.NotNil(t, stats.LoadedAt)
+	assert.Zero(t, stats.Age)
+	assert.InDelta(t, 3600, stats.Ttl, 1)
+	if assert.Len(t, stats.Entries, 1) {
+		assert.Equal(t, projectId, stats.Entries[0].ProjectId)
+		assert.Equal(t, 1, stats.Entries[0].Pipelines)
+		assert.InDelta(t, 3600, stats.Entries[0].Ttl, 1)
+	}
+}
+
+func TestCache_Clear(t *testing.T) {
+	loader := &testLoader{projects: createProjects(false)}
+	c := New(-1, 5, loader, new(tests.MockLogger))
+	c.SetProjects(createProjects(true))
+	c.Clear()
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(2), stats.Version)
+	assert.Nil(t, stats.LoadedAt)
+	assert.Empty(t, stats.Entries)
+	actual, err := c.GetProjects()
+	if assert.NoError(t, err) {
+		assert.Equal(t, loader.projects, actual)
+	}
+	assert.Equal(t, 1, loader.projectsCalls)
+	assert.Equal(t, contracts.NoExpiration, c.Stats().Entries[0].Ttl)
+}
+
+// Readers modify returned projects while pipelines are updated, run with -race.
+func TestCache_ConcurrentAccess(t *testing.T) {
+	const (
+		projectsCount = 10
+		updates       = 200
+	)
+	projects := make([]contracts.Project, projectsCount)
+	for i := range projects {
+		projects[i] = contracts.Project{Id: int64(i + 1), Name: fmt.Sprintf("project%d", i)}
+	}
+	c := New(-1, 5, &testLoader{projects: projects}, new(tests.MockLogger))
+	c.SetProjects(projects)
+
+	var wg sync.WaitGroup
+	for i := 0; i < projectsCount; i++ {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				push := createTestPipelinePush()
+				push.Project.Id = id
+				push.Attributes.Id = int64(j % 5)
+				push.Attributes.Status = fmt.Sprintf("status%d", j)
+				assert.NoError(t, updatePipeline(c, push))
+			}
+		}(int64(i + 1))
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var lastVersion uint64
+			for j := 0; j < updates; j++ {
+				actual, err := c.GetProjects()
+				assert.NoError(t, err)
+				assert.Len(t, actual, projectsCount)
+				for k := range actual {
+					for l := range actual[k].Pipelines {
+						actual[k].Pipelines[l].Status = "filtered"
+						actual[k].Pipelines[l].Commit.Title = "filtered"
+					}
+				}
+				_, version := c.Snapshot()
+				assert.True(t, version >= lastVersion)
+				lastVersion = version
+			}
+		}()
+	}
+	wg.Wait()
+
+	actual, err := c.GetProjects()
+	if assert.NoError(t, err) {
+		for _, project := range actual {
+			assert.Len(t, project.Pipelines, 5)
+			for _, pipeline := range project.Pipelines {
+				assert.NotEqual(t, "filtered", pipeline.Status)
+				assert.NotEqual(t, "filtered", pipeline.Commit.Title)
+			}
+		}
+	}
+	_, version := c.Snapshot()
+	assert.Equal(t, uint64(1+projectsCount*updates), version)
+}
+
+// testLoader returns given projects and counts calls.
+// If started and release are set, Projects signals start and waits for release.
+type testLoader struct {
+	lock          sync.Mutex
+	projects      []contracts.Project
+	err           error
+	projectsCalls int
+	projectCalls  int
+	started       chan struct{}
+	release       chan struct{}
+}
+
+func (l *testLoader) Projects() ([]contracts.Project, error) {
+	if l.started != nil {
+		close(l.started)
+		<-l.release
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.projectsCalls++
+	return l.projects, l.err
+}
+
+func (l *testLoader) Project(id int64) (contracts.Project, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.projectCalls++
+	for _, project := range l.projects {
+		if project.Id == id {
+			return project, nil
+		}
+	}
+	return contracts.Project{}, fmt.Errorf("project %d not found", id)
 }
 
 func createProjects(withPipeline bool) []contracts.Project {
@@ -126,6 +488,12 @@ func createProjects(withPipeline bool) []contracts.Project {
 	}
 }
 
+// Applies pipeline event, drops the change.
+func updatePipeline(c ProjectsCache, push contracts.PipelinePush) error {
+	_, err := c.UpdatePipeline(push)
+	return err
+}
+
 func createTestPipelinePush() contracts.PipelinePush {
 	user := contracts.User{
 		Name:     "Administrator",
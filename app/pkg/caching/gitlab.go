@@ -0,0 +1,168 @@
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"github.com/ricdeau/gitlab-extension/app/pkg/utils"
+	"net/http"
+	"time"
+)
+
+const privateToken = "Private-Token"
+
+// urls
+const (
+	projectsUrl  = "%s/projects"
+	projectUrl   = "%s/projects/%d"
+	pipelinesUtl = "%s/projects/%d/pipelines"
+	commitUrl    = "%s/projects/%d/repository/commits/%s"
+)
+
+// Loader loads projects that are missing in cache or expired.
+type Loader interface {
+	Projects() ([]contracts.Project, error)
+	Project(id int64) (contracts.Project, error)
+}
+
+// gitlabLoader performs multiple requests to gitlab API and combines responses to projects
+// with first N pipelines for each project, and last commit for each pipeline.
+type gitlabLoader struct {
+	config     *config.Config
+	logger     logging.Logger
+	gitlabUrl  string
+	client     *http.Client
+	nPipelines int
+}
+
+// Creates loader of gitlab projects.
+// conf - Global config
+// nPipelines - top N pipelines to take for each project
+// logger - Logging module
+func NewGitlabLoader(conf *config.Config, nPipelines int, logger logging.Logger) Loader {
+	return &gitlabLoader{
+		config:     conf,
+		logger:     logger,
+		gitlabUrl:  conf.GitlabUri,
+		nPipelines: nPipelines,
+		client: &http.Client{
+			Timeout: time.Second * 30,
+		},
+	}
+}
+
+// Gets all projects, allowed for private token that provided through config.
+func (l *gitlabLoader) Projects() (result []contracts.Project, err error) {
+	var rawJson []map[string]interface{}
+	if err = l.get(fmt.Sprintf(projectsUrl, l.gitlabUrl), &rawJson); err != nil {
+		return
+	}
+
+	results := make(chan contracts.Project)
+	go func() {
+		sema := utils.CountingSemaphore{Count: 4}
+		for _, projRaw := range rawJson {
+			sema.Acquire()
+			go func(p map[string]interface{}) {
+				defer sema.Release()
+				results <- l.withPipelines(parseProject(p))
+			}(projRaw)
+		}
+		sema.WaitAll()
+		close(results)
+	}()
+
+	for r := range results {
+		result = append(result, r)
+	}
+	return
+}
+
+// Gets single project by its id.
+// id - the identifier of gitlab project
+func (l *gitlabLoader) Project(id int64) (result contracts.Project, err error) {
+	var rawJson map[string]interface{}
+	if err = l.get(fmt.Sprintf(projectUrl, l.gitlabUrl, id), &rawJson); err != nil {
+		return
+	}
+	return l.withPipelines(parseProject(rawJson)), nil
+}
+
+// Adds pipelines to project, project is returned without pipelines if they can't be loaded.
+func (l *gitlabLoader) withPipelines(project contracts.Project) contracts.Project {
+	var err error
+	project.Pipelines, err = l.getPipelines(project.Id, l.nPipelines)
+	if err != nil {
+		l.logger.Errorf("ErrorResponse while getting pipelines: %v", err)
+	}
+	return project
+}
+
+// Gets pipelines for project.
+// projectId - the identifier of gitlab project
+// nPipelines - top N pipelines to take
+func (l *gitlabLoader) getPipelines(projectId int64, nPipelines int) (pipelines []contracts.Pipeline, err error) {
+	var rawJson []map[string]interface{}
+	if err = l.get(fmt.Sprintf(pipelinesUtl, l.gitlabUrl, projectId), &rawJson); err != nil {
+		return
+	}
+	if nPipelines > len(rawJson) {
+		nPipelines = len(rawJson)
+	}
+	for _, p := range rawJson[:nPipelines] {
+		pipeline := contracts.Pipeline{
+			Id:     int64(p["id"].(float64)),
+			Sha:    p["sha"].(string),
+			Branch: p["ref"].(string),
+			Status: p["status"].(string),
+			WebUrl: p["web_url"].(string),
+		}
+		// add last commit to pipeline
+		pipeline.Commit, err = l.getCommitForProject(projectId, pipeline.Sha)
+		if err != nil {
+			return
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+	return
+}
+
+// Gets commit and converts it to contracts.Commit struct.
+// projectId - the identifier of gitlab project
+// sha - commit's SHA
+func (l *gitlabLoader) getCommitForProject(projectId int64, sha string) (result *contracts.Commit, err error) {
+	var rawJson map[string]interface{}
+	if err = l.get(fmt.Sprintf(commitUrl, l.gitlabUrl, projectId, sha), &rawJson); err != nil {
+		return
+	}
+	result = &contracts.Commit{
+		Title:     rawJson["title"].(string),
+		CreatedAt: rawJson["created_at"].(string),
+		Author:    rawJson["author_name"].(string),
+	}
+	return
+}
+
+// Performs GET request with Private-Token header and decodes json response to result.
+// url - request's url
+func (l *gitlabLoader) get(url string, result interface{}) error {
+	headers := map[string]string{privateToken: l.config.GitlabToken}
+	response, err := utils.PerformGetRequest(l.client, url, headers, l.logger)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func parseProject(p map[string]interface{}) contracts.Project {
+	return contracts.Project{
+		Id:           int64(p["id"].(float64)),
+		Name:         p["name"].(string),
+		Namespace:    p["namespace"].(map[string]interface{})["name"].(string),
+		LastActivity: p["last_activity_at"].(string),
+		WebUrl:       p["web_url"].(string),
+	}
+}
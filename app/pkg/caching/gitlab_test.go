@@ -0,0 +1,168 @@
+package caching
+
+import (
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	projId    int64 = 99
+	pipeId    int64 = 999
+	projName        = "project"
+	branch          = "master"
+	status          = "success"
+	sha             = "sha999"
+	title           = "commit1"
+	createdAt       = "today"
+	author          = "Committer"
+)
+
+func TestNewGitlabLoader(t *testing.T) {
+	actual := NewGitlabLoader(new(config.Config), 5, new(tests.MockLogger))
+	assert.NotNil(t, actual)
+	assert.IsType(t, &gitlabLoader{}, actual)
+}
+
+func TestGitlabLoader_getCommitForProject(t *testing.T) {
+	ts := createTestServer()
+	defer ts.Close()
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof").Twice()
+	mockLogger.On("Errorf").Once()
+	loader := createTestLoader(ts, mockLogger)
+
+	actual, err := loader.getCommitForProject(projId, sha)
+	if assert.NoError(t, err) {
+		assert.NotNil(t, actual)
+		assert.Equal(t, &contracts.Commit{
+			Title:     title,
+			CreatedAt: createdAt,
+			Author:    author,
+		}, actual)
+	}
+	_, err = loader.getCommitForProject(0, sha)
+	assert.Error(t, err)
+}
+
+func TestGitlabLoader_getPipelines(t *testing.T) {
+	ts := createTestServer()
+	defer ts.Close()
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof")
+	mockLogger.On("Errorf").Once()
+	loader := createTestLoader(ts, mockLogger)
+
+	actual, err := loader.getPipelines(projId, 1)
+	if assert.NoError(t, err) {
+		assert.NotNil(t, actual)
+		assert.Equal(t, 1, len(actual))
+		assert.Equal(t, pipeId, actual[0].Id)
+		assert.Equal(t, sha, actual[0].Sha)
+		assert.Equal(t, branch, actual[0].Branch)
+		assert.Equal(t, status, actual[0].Status)
+	}
+	_, err = loader.getPipelines(0, 1)
+	assert.Error(t, err)
+}
+
+func TestGitlabLoader_Projects(t *testing.T) {
+	ts := createTestServer()
+	defer ts.Close()
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof")
+	loader := createTestLoader(ts, mockLogger)
+
+	actual, err := loader.Projects()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(actual))
+		assert.Equal(t, projId, actual[0].Id)
+		assert.Equal(t, projName, actual[0].Name)
+		assert.Equal(t, 1, len(actual[0].Pipelines))
+		assert.Equal(t, pipeId, actual[0].Pipelines[0].Id)
+	}
+}
+
+func TestGitlabLoader_Project(t *testing.T) {
+	ts := createTestServer()
+	defer ts.Close()
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof")
+	mockLogger.On("Errorf").Once()
+	loader := createTestLoader(ts, mockLogger)
+
+	actual, err := loader.Project(projId)
+	if assert.NoError(t, err) {
+		assert.Equal(t, projId, actual.Id)
+		assert.Equal(t, "ns", actual.Namespace)
+		assert.Equal(t, 1, len(actual.Pipelines))
+	}
+	_, err = loader.Project(0)
+	assert.Error(t, err)
+}
+
+func createTestLoader(ts *httptest.Server, logger *tests.MockLogger) *gitlabLoader {
+	return &gitlabLoader{
+		config:     new(config.Config),
+		logger:     logger,
+		client:     ts.Client(),
+		gitlabUrl:  ts.URL,
+		nPipelines: 1,
+	}
+}
+
+func createTestServer() *httptest.Server {
+	const commitResponseFormat = `{
+									"title" : "%s",
+									"created_at" : "%s",
+									"author_name" : "%s"
+								  }`
+	const pipelineResponseFormat = `[{
+									  "id" : %d,
+									  "sha" : "%s",
+									  "ref" : "%s",
+									  "status" : "%s",
+									  "web_url" : "url"
+									}]`
+	const projectResponseFormat = `{
+										"id" : %d,
+										"name" : "%s",
+										"namespace" : {
+											"name" : "ns"
+										},
+										"last_activity_at" : "today",
+										"web_url" : "url"
+									}`
+
+	r := http.NewServeMux()
+	r.HandleFunc(fmt.Sprintf(commitUrl, "", projId, sha), func(w http.ResponseWriter, r *http.Request) {
+		_, err := fmt.Fprintf(w, commitResponseFormat, title, createdAt, author)
+		if err != nil {
+			w.WriteHeader(500)
+		}
+	})
+	r.HandleFunc(fmt.Sprintf(pipelinesUtl, "", projId), func(w http.ResponseWriter, r *http.Request) {
+		_, err := fmt.Fprintf(w, pipelineResponseFormat, pipeId, sha, branch, status)
+		if err != nil {
+			w.WriteHeader(500)
+		}
+	})
+	r.HandleFunc(fmt.Sprintf(projectUrl, "", projId), func(w http.ResponseWriter, r *http.Request) {
+		_, err := fmt.Fprintf(w, projectResponseFormat, projId, projName)
+		if err != nil {
+			w.WriteHeader(500)
+		}
+	})
+	r.HandleFunc(fmt.Sprintf(projectsUrl, ""), func(w http.ResponseWriter, r *http.Request) {
+		_, err := fmt.Fprintf(w, "["+projectResponseFormat+"]", projId, projName)
+		if err != nil {
+			w.WriteHeader(500)
+		}
+	})
+	return httptest.NewServer(r)
+}
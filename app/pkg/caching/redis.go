@@ -0,0 +1,532 @@
+package caching
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"sync/atomic"
+	"time"
+)
+
+// Redis keys
+const (
+	redisKeyPrefix        = "gitlab_extension:cache:"
+	redisIndexKey         = redisKeyPrefix + "index"
+	redisVersionKey       = redisKeyPrefix + "version"
+	redisLoadedAtKey      = redisKeyPrefix + "loaded_at"
+	redisReloadLockKey    = redisKeyPrefix + "reload_lock"
+	redisProjectKeyFormat = redisKeyPrefix + "project:%d"
+)
+
+const (
+	reloadLockTimeout = time.Minute
+	reloadWaitPeriod  = 100 * time.Millisecond
+	maxTxAttempts     = 10
+)
+
+// Errors
+const (
+	cacheNotLoaded = "projects are not loaded"
+	txAttempts     = "cache transaction failed after %d attempts"
+)
+
+// Deletes lock only if it's still held by the caller.
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// redisCache keeps index and every project as separate redis keys with their own TTLs,
+// so every replica of the service serves the same projects.
+// Whole projects list is loaded by the replica that acquired reload lock, others wait for it.
+// Changes are made in transactions watching changed keys, every change increments version key.
+// Hits and misses are counted by every replica separately.
+type redisCache struct {
+	hits               uint64
+	misses             uint64
+	client             *redis.Client
+	defaultExpiration  time.Duration
+	pipelinesPerBranch int
+	loader             Loader
+	logger             logging.Logger
+}
+
+// Creates projects cache stored in redis at given url, e.g. 'redis://:password@localhost:6379/0'.
+// defaultExpiration - TTL of index and every project entry, non-positive value means that entries never expire
+// pipelinesPerBranch - max number of pipelines of every branch kept after webhook event
+// loader - loads projects that are missing in cache
+// logger - Logging module
+func NewRedis(
+	url string,
+	defaultExpiration time.Duration,
+	pipelinesPerBranch int,
+	loader Loader,
+	logger logging.Logger) (ProjectsCache, error) {
+
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping().Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	if defaultExpiration < 0 {
+		defaultExpiration = 0
+	}
+	return &redisCache{
+		client:             client,
+		defaultExpiration:  defaultExpiration,
+		pipelinesPerBranch: pipelinesPerBranch,
+		loader:             loader,
+		logger:             logger,
+	}, nil
+}
+
+// Returns cached projects ordered by namespace and name.
+// If index is expired all projects are loaded, otherwise only expired projects are loaded.
+// Projects that can't be loaded are skipped.
+func (c *redisCache) GetProjects() ([]contracts.Project, error) {
+	index, ok, err := c.index(c.client)
+	if err == nil && !ok {
+		if err = c.Reload(); err == nil {
+			if index, ok, err = c.index(c.client); err == nil && !ok {
+				err = fmt.Errorf(cacheNotLoaded)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	cached, err := c.projects(index)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]contracts.Project, 0, len(index))
+	for i, e := range index {
+		project := cached[i]
+		c.count(project != nil)
+		if project == nil {
+			loaded, err := c.load(e.Id)
+			if err != nil {
+				c.logger.Errorf("Error while loading project %d: %v", e.Id, err)
+				continue
+			}
+			project = &loaded
+		}
+		result = append(result, *project)
+	}
+	return result, nil
+}
+
+func (c *redisCache) GetProject(id int64) (contracts.Project, error) {
+	cached, err := c.projects([]indexEntry{{Id: id}})
+	if err != nil {
+		return contracts.Project{}, err
+	}
+	c.count(cached[0] != nil)
+	if cached[0] != nil {
+		return *cached[0], nil
+	}
+	return c.load(id)
+}
+
+// Returns cached projects and version, projects are read after index and version,
+// so they may be newer than version.
+func (c *redisCache) Snapshot() (projects []contracts.Project, version uint64) {
+	var index []indexEntry
+	err := c.client.Watch(func(tx *redis.Tx) error {
+		var err error
+		if index, _, err = c.index(tx); err != nil {
+			return err
+		}
+		version, err = c.version(tx)
+		return err
+	}, redisIndexKey, redisVersionKey)
+	var cached []*contracts.Project
+	if err == nil {
+		cached, err = c.projects(index)
+	}
+	if err != nil {
+		c.logger.Errorf("Error while reading projects cache snapshot: %v", err)
+		return nil, version
+	}
+	projects = make([]contracts.Project, 0, len(index))
+	for _, project := range cached {
+		if project != nil {
+			projects = append(projects, *project)
+		}
+	}
+	return projects, version
+}
+
+// Replaces all cached projects and index.
+func (c *redisCache) SetProjects(projects []contracts.Project) {
+	index := make([]indexEntry, 0, len(projects))
+	for _, project := range projects {
+		index = addToIndex(index, newIndexEntry(project))
+	}
+	err := c.transaction(func(tx *redis.Tx) ([]txSet, []string, error) {
+		old, _, err := c.index(tx)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids := make(map[int64]struct{}, len(projects))
+		sets := make([]txSet, 0, len(projects)+1)
+		for _, project := range projects {
+			ids[project.Id] = struct{}{}
+			sets = append(sets, txSet{redisProjectKey(project.Id), project, c.defaultExpiration})
+		}
+		sets = append(sets,
+			txSet{redisIndexKey, index, c.defaultExpiration},
+			txSet{redisLoadedAtKey, time.Now().UTC(), c.defaultExpiration})
+		var deleted []string
+		for _, e := range old {
+			if _, ok := ids[e.Id]; !ok {
+				deleted = append(deleted, redisProjectKey(e.Id))
+			}
+		}
+		return sets, deleted, nil
+	}, redisIndexKey)
+	if err != nil {
+		c.logger.Errorf("Error while caching projects: %v", err)
+	}
+}
+
+// Caches single project and adds it to the index, TTL of index isn't changed.
+// Project isn't added to expired index, it will be added by the next load of all projects.
+func (c *redisCache) SetProject(project contracts.Project) {
+	err := c.transaction(func(tx *redis.Tx) ([]txSet, []string, error) {
+		sets := []txSet{{redisProjectKey(project.Id), project, c.defaultExpiration}}
+		index, ok, err := c.index(tx)
+		if err != nil || !ok {
+			return sets, nil, err
+		}
+		ttl, err := c.ttl(tx, redisIndexKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return append(sets, txSet{redisIndexKey, addToIndex(index, newIndexEntry(project)), ttl}), nil, nil
+	}, redisIndexKey)
+	if err != nil {
+		c.logger.Errorf("Error while caching project %d: %v", project.Id, err)
+	}
+}
+
+// Expires cached project, so it's loaded again on the next read.
+func (c *redisCache) Invalidate(id int64) {
+	err := c.transaction(func(tx *redis.Tx) ([]txSet, []string, error) {
+		return nil, []string{redisProjectKey(id)}, nil
+	})
+	if err != nil {
+		c.logger.Errorf("Error while invalidating project %d: %v", id, err)
+	}
+}
+
+// Loads project and replaces cached one.
+func (c *redisCache) Refresh(id int64) error {
+	_, err := c.load(id)
+	return err
+}
+
+// Loads all projects and replaces cached ones.
+// If another replica is loading projects, waits until it finishes instead of loading them again.
+func (c *redisCache) Reload() error {
+	token, err := lockToken()
+	if err != nil {
+		return err
+	}
+	acquired, err := c.client.SetNX(redisReloadLockKey, token, reloadLockTimeout).Result()
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return c.waitReload()
+	}
+	defer func() {
+		if err := unlockScript.Run(c.client, []string{redisReloadLockKey}, token).Err(); err != nil {
+			c.logger.Errorf("Error while releasing projects cache reload lock: %v", err)
+		}
+	}()
+	projects, err := c.loader.Projects()
+	if err != nil {
+		return err
+	}
+	c.SetProjects(projects)
+	return nil
+}
+
+// Removes index and all cached projects, including ones that aren't in the index.
+func (c *redisCache) Clear() {
+	keys := []string{redisIndexKey, redisLoadedAtKey}
+	iter := c.client.Scan(0, redisKeyPrefix+"project:*", 0).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	err := iter.Err()
+	if err == nil {
+		err = c.transaction(func(tx *redis.Tx) ([]txSet, []string, error) {
+			return nil, keys, nil
+		})
+	}
+	if err != nil {
+		c.logger.Errorf("Error while clearing projects cache: %v", err)
+	}
+}
+
+// Returns counters of this replica and state of every project in the index.
+func (c *redisCache) Stats() contracts.CacheStats {
+	result := contracts.CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+	var index []indexEntry
+	err := c.client.Watch(func(tx *redis.Tx) error {
+		var err error
+		if index, _, err = c.index(tx); err != nil {
+			return err
+		}
+		if result.Version, err = c.version(tx); err != nil {
+			return err
+		}
+		var loadedAt time.Time
+		if ok, err := c.get(tx, redisLoadedAtKey, &loadedAt); err != nil || !ok {
+			return err
+		}
+		result.LoadedAt = &loadedAt
+		result.Age = int64(time.Since(loadedAt) / time.Second)
+		result.Ttl, err = c.ttlSeconds(tx, redisIndexKey)
+		return err
+	}, redisIndexKey, redisVersionKey, redisLoadedAtKey)
+	var cached []*contracts.Project
+	if err == nil {
+		cached, err = c.projects(index)
+	}
+	result.Entries = make([]contracts.CacheEntry, 0, len(index))
+	for i := 0; err == nil && i < len(index); i++ {
+		e := index[i]
+		entry := contracts.CacheEntry{ProjectId: e.Id, Project: e.Name, Namespace: e.Namespace}
+		if cached[i] != nil {
+			entry.Pipelines = len(cached[i].Pipelines)
+			entry.Ttl, err = c.ttlSeconds(c.client, redisProjectKey(e.Id))
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	if err != nil {
+		c.logger.Errorf("Error while reading projects cache stats: %v", err)
+	}
+	return result
+}
+
+// Updates pipeline of cached project from webhook event or adds new pipeline, TTL of project isn't changed.
+// Project that isn't cached is loaded first, so pipelines of new projects appear without full reload.
+// Project keeps only pipelinesPerBranch newest pipelines of every branch, ordered by id from the newest.
+// Returns the change, so clients can apply it instead of the raw webhook event.
+func (c *redisCache) UpdatePipeline(pipelinePush contracts.PipelinePush) (change contracts.CacheChange, err error) {
+	if pipelinePush.Attributes == nil || pipelinePush.Project == nil {
+		return change, fmt.Errorf(pushInvalid)
+	}
+	key := redisProjectKey(pipelinePush.Project.Id)
+	var project contracts.Project
+	apply := func(tx *redis.Tx) ([]txSet, []string, error) {
+		project = contracts.Project{}
+		ok, err := c.get(tx, key, &project)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return nil, nil, errNoObject
+		}
+		ttl, err := c.ttl(tx, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		project, change = applyPipeline(project, pipelinePush, c.pipelinesPerBranch)
+		return []txSet{{key, project, ttl}}, nil, nil
+	}
+	err = c.transaction(apply, key)
+	if err != errNoObject {
+		return
+	}
+	if _, err = c.load(pipelinePush.Project.Id); err != nil {
+		return
+	}
+	if err = c.transaction(apply, key); err != nil {
+		return
+	}
+	return addedProject(project), nil
+}
+
+// Counts cache hit or miss.
+func (c *redisCache) count(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+// Loads project and caches it.
+func (c *redisCache) load(id int64) (contracts.Project, error) {
+	project, err := c.loader.Project(id)
+	if err != nil {
+		return project, err
+	}
+	c.SetProject(project)
+	return project, nil
+}
+
+// Waits until replica that holds reload lock finishes loading projects.
+func (c *redisCache) waitReload() error {
+	deadline := time.Now().Add(reloadLockTimeout)
+	for time.Now().Before(deadline) {
+		exists, err := c.client.Exists(redisReloadLockKey).Result()
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			return nil
+		}
+		time.Sleep(reloadWaitPeriod)
+	}
+	return nil
+}
+
+// txSet is a key written by transaction.
+type txSet struct {
+	key   string
+	value interface{}
+	ttl   time.Duration
+}
+
+// Runs change in transaction watching given keys and retries it if watched keys are changed by another client.
+// Change returns keys to set and delete, version is incremented after them.
+func (c *redisCache) transaction(change func(tx *redis.Tx) ([]txSet, []string, error), keys ...string) error {
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		err := c.client.Watch(func(tx *redis.Tx) error {
+			sets, deleted, err := change(tx)
+			if err != nil {
+				return err
+			}
+			values := make([][]byte, len(sets))
+			for i, set := range sets {
+				if values[i], err = json.Marshal(set.value); err != nil {
+					return err
+				}
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				for i, set := range sets {
+					pipe.Set(set.key, values[i], set.ttl)
+				}
+				if len(deleted) > 0 {
+					pipe.Del(deleted...)
+				}
+				pipe.Incr(redisVersionKey)
+				return nil
+			})
+			return err
+		}, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf(txAttempts, maxTxAttempts)
+}
+
+// Returns ordered index of cached projects, ok is false if index is expired.
+func (c *redisCache) index(client redis.Cmdable) (index []indexEntry, ok bool, err error) {
+	ok, err = c.get(client, redisIndexKey, &index)
+	return
+}
+
+func (c *redisCache) version(client redis.Cmdable) (uint64, error) {
+	version, err := client.Get(redisVersionKey).Uint64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Returns projects of index entries, project is nil if it isn't cached or expired.
+func (c *redisCache) projects(index []indexEntry) ([]*contracts.Project, error) {
+	result := make([]*contracts.Project, len(index))
+	if len(index) == 0 {
+		return result, nil
+	}
+	keys := make([]string, len(index))
+	for i, e := range index {
+		keys[i] = redisProjectKey(e.Id)
+	}
+	values, err := c.client.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		result[i] = new(contracts.Project)
+		if err := json.Unmarshal([]byte(value.(string)), result[i]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Reads and decodes value of key, ok is false if key doesn't exist.
+func (c *redisCache) get(client redis.Cmdable, key string, result interface{}) (ok bool, err error) {
+	value, err := client.Get(key).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(value, result)
+}
+
+// Returns remaining TTL of key, zero means that key never expires.
+func (c *redisCache) ttl(client redis.Cmdable, key string) (time.Duration, error) {
+	ttl, err := client.PTTL(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// Returns seconds until key expires, 0 if it doesn't exist.
+func (c *redisCache) ttlSeconds(client redis.Cmdable, key string) (int64, error) {
+	ttl, err := client.PTTL(key).Result()
+	switch {
+	case err != nil:
+		return 0, err
+	case ttl == -time.Millisecond:
+		// PTTL replies -1 for key without expiration
+		return contracts.NoExpiration, nil
+	case ttl < 0:
+		return 0, nil
+	}
+	return int64(ttl / time.Second), nil
+}
+
+func redisProjectKey(id int64) string {
+	return fmt.Sprintf(redisProjectKeyFormat, id)
+}
+
+// Returns random value identifying holder of the lock.
+func lockToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
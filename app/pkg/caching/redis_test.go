@@ -0,0 +1,160 @@
+package caching
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewRedis_InvalidUrl(t *testing.T) {
+	_, err := NewRedis("invalid", time.Hour, 5, new(testLoader), new(tests.MockLogger))
+	assert.Error(t, err)
+}
+
+func TestRedisCache_SharedBetweenReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	firstLoader := &testLoader{projects: createProjects(true)}
+	first := openRedis(t, server, time.Hour, firstLoader)
+	secondLoader := new(testLoader)
+	second := openRedis(t, server, time.Hour, secondLoader)
+
+	actual, err := first.GetProjects()
+	if assert.NoError(t, err) {
+		assert.Equal(t, firstLoader.projects, actual)
+	}
+	actual, err = second.GetProjects()
+	if assert.NoError(t, err) {
+		assert.Equal(t, firstLoader.projects, actual)
+	}
+	assert.Equal(t, 1, firstLoader.projectsCalls)
+	assert.Zero(t, secondLoader.projectsCalls)
+
+	assert.NoError(t, updatePipeline(second, createTestPipelinePush()))
+	project, err := first.GetProject(projectId)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "success", project.Pipelines[0].Status)
+	}
+}
+
+func TestRedisCache_Reload_SingleCrawler(t *testing.T) {
+	server := miniredis.RunT(t)
+	firstLoader := &testLoader{projects: createProjects(false), started: make(chan struct{}), release: make(chan struct{})}
+	first := openRedis(t, server, time.Hour, firstLoader)
+	secondLoader := new(testLoader)
+	second := openRedis(t, server, time.Hour, secondLoader)
+
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- first.Reload()
+	}()
+	<-firstLoader.started
+	go func() {
+		reloaded <- second.Reload()
+	}()
+	time.Sleep(2 * reloadWaitPeriod)
+	close(firstLoader.release)
+	assert.NoError(t, <-reloaded)
+	assert.NoError(t, <-reloaded)
+
+	assert.Zero(t, secondLoader.projectsCalls)
+	projects, _ := second.Snapshot()
+	assert.Equal(t, firstLoader.projects, projects)
+	assert.False(t, server.Exists(redisReloadLockKey))
+}
+
+func TestRedisCache_ExpiredProject(t *testing.T) {
+	server := miniredis.RunT(t)
+	loader := &testLoader{projects: []contracts.Project{{Id: 1, Name: "a", WebUrl: "refreshed"}}}
+	c := openRedis(t, server, time.Hour, loader)
+	c.SetProjects([]contracts.Project{{Id: 1, Name: "a"}, {Id: 2, Name: "b"}})
+	c.Invalidate(2)
+
+	// project that can't be loaded is skipped
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Errorf").Once()
+	c.(*redisCache).logger = mockLogger
+	server.FastForward(time.Minute)
+	server.Del(redisProjectKey(1))
+	actual, err := c.GetProjects()
+	if assert.NoError(t, err) {
+		assert.Equal(t, loader.projects, actual)
+	}
+	mockLogger.AssertExpectations(t)
+	assert.Equal(t, 2, loader.projectCalls)
+	assert.Zero(t, loader.projectsCalls)
+
+	// index expires with its own TTL, so loaded project doesn't prolong it
+	server.FastForward(time.Hour)
+	_, err = c.GetProjects()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loader.projectsCalls)
+}
+
+func TestRedisCache_UpdatePipeline(t *testing.T) {
+	server := miniredis.RunT(t)
+	loader := &testLoader{projects: createProjects(false)}
+	c := openRedis(t, server, time.Hour, loader)
+	c.SetProjects(nil)
+
+	// unknown project is loaded
+	change, err := c.UpdatePipeline(createTestPipelinePush())
+	assert.NoError(t, err)
+	assert.Equal(t, contracts.ProjectAdded, change.Type)
+	assert.Equal(t, 1, loader.projectCalls)
+	server.FastForward(30 * time.Minute)
+	change, err = c.UpdatePipeline(createTestPipelinePush())
+	assert.NoError(t, err)
+	assert.Equal(t, contracts.PipelineUpdated, change.Type)
+	assert.Equal(t, 30*time.Minute, server.TTL(redisProjectKey(projectId)))
+
+	projects, version := c.Snapshot()
+	if assert.Len(t, projects, 1) {
+		assert.Len(t, projects[0].Pipelines, 1)
+		assert.Equal(t, pipelineId, projects[0].Pipelines[0].Id)
+	}
+	// set projects, set project, two updates
+	assert.Equal(t, uint64(4), version)
+
+	_, err = c.UpdatePipeline(contracts.PipelinePush{})
+	assert.EqualError(t, err, pushInvalid)
+}
+
+func TestRedisCache_StatsAndClear(t *testing.T) {
+	server := miniredis.RunT(t)
+	loader := &testLoader{projects: createProjects(true)}
+	c := openRedis(t, server, time.Hour, loader)
+	_, err := c.GetProjects()
+	assert.NoError(t, err)
+	c.Invalidate(projectId)
+	_, err = c.GetProject(projectId)
+	assert.NoError(t, err)
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(3), stats.Version)
+	assert.NotNil(t, stats.LoadedAt)
+	assert.Equal(t, int64(3600), stats.Ttl)
+	if assert.Len(t, stats.Entries, 1) {
+		assert.Equal(t, 1, stats.Entries[0].Pipelines)
+		assert.Equal(t, int64(3600), stats.Entries[0].Ttl)
+	}
+
+	c.SetProject(contracts.Project{Id: 2})
+	c.Clear()
+	assert.Equal(t, []string{redisVersionKey}, server.Keys())
+	stats = c.Stats()
+	assert.Nil(t, stats.LoadedAt)
+	assert.Empty(t, stats.Entries)
+}
+
+func openRedis(t *testing.T, server *miniredis.Miniredis, expiration time.Duration, loader Loader) ProjectsCache {
+	c, err := NewRedis("redis://"+server.Addr(), expiration, 5, loader, new(tests.MockLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,149 @@
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Errors
+const (
+	snapshotIntervalInvalid = "cache snapshot interval must be positive, got %v"
+)
+
+// Snapshotter saves cached projects to file, so cache can be warmed after restart without gitlab requests.
+type Snapshotter interface {
+	Warm() error
+	Save() error
+	Start(interval time.Duration) error
+	Close() error
+}
+
+// snapshot is the file content.
+type snapshot struct {
+	SavedAt  time.Time           `json:"saved_at"`
+	Projects []contracts.Project `json:"projects"`
+}
+
+type snapshotter struct {
+	cache  ProjectsCache
+	path   string
+	logger logging.Logger
+	lock   *sync.Mutex
+	done   chan struct{}
+	once   *sync.Once
+}
+
+// Creates snapshotter of projects cache.
+// cache - Caching module
+// path - snapshot file path
+// logger - Logging module
+func NewSnapshotter(cache ProjectsCache, path string, logger logging.Logger) Snapshotter {
+	return &snapshotter{
+		cache:  cache,
+		path:   path,
+		logger: logger,
+		lock:   new(sync.Mutex),
+		done:   make(chan struct{}),
+		once:   new(sync.Once),
+	}
+}
+
+// Fills cache with projects from snapshot file and reloads them in background,
+// so snapshot is served until current projects are loaded from gitlab.
+// Missing snapshot file isn't an error, cache stays empty then.
+// Cache that already has projects, e.g. shared cache filled by another instance, isn't changed.
+func (s *snapshotter) Warm() error {
+	if cached, _ := s.cache.Snapshot(); len(cached) > 0 {
+		return nil
+	}
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var saved snapshot
+	if err := json.NewDecoder(file).Decode(&saved); err != nil {
+		return err
+	}
+	s.cache.SetProjects(saved.Projects)
+	s.logger.Infof("Projects cache is warmed with %d projects saved at %s", len(saved.Projects), saved.SavedAt)
+	go func() {
+		if err := s.cache.Reload(); err != nil {
+			s.logger.Errorf("Error while reloading warmed projects cache: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Writes cached projects to snapshot file.
+// File is replaced atomically, so it's never left partially written.
+// If cache is empty, e.g. it's expired and gitlab is unavailable, previous snapshot is kept.
+func (s *snapshotter) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	projects, _ := s.cache.Snapshot()
+	if len(projects) == 0 {
+		return nil
+	}
+	value, err := json.Marshal(snapshot{time.Now().UTC(), projects})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(value); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.path)
+}
+
+// Saves snapshot periodically with given interval until snapshotter is closed.
+func (s *snapshotter) Start(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf(snapshotIntervalInvalid, interval)
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Save(); err != nil {
+					s.logger.Errorf("Projects cache snapshot error: %v", err)
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stops periodic saving and saves the last snapshot.
+func (s *snapshotter) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return s.Save()
+}
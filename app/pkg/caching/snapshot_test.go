@@ -0,0 +1,113 @@
+package caching
+
+import (
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotter_SaveAndWarm(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot", "cache.json")
+	projects := createProjects(true)
+	saved := New(-1, 5, new(testLoader), new(tests.MockLogger))
+	saved.SetProjects(projects)
+	assert.NoError(t, NewSnapshotter(saved, path, new(tests.MockLogger)).Save())
+
+	loaded := []contracts.Project{{Id: projectId, Name: "reloaded"}}
+	loader := &testLoader{projects: loaded, started: make(chan struct{}), release: make(chan struct{})}
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof").Once()
+	warmed := New(-1, 5, loader, mockLogger)
+	assert.NoError(t, NewSnapshotter(warmed, path, mockLogger).Warm())
+
+	// snapshot is served while projects are reloaded
+	<-loader.started
+	actual, err := warmed.GetProjects()
+	if assert.NoError(t, err) {
+		assert.Equal(t, projects, actual)
+	}
+	close(loader.release)
+	assert.Eventually(t, func() bool {
+		actual, _ := warmed.GetProjects()
+		return assert.ObjectsAreEqual(loaded, actual)
+	}, time.Second, 10*time.Millisecond)
+	mockLogger.AssertExpectations(t)
+}
+
+func TestSnapshotter_Warm_NoSnapshot(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	loader := new(testLoader)
+	c := New(-1, 5, loader, new(tests.MockLogger))
+	assert.NoError(t, NewSnapshotter(c, filepath.Join(dir, "cache.json"), new(tests.MockLogger)).Warm())
+	projects, _ := c.Snapshot()
+	assert.Empty(t, projects)
+	assert.Zero(t, loader.projectsCalls)
+}
+
+func TestSnapshotter_Warm_InvalidSnapshot(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
+	assert.Error(t, NewSnapshotter(c, path, new(tests.MockLogger)).Warm())
+	projects, _ := c.Snapshot()
+	assert.Empty(t, projects)
+}
+
+func TestSnapshotter_Save_EmptyCache(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
+	c.SetProjects(createProjects(false))
+	snapshotter := NewSnapshotter(c, path, new(tests.MockLogger))
+	assert.NoError(t, snapshotter.Save())
+
+	c.SetProjects(nil)
+	assert.NoError(t, snapshotter.Close())
+
+	// gitlab is unavailable, so snapshot stays in cache
+	warmed := New(-1, 5, &testLoader{err: fmt.Errorf("load error")}, new(tests.MockLogger))
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof").Once()
+	mockLogger.On("Errorf")
+	assert.NoError(t, NewSnapshotter(warmed, path, mockLogger).Warm())
+	projects, _ := warmed.Snapshot()
+	assert.Equal(t, createProjects(false), projects)
+}
+
+func TestSnapshotter_Start(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+	c := New(-1, 5, new(testLoader), new(tests.MockLogger))
+	c.SetProjects(createProjects(false))
+	snapshotter := NewSnapshotter(c, path, new(tests.MockLogger))
+	assert.EqualError(t, snapshotter.Start(0), "cache snapshot interval must be positive, got 0s")
+	assert.EqualError(t, snapshotter.Start(-time.Second), "cache snapshot interval must be positive, got -1s")
+	assert.NoError(t, snapshotter.Start(10*time.Millisecond))
+	defer snapshotter.Close()
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
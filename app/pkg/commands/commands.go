@@ -0,0 +1,277 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/caching"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"github.com/ricdeau/gitlab-extension/app/pkg/utils"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	privateToken = "Private-Token"
+	statusFailed = "failed"
+)
+
+// urls
+const (
+	userUrl     = "%s/user"
+	projectUrl  = "%s/projects/%d"
+	pipelineUrl = "%s/projects/%d/pipelines/%d/%s"
+)
+
+// Errors
+const (
+	commandUnknown    = "unknown command: %s"
+	projectNotAllowed = "project %d is not monitored"
+	projectNotCached  = "project %d is not cached"
+	pipelineNotFound  = "pipeline %d is not found in project %d"
+	pipelineNotFailed = "pipeline %d is %s, only failed pipelines can be acknowledged"
+)
+
+// User is gitlab user authenticated by private token.
+type User struct {
+	Id       int64
+	Username string
+	token    string
+}
+
+// Executor performs commands of websocket clients on behalf of gitlab users.
+// Every command requires user to have access to project, checked with user's token before anything else.
+// Only projects that are already in cache index or belong to configured namespaces are available,
+// projects are never loaded to cache on behalf of user except refresh of available project.
+type Executor interface {
+	Authenticate(token string) (User, error)
+	Execute(user User, command contracts.Command) (contracts.CommandResult, error)
+}
+
+type executor struct {
+	config *config.Config
+	client *http.Client
+	cache  caching.ProjectsCache
+	notify func(contracts.CacheChange)
+	logger logging.Logger
+	lock   *sync.Mutex
+	acks   map[int64]contracts.Acknowledgement
+}
+
+// gitlabProject is project returned by gitlab API.
+type gitlabProject struct {
+	Id        int64 `json:"id"`
+	Namespace struct {
+		Name string `json:"name"`
+	} `json:"namespace"`
+}
+
+// gitlabPipeline is pipeline returned by gitlab API.
+type gitlabPipeline struct {
+	Id     int64  `json:"id"`
+	Sha    string `json:"sha"`
+	Ref    string `json:"ref"`
+	Status string `json:"status"`
+	WebUrl string `json:"web_url"`
+}
+
+// Creates new command executor.
+// conf - Global config
+// cache - projects cache, refreshed projects are loaded to it
+// notify - receives acknowledgements of failed pipelines
+// logger - Logging module
+func New(
+	conf *config.Config,
+	cache caching.ProjectsCache,
+	notify func(contracts.CacheChange),
+	logger logging.Logger) Executor {
+
+	return &executor{
+		config: conf,
+		cache:  cache,
+		notify: notify,
+		logger: logger,
+		lock:   new(sync.Mutex),
+		acks:   make(map[int64]contracts.Acknowledgement),
+		client: &http.Client{
+			Timeout: time.Second * 30,
+		},
+	}
+}
+
+// Gets user of gitlab private token.
+func (e *executor) Authenticate(token string) (User, error) {
+	var result struct {
+		Id       int64  `json:"id"`
+		Username string `json:"username"`
+	}
+	user := User{token: token}
+	if err := e.request(user, http.MethodGet, fmt.Sprintf(userUrl, e.config.GitlabUri), &result); err != nil {
+		return User{}, err
+	}
+	user.Id, user.Username = result.Id, result.Username
+	return user, nil
+}
+
+// Performs command on behalf of user.
+func (e *executor) Execute(user User, command contracts.Command) (result contracts.CommandResult, err error) {
+	result.Command = command.Name
+	switch command.Name {
+	case contracts.CommandRetryPipeline, contracts.CommandCancelPipeline,
+		contracts.CommandRefreshProject, contracts.CommandAckFailure:
+	default:
+		return result, fmt.Errorf(commandUnknown, command.Name)
+	}
+	if err = e.authorize(user, command.ProjectId); err != nil {
+		return
+	}
+	switch command.Name {
+	case contracts.CommandRetryPipeline:
+		result.Pipeline, err = e.pipelineAction(user, command, "retry")
+	case contracts.CommandCancelPipeline:
+		result.Pipeline, err = e.pipelineAction(user, command, "cancel")
+	case contracts.CommandRefreshProject:
+		result.Project, err = e.refresh(command.ProjectId)
+	case contracts.CommandAckFailure:
+		result.Ack, err = e.ack(user, command.ProjectId, command.PipelineId)
+	}
+	return
+}
+
+// Retries or cancels pipeline, changed pipeline is cached when its event is received.
+func (e *executor) pipelineAction(user User, command contracts.Command, action string) (*contracts.Pipeline, error) {
+	var pipeline gitlabPipeline
+	url := fmt.Sprintf(pipelineUrl, e.config.GitlabUri, command.ProjectId, command.PipelineId, action)
+	if err := e.request(user, http.MethodPost, url, &pipeline); err != nil {
+		return nil, err
+	}
+	return &contracts.Pipeline{
+		Id:     pipeline.Id,
+		Sha:    pipeline.Sha,
+		Branch: pipeline.Ref,
+		Status: pipeline.Status,
+		WebUrl: pipeline.WebUrl,
+	}, nil
+}
+
+// Loads project to cache again.
+func (e *executor) refresh(projectId int64) (*contracts.Project, error) {
+	if err := e.cache.Refresh(projectId); err != nil {
+		return nil, err
+	}
+	return e.cachedProject(projectId)
+}
+
+// Acknowledges failed pipeline of cached project, repeated acknowledgement returns the first one.
+// Acknowledgements of pipelines that aren't cached anymore are removed.
+func (e *executor) ack(user User, projectId int64, pipelineId int64) (*contracts.Acknowledgement, error) {
+	projects, _ := e.cache.Snapshot()
+	project, err := findProject(projects, projectId)
+	if err != nil {
+		return nil, err
+	}
+	var pipeline *contracts.Pipeline
+	for i := range project.Pipelines {
+		if project.Pipelines[i].Id == pipelineId {
+			pipeline = &project.Pipelines[i]
+			break
+		}
+	}
+	if pipeline == nil {
+		return nil, fmt.Errorf(pipelineNotFound, pipelineId, project.Id)
+	}
+	if pipeline.Status != statusFailed {
+		return nil, fmt.Errorf(pipelineNotFailed, pipelineId, pipeline.Status)
+	}
+
+	e.lock.Lock()
+	ack, exists := e.acks[pipelineId]
+	if !exists {
+		ack = contracts.Acknowledgement{
+			ProjectId:  project.Id,
+			PipelineId: pipelineId,
+			User:       user.Username,
+			At:         time.Now().UTC(),
+		}
+		e.acks[pipelineId] = ack
+		e.removeAcks(projects)
+	}
+	e.lock.Unlock()
+
+	if !exists {
+		e.notify(contracts.CacheChange{
+			Type:      contracts.PipelineAcknowledged,
+			ProjectId: project.Id,
+			Namespace: project.Namespace,
+			Pipeline:  pipeline,
+			Ack:       &ack,
+		})
+	}
+	return &ack, nil
+}
+
+// Removes acknowledgements of pipelines that aren't cached anymore, including pipelines of evicted projects.
+func (e *executor) removeAcks(projects []contracts.Project) {
+	cached := make(map[int64]bool)
+	for _, project := range projects {
+		for _, pipeline := range project.Pipelines {
+			cached[pipeline.Id] = true
+		}
+	}
+	for id := range e.acks {
+		if !cached[id] {
+			delete(e.acks, id)
+		}
+	}
+}
+
+// Checks that user has access to project and project is in cache index or in configured namespace.
+func (e *executor) authorize(user User, projectId int64) error {
+	var project gitlabProject
+	url := fmt.Sprintf(projectUrl, e.config.GitlabUri, projectId)
+	if err := e.request(user, http.MethodGet, url, &project); err != nil {
+		return err
+	}
+	for _, namespace := range e.config.GitlabNamespaces {
+		if namespace == project.Namespace.Name {
+			return nil
+		}
+	}
+	for _, entry := range e.cache.Stats().Entries {
+		if entry.ProjectId == projectId {
+			return nil
+		}
+	}
+	return fmt.Errorf(projectNotAllowed, projectId)
+}
+
+// Returns cached project without loading it.
+func (e *executor) cachedProject(projectId int64) (*contracts.Project, error) {
+	projects, _ := e.cache.Snapshot()
+	return findProject(projects, projectId)
+}
+
+// Returns project with the id from projects.
+func findProject(projects []contracts.Project, projectId int64) (*contracts.Project, error) {
+	for i := range projects {
+		if projects[i].Id == projectId {
+			return &projects[i], nil
+		}
+	}
+	return nil, fmt.Errorf(projectNotCached, projectId)
+}
+
+// Performs gitlab API request with user's token and decodes json response into result if it's not nil.
+func (e *executor) request(user User, method, url string, result interface{}) error {
+	headers := map[string]string{privateToken: user.token}
+	response, err := utils.PerformRequest(e.client, method, url, headers, nil, e.logger)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil || result == nil {
+		return err
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
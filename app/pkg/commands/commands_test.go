@@ -0,0 +1,202 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	developerToken = "developer-token"
+	guestToken     = "guest-token"
+)
+
+// fakeGitlab emulates user, project and pipeline actions endpoints of gitlab API.
+// Developer has access to projects 1, 2 and 3, guest has no access to any project.
+// Project 1 is cached, project 2 isn't monitored, project 3 is in monitored namespace but isn't cached.
+type fakeGitlab struct {
+	actions []string
+}
+
+func (g *fakeGitlab) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get(privateToken) {
+		case developerToken:
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "username": "developer"})
+		case guestToken:
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 2, "username": "guest"})
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	for id, namespace := range map[int64]string{1: "group", 2: "other", 3: "monitored"} {
+		id, namespace := id, namespace
+		mux.HandleFunc(fmt.Sprintf("/projects/%d", id), func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(privateToken) != developerToken {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "namespace": map[string]string{"name": namespace}})
+		})
+	}
+	for _, action := range []string{"retry", "cancel"} {
+		action := action
+		mux.HandleFunc("/projects/1/pipelines/10/"+action, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.Header.Get(privateToken) != developerToken {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			g.actions = append(g.actions, action)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": 10, "sha": "abc", "ref": "master", "status": "pending", "web_url": "http://gitlab/pipelines/10",
+			})
+		})
+	}
+	return mux
+}
+
+func TestExecutor_Authenticate(t *testing.T) {
+	e, _, _, server := newTestExecutor()
+	defer server.Close()
+
+	user, err := e.Authenticate(developerToken)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), user.Id)
+	assert.Equal(t, "developer", user.Username)
+
+	_, err = e.Authenticate("unknown")
+	assert.EqualError(t, err, "unexpected status code: 401")
+}
+
+func TestExecutor_Execute_Pipeline(t *testing.T) {
+	e, gitlab, _, server := newTestExecutor()
+	defer server.Close()
+	developer, _ := e.Authenticate(developerToken)
+	guest, _ := e.Authenticate(guestToken)
+
+	for _, name := range []string{contracts.CommandRetryPipeline, contracts.CommandCancelPipeline} {
+		t.Run(name, func(t *testing.T) {
+			command := contracts.Command{Name: name, ProjectId: 1, PipelineId: 10}
+			actual, err := e.Execute(developer, command)
+			assert.NoError(t, err)
+			assert.Equal(t, name, actual.Command)
+			assert.Equal(t, &contracts.Pipeline{
+				Id: 10, Sha: "abc", Branch: "master", Status: "pending", WebUrl: "http://gitlab/pipelines/10",
+			}, actual.Pipeline)
+
+			_, err = e.Execute(guest, command)
+			assert.EqualError(t, err, "unexpected status code: 404")
+		})
+	}
+	assert.Equal(t, []string{"retry", "cancel"}, gitlab.actions)
+}
+
+func TestExecutor_Execute_RefreshProject(t *testing.T) {
+	e, _, cache, server := newTestExecutor()
+	defer server.Close()
+	cache.On("Refresh", int64(1)).Once()
+	developer, _ := e.Authenticate(developerToken)
+	guest, _ := e.Authenticate(guestToken)
+
+	actual, err := e.Execute(developer, contracts.Command{Name: contracts.CommandRefreshProject, ProjectId: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), actual.Project.Id)
+
+	_, err = e.Execute(guest, contracts.Command{Name: contracts.CommandRefreshProject, ProjectId: 1})
+	assert.EqualError(t, err, "unexpected status code: 404")
+	cache.AssertExpectations(t)
+}
+
+func TestExecutor_Execute_AckFailure(t *testing.T) {
+	var changes []contracts.CacheChange
+	e, _, _, server := newTestExecutor()
+	defer server.Close()
+	e.(*executor).notify = func(change contracts.CacheChange) {
+		changes = append(changes, change)
+	}
+	developer, _ := e.Authenticate(developerToken)
+	guest, _ := e.Authenticate(guestToken)
+	command := contracts.Command{Name: contracts.CommandAckFailure, ProjectId: 1, PipelineId: 10}
+
+	first, err := e.Execute(developer, command)
+	assert.NoError(t, err)
+	assert.Equal(t, "developer", first.Ack.User)
+	assert.Equal(t, int64(10), first.Ack.PipelineId)
+	second, err := e.Execute(developer, command)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Ack, second.Ack)
+	if assert.Len(t, changes, 1) {
+		assert.Equal(t, contracts.PipelineAcknowledged, changes[0].Type)
+		assert.Equal(t, "group", changes[0].Namespace)
+		assert.Equal(t, int64(10), changes[0].Pipeline.Id)
+		assert.Equal(t, first.Ack, changes[0].Ack)
+	}
+
+	_, err = e.Execute(guest, command)
+	assert.EqualError(t, err, "unexpected status code: 404")
+	_, err = e.Execute(developer, contracts.Command{Name: contracts.CommandAckFailure, ProjectId: 1, PipelineId: 11})
+	assert.EqualError(t, err, "pipeline 11 is success, only failed pipelines can be acknowledged")
+	_, err = e.Execute(developer, contracts.Command{Name: contracts.CommandAckFailure, ProjectId: 1, PipelineId: 12})
+	assert.EqualError(t, err, "pipeline 12 is not found in project 1")
+}
+
+func TestExecutor_Execute_AckFailure_RemovesStaleAcks(t *testing.T) {
+	e, _, _, server := newTestExecutor()
+	defer server.Close()
+	acks := e.(*executor).acks
+	// pipeline 9 isn't cached anymore, project 5 is evicted from cache
+	acks[9] = contracts.Acknowledgement{ProjectId: 1, PipelineId: 9}
+	acks[50] = contracts.Acknowledgement{ProjectId: 5, PipelineId: 50}
+	developer, _ := e.Authenticate(developerToken)
+
+	_, err := e.Execute(developer, contracts.Command{Name: contracts.CommandAckFailure, ProjectId: 1, PipelineId: 10})
+	assert.NoError(t, err)
+	assert.Len(t, acks, 1)
+	assert.Contains(t, acks, int64(10))
+}
+
+func TestExecutor_Execute_Invalid(t *testing.T) {
+	e, gitlab, cache, server := newTestExecutor()
+	defer server.Close()
+	developer, _ := e.Authenticate(developerToken)
+
+	_, err := e.Execute(developer, contracts.Command{Name: "delete_project", ProjectId: 1})
+	assert.EqualError(t, err, "unknown command: delete_project")
+	_, err = e.Execute(developer, contracts.Command{Name: contracts.CommandRetryPipeline, ProjectId: 2, PipelineId: 10})
+	assert.EqualError(t, err, "project 2 is not monitored")
+	_, err = e.Execute(developer, contracts.Command{Name: contracts.CommandRefreshProject, ProjectId: 2})
+	assert.EqualError(t, err, "project 2 is not monitored")
+	// project of monitored namespace is available, but it isn't loaded to cache
+	_, err = e.Execute(developer, contracts.Command{Name: contracts.CommandAckFailure, ProjectId: 3, PipelineId: 10})
+	assert.EqualError(t, err, "project 3 is not cached")
+	assert.Empty(t, gitlab.actions)
+	cache.AssertNotCalled(t, "GetProject", mock.Anything)
+	cache.AssertNotCalled(t, "Refresh", mock.Anything)
+}
+
+func newTestExecutor() (Executor, *fakeGitlab, *tests.MockProjectsCache, *httptest.Server) {
+	gitlab := new(fakeGitlab)
+	server := httptest.NewServer(gitlab.handler())
+	cache := &tests.MockProjectsCache{
+		Projects: []contracts.Project{{Id: 1, Namespace: "group", Pipelines: []contracts.Pipeline{
+			{Id: 10, Status: "failed"},
+			{Id: 11, Status: "success"},
+		}}},
+	}
+	cache.On("Snapshot")
+	cache.On("Stats")
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof")
+	mockLogger.On("Errorf")
+	conf := &config.Config{GitlabUri: server.URL, GitlabNamespaces: []string{"monitored"}}
+	e := New(conf, cache, func(contracts.CacheChange) {}, mockLogger)
+	return e, gitlab, cache, server
+}
@@ -4,22 +4,123 @@ import (
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	"os"
+	"time"
+)
+
+// Default values
+const (
+	defaultJournalPath      = "db/journal"
+	defaultJournalRetention = 7 * 24 * time.Hour
+	defaultJournalMaxEvents = 10000
+	defaultHookSyncInterval = time.Hour
+	defaultFanoutPath       = "db/fanout"
+	defaultBrokerType       = BrokerMemory
+	defaultBrokerPath       = "db/broker"
+	defaultCacheType        = CacheMemory
+	defaultCachePath        = "db/cache.json"
+	defaultCacheSnapshot    = 5 * time.Minute
+	defaultSocketReplaySize = 100
+	defaultSocketPingPeriod = 54 * time.Second
+	defaultSocketPongWait   = 60 * time.Second
+	defaultSocketWriteWait  = 10 * time.Second
+	defaultSocketBufferSize = 256
+	defaultSocketMaxPending = 128
+	defaultSseHeartbeat     = 15 * time.Second
+)
+
+// Message broker types
+const (
+	// Messages are kept in memory and lost on restart.
+	BrokerMemory = "memory"
+	// Messages are kept on disk until every subscriber processes them.
+	BrokerDisk = "disk"
+	// Messages are published to redis channels and received by every instance of the service,
+	// so fan-out and telegram bot must run on one instance only, see Config.RunConsumers.
+	BrokerRedis = "redis"
+)
+
+// Projects cache types
+const (
+	// Projects are cached in memory of every instance of the service.
+	CacheMemory = "memory"
+	// Projects are cached in redis and shared by every instance of the service.
+	CacheRedis = "redis"
 )
 
 // Configuration file type.
+// RunConsumers - instance forwards pipeline events to fan-out targets and runs telegram bot,
+// with redis cache and redis broker it also applies pipeline events to shared cache
 type Config struct {
-	Port             int      `yaml:"port"`
-	GitlabUri        string   `yaml:"gitlab-uri"`
-	GitlabToken      string   `yaml:"gitlab-token"`
-	BotToken         string   `yaml:"telegram-bot-token"`
-	GitlabNamespaces []string `yaml:"gitlab-namespaces"`
-	Origins          []string `yaml:"origins"`
+	Port             int           `yaml:"port"`
+	InstanceName     string        `yaml:"instance-name"`
+	GitlabUri        string        `yaml:"gitlab-uri"`
+	GitlabToken      string        `yaml:"gitlab-token"`
+	BotToken         string        `yaml:"telegram-bot-token"`
+	GitlabNamespaces []string      `yaml:"gitlab-namespaces"`
+	Origins          []string      `yaml:"origins"`
+	AdminToken       string        `yaml:"admin-token"`
+	JournalPath      string        `yaml:"journal-path"`
+	JournalRetention time.Duration `yaml:"journal-retention"`
+	JournalMaxEvents int           `yaml:"journal-max-events"`
+	PublicUrl        string        `yaml:"public-url"`
+	WebhookSecret    string        `yaml:"webhook-secret"`
+	HookSyncInterval time.Duration `yaml:"hook-sync-interval"`
+	FanoutPath       string        `yaml:"fanout-path"`
+	FanoutTargets    []Target      `yaml:"fanout-targets"`
+	BrokerType       string        `yaml:"broker-type"`
+	BrokerPath       string        `yaml:"broker-path"`
+	RedisUrl         string        `yaml:"redis-url"`
+	RunConsumers     bool          `yaml:"run-consumers"`
+	CacheType        string        `yaml:"cache-type"`
+	CachePath        string        `yaml:"cache-path"`
+	CacheSnapshot    time.Duration `yaml:"cache-snapshot-interval"`
+	SocketReplaySize int           `yaml:"socket-replay-size"`
+	SocketPingPeriod time.Duration `yaml:"socket-ping-period"`
+	SocketPongWait   time.Duration `yaml:"socket-pong-wait"`
+	SocketWriteWait  time.Duration `yaml:"socket-write-wait"`
+	SocketBufferSize int           `yaml:"socket-buffer-size"`
+	SocketMaxPending int           `yaml:"socket-max-pending"`
+	SocketMaxConns   int           `yaml:"socket-max-connections"`
+	SocketMaxIpConns int           `yaml:"socket-max-connections-per-ip"`
+	SseHeartbeat     time.Duration `yaml:"sse-heartbeat-interval"`
+}
+
+// Downstream http endpoint that receives pipeline events.
+// Empty filter matches any value, branches are matched as globs.
+type Target struct {
+	Name       string   `yaml:"name"`
+	Url        string   `yaml:"url"`
+	Secret     string   `yaml:"secret"`
+	MaxRetries int      `yaml:"max-retries"`
+	Namespaces []string `yaml:"namespaces"`
+	Projects   []int64  `yaml:"projects"`
+	Branches   []string `yaml:"branches"`
+	Statuses   []string `yaml:"statuses"`
 }
 
 // Loads config file.
 // filepath - path to config file.
 func Get(filepath string, logger *logrus.Logger) *Config {
-	c := new(Config)
+	c := &Config{
+		JournalPath:      defaultJournalPath,
+		JournalRetention: defaultJournalRetention,
+		JournalMaxEvents: defaultJournalMaxEvents,
+		HookSyncInterval: defaultHookSyncInterval,
+		FanoutPath:       defaultFanoutPath,
+		BrokerType:       defaultBrokerType,
+		BrokerPath:       defaultBrokerPath,
+		RunConsumers:     true,
+		CacheType:        defaultCacheType,
+		CachePath:        defaultCachePath,
+		CacheSnapshot:    defaultCacheSnapshot,
+		SocketReplaySize: defaultSocketReplaySize,
+		SocketPingPeriod: defaultSocketPingPeriod,
+		SocketPongWait:   defaultSocketPongWait,
+		SocketWriteWait:  defaultSocketWriteWait,
+		SocketBufferSize: defaultSocketBufferSize,
+		SocketMaxPending: defaultSocketMaxPending,
+		SseHeartbeat:     defaultSseHeartbeat,
+	}
 	file, err := os.Open(filepath)
 	if err != nil {
 		logger.Fatalf("Config load err: %v", err)
@@ -29,5 +130,10 @@ func Get(filepath string, logger *logrus.Logger) *Config {
 	if err != nil {
 		logger.Fatalf("Config unmarshal err: %v", err)
 	}
+	if c.InstanceName == "" {
+		if c.InstanceName, err = os.Hostname(); err != nil {
+			c.InstanceName = "unknown"
+		}
+	}
 	return c
 }
@@ -0,0 +1,58 @@
+package contracts
+
+import "time"
+
+// Ttl value of cache entries that never expire.
+const NoExpiration int64 = -1
+
+// Types of cached projects changes
+const (
+	// Pipeline isn't cached yet.
+	PipelineCreated = "pipeline.created"
+	// Pipeline is already cached, it's replaced.
+	PipelineUpdated = "pipeline.updated"
+	// Project isn't cached yet, it's loaded with its pipelines.
+	ProjectAdded = "project.added"
+	// Failed pipeline is acknowledged by user, cached project isn't changed.
+	PipelineAcknowledged = "pipeline.acknowledged"
+)
+
+// CacheChange is change of cached project made by pipeline event, empty Type means that nothing is changed.
+// Pipeline - pipeline from event as it's cached, for pipeline changes
+// Project - whole cached project, for added project
+// RemovedPipelines - ids of the oldest pipelines that aren't cached anymore
+// Ack - acknowledgement of failed pipeline
+type CacheChange struct {
+	Type             string           `json:"type"`
+	ProjectId        int64            `json:"project_id"`
+	Namespace        string           `json:"namespace"`
+	Pipeline         *Pipeline        `json:"pipeline,omitempty"`
+	Project          *Project         `json:"project,omitempty"`
+	RemovedPipelines []int64          `json:"removed_pipelines,omitempty"`
+	Ack              *Acknowledgement `json:"ack,omitempty"`
+}
+
+// CacheEntry describes cached project.
+// Ttl - seconds until entry expires, 0 if it's expired, NoExpiration if it never expires
+type CacheEntry struct {
+	ProjectId int64  `json:"project_id"`
+	Project   string `json:"project"`
+	Namespace string `json:"namespace"`
+	Pipelines int    `json:"pipelines"`
+	Ttl       int64  `json:"ttl"`
+}
+
+// CacheStats describes state of projects cache.
+// Hits and Misses - number of project reads served from cache and loaded from gitlab
+// LoadedAt - time of the last load of all projects, nil if they weren't loaded
+// Age - seconds since the last load of all projects
+// Ttl - seconds until projects list expires and all projects are loaded again
+type CacheStats struct {
+	Version  uint64       `json:"version"`
+	Hits     uint64       `json:"hits"`
+	Misses   uint64       `json:"misses"`
+	LoadedAt *time.Time   `json:"loaded_at"`
+	Age      int64        `json:"age"`
+	Ttl      int64        `json:"ttl"`
+	Entries  []CacheEntry `json:"entries"`
+}
@@ -0,0 +1,70 @@
+package contracts
+
+import "time"
+
+// PipelineEvent is normalized pipeline webhook message that is sent to downstream consumers.
+type PipelineEvent struct {
+	ProjectId  int64   `json:"project_id"`
+	Project    string  `json:"project"`
+	Namespace  string  `json:"namespace"`
+	PipelineId int64   `json:"pipeline_id"`
+	Branch     string  `json:"branch"`
+	Sha        string  `json:"sha"`
+	Status     string  `json:"status"`
+	WebUrl     string  `json:"web_url"`
+	CreatedAt  string  `json:"created_at"`
+	FinishedAt string  `json:"finished_at"`
+	Duration   int64   `json:"duration"`
+	User       string  `json:"user"`
+	Commit     *Commit `json:"commit,omitempty"`
+}
+
+type DeadLetter struct {
+	Id       uint64        `json:"id"`
+	Target   string        `json:"target"`
+	Url      string        `json:"url"`
+	Event    PipelineEvent `json:"event"`
+	Error    string        `json:"error"`
+	Attempts int           `json:"attempts"`
+	FailedAt time.Time     `json:"failed_at"`
+}
+
+type DeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+// Creates normalized event from gitlab webhook message, missing parts of message are left empty.
+func NewPipelineEvent(push PipelinePush) (event PipelineEvent) {
+	if push.Project != nil {
+		event.ProjectId = push.Project.Id
+		event.Project = push.Project.Name
+		event.Namespace = push.Project.Namespace
+	}
+	if push.Attributes != nil {
+		event.PipelineId = push.Attributes.Id
+		event.Branch = push.Attributes.Branch
+		event.Sha = push.Attributes.Sha
+		event.Status = push.Attributes.Status
+		event.CreatedAt = push.Attributes.CreatedAt
+		event.FinishedAt = push.Attributes.FinishedAt
+		event.Duration = push.Attributes.Duration
+	}
+	if push.User != nil {
+		event.User = push.User.Name
+	}
+	if push.Commit != nil {
+		event.WebUrl = push.Commit.Url
+		event.Commit = &Commit{
+			Title:     push.Commit.Message,
+			CreatedAt: push.Commit.Timestamp,
+		}
+		if push.Commit.Author != nil {
+			event.Commit.Author = push.Commit.Author.Name
+		}
+	}
+	return
+}
+
+func NewDeadLettersResponse(deadLetters []DeadLetter) DeadLettersResponse {
+	return DeadLettersResponse{deadLetters}
+}
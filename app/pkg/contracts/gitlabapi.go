@@ -20,6 +20,14 @@ type Pipeline struct {
 	Status string  `json:"status"`
 	WebUrl string  `json:"web_url"`
 	Commit *Commit `json:"PipelineCommit"`
+	Jobs   []Job   `json:"jobs,omitempty"`
+}
+
+type Job struct {
+	Id     int64  `json:"id"`
+	Stage  string `json:"stage"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
 }
 
 type Commit struct {
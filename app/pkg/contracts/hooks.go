@@ -0,0 +1,28 @@
+package contracts
+
+import "time"
+
+// hook states
+const (
+	HookStateOk      = "ok"
+	HookStateCreated = "created"
+	HookStateUpdated = "updated"
+	HookStateError   = "error"
+)
+
+type HookStatus struct {
+	ProjectId int64     `json:"project_id"`
+	Project   string    `json:"project"`
+	Namespace string    `json:"namespace"`
+	HookId    int64     `json:"hook_id,omitempty"`
+	State     string    `json:"state"`
+	Drift     []string  `json:"drift,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type HooksResponse struct {
+	HookUrl  string       `json:"hook_url"`
+	LastSync time.Time    `json:"last_sync"`
+	Hooks    []HookStatus `json:"hooks"`
+}
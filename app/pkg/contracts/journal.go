@@ -0,0 +1,21 @@
+package contracts
+
+import "time"
+
+type JournalEvent struct {
+	Id            uint64       `json:"id"`
+	EnvelopeId    string       `json:"envelope_id"`
+	Source        string       `json:"source"`
+	CorrelationId string       `json:"correlation_id"`
+	ReceivedAt    time.Time    `json:"received_at"`
+	Kind          string       `json:"kind"`
+	Payload       PipelinePush `json:"payload"`
+}
+
+type EventsResponse struct {
+	Events []JournalEvent `json:"events"`
+}
+
+func NewEventsResponse(events []JournalEvent) EventsResponse {
+	return EventsResponse{events}
+}
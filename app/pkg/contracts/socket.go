@@ -0,0 +1,95 @@
+package contracts
+
+import "time"
+
+// Websocket control message types
+const (
+	// Client replaces its filter of pipeline events.
+	SocketSubscribe = "subscribe"
+	// Server confirms new filter.
+	SocketSubscribed = "subscribed"
+	// Server rejects client message.
+	SocketError = "error"
+	// Server sends current projects when client can't resume from its last event.
+	SocketSnapshot = "snapshot"
+	// Client authenticates with gitlab private token, its commands are performed on behalf of token's user.
+	SocketAuth = "auth"
+	// Server confirms authentication.
+	SocketAuthenticated = "authenticated"
+	// Client sends command, server replies with result or error with the same request id.
+	SocketCommand = "command"
+	// Server sends result of command.
+	SocketResult = "result"
+)
+
+// Websocket commands
+const (
+	CommandRetryPipeline  = "retry_pipeline"
+	CommandCancelPipeline = "cancel_pipeline"
+	CommandRefreshProject = "refresh_project"
+	CommandAckFailure     = "ack_failure"
+)
+
+// SocketFilter selects pipeline events sent to websocket client.
+// Empty filter matches any value, branches are matched as globs.
+type SocketFilter struct {
+	ProjectIds []int64  `json:"project_ids,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Branches   []string `json:"branches,omitempty"`
+	Statuses   []string `json:"statuses,omitempty"`
+}
+
+// SocketMessage is message exchanged with websocket client.
+// Change of cached project is sent with its type, see CacheChange.
+// Seq is sequence number of change, or of the last change included in snapshot.
+// LastSeq is sequence number of the last event received by client before reconnect.
+// RequestId is set by client to match command with its result or error.
+type SocketMessage struct {
+	Type      string         `json:"type"`
+	RequestId string         `json:"request_id,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Seq       uint64         `json:"seq,omitempty"`
+	LastSeq   uint64         `json:"last_seq,omitempty"`
+	Projects  []Project      `json:"projects,omitempty"`
+	Token     string         `json:"token,omitempty"`
+	User      string         `json:"user,omitempty"`
+	Command   *Command       `json:"command,omitempty"`
+	Result    *CommandResult `json:"result,omitempty"`
+	SocketFilter
+	*CacheChange
+}
+
+// Command is action requested by websocket client.
+// PipelineId is required by pipeline commands.
+type Command struct {
+	Name       string `json:"name"`
+	ProjectId  int64  `json:"project_id"`
+	PipelineId int64  `json:"pipeline_id,omitempty"`
+}
+
+// CommandResult is result of command, it contains pipeline, project or acknowledgement depending on command.
+type CommandResult struct {
+	Command  string           `json:"command"`
+	Pipeline *Pipeline        `json:"pipeline,omitempty"`
+	Project  *Project         `json:"project,omitempty"`
+	Ack      *Acknowledgement `json:"ack,omitempty"`
+}
+
+// Acknowledgement marks failed pipeline as taken care of by user.
+type Acknowledgement struct {
+	ProjectId  int64     `json:"project_id"`
+	PipelineId int64     `json:"pipeline_id"`
+	User       string    `json:"user"`
+	At         time.Time `json:"at"`
+}
+
+// SocketStats describes connected websocket clients.
+// Clients is number of connections by client ip, zero limit means unlimited.
+type SocketStats struct {
+	Connections         int            `json:"connections"`
+	Clients             map[string]int `json:"clients"`
+	MaxConnections      int            `json:"max_connections"`
+	MaxConnectionsPerIp int            `json:"max_connections_per_ip"`
+	Rejected            uint64         `json:"rejected"`
+	Evicted             uint64         `json:"evicted"`
+}
@@ -0,0 +1,92 @@
+package fanout
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prologic/bitcask"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	deadLetterPrefix    = "dead_letter_"
+	deadLetterKeyFormat = deadLetterPrefix + "%020d"
+	maxValueSize        = 1 << 20
+)
+
+type DeadLetterStore interface {
+	io.Closer
+	Add(record contracts.DeadLetter) error
+	List() ([]contracts.DeadLetter, error)
+}
+
+// deadLetterStore keeps undelivered events in bitcask.
+type deadLetterStore struct {
+	db     *bitcask.Bitcask
+	lock   *sync.Mutex
+	lastId uint64
+}
+
+// Opens dead letters store at given path.
+func NewDeadLetterStore(path string) (DeadLetterStore, error) {
+	db, err := bitcask.Open(path, bitcask.WithMaxValueSize(maxValueSize))
+	if err != nil {
+		return nil, err
+	}
+	result := &deadLetterStore{db: db, lock: new(sync.Mutex)}
+	err = db.Scan([]byte(deadLetterPrefix), func(key []byte) error {
+		id, err := strconv.ParseUint(strings.TrimPrefix(string(key), deadLetterPrefix), 10, 64)
+		if err == nil && id > result.lastId {
+			result.lastId = id
+		}
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *deadLetterStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.db.Close()
+}
+
+func (s *deadLetterStore) Add(record contracts.DeadLetter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record.Id = s.lastId + 1
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err = s.db.Put([]byte(fmt.Sprintf(deadLetterKeyFormat, record.Id)), value); err != nil {
+		return err
+	}
+	s.lastId = record.Id
+	return nil
+}
+
+// Returns all dead letters, oldest first.
+func (s *deadLetterStore) List() (result []contracts.DeadLetter, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err = s.db.Scan([]byte(deadLetterPrefix), func(key []byte) error {
+		value, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+		var record contracts.DeadLetter
+		if err = json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		result = append(result, record)
+		return nil
+	})
+	return
+}
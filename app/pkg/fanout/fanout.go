@@ -0,0 +1,232 @@
+package fanout
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"github.com/ricdeau/gitlab-extension/app/pkg/utils"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	signatureHeader = "X-Gitlab-Extension-Signature"
+	eventHeader     = "X-Gitlab-Extension-Event"
+	deliveryHeader  = "X-Gitlab-Extension-Delivery"
+	contentType     = "Content-Type"
+	jsonType        = "application/json"
+	pipelineEvent   = "pipeline"
+	queueSize       = 100
+	initialBackoff  = time.Second
+	maxBackoff      = time.Minute
+)
+
+// Errors
+const (
+	queueOverflow    = "target queue overflow"
+	dispatcherClosed = "dispatcher closed"
+)
+
+type Dispatcher interface {
+	io.Closer
+	Dispatch(event contracts.PipelineEvent)
+	DeadLetters() ([]contracts.DeadLetter, error)
+}
+
+// dispatcher sends pipeline events to downstream http targets.
+// Each target has its own queue, so slow target doesn't delay the others.
+// Events that can't be delivered after all retries are stored as dead letters.
+type dispatcher struct {
+	targets     []*target
+	deadLetters DeadLetterStore
+	client      *http.Client
+	logger      logging.Logger
+	backoff     time.Duration
+	done        chan struct{}
+	wg          sync.WaitGroup
+	// lock guards closed, so events aren't enqueued into closed queues
+	lock   *sync.RWMutex
+	closed bool
+}
+
+type target struct {
+	config.Target
+	queue chan contracts.PipelineEvent
+}
+
+// Creates dispatcher and starts delivery to given targets.
+// targets - Downstream endpoints with filters
+// deadLetters - Store for undelivered events
+// logger - Logging module
+func New(targets []config.Target, deadLetters DeadLetterStore, logger logging.Logger) Dispatcher {
+	return newDispatcher(targets, deadLetters, logger, initialBackoff)
+}
+
+func newDispatcher(targets []config.Target, deadLetters DeadLetterStore, logger logging.Logger, backoff time.Duration) *dispatcher {
+	result := &dispatcher{
+		deadLetters: deadLetters,
+		logger:      logger,
+		backoff:     backoff,
+		done:        make(chan struct{}),
+		lock:        new(sync.RWMutex),
+		client: &http.Client{
+			Timeout: time.Second * 10,
+		},
+	}
+	for _, t := range targets {
+		tg := &target{t, make(chan contracts.PipelineEvent, queueSize)}
+		result.targets = append(result.targets, tg)
+		result.wg.Add(1)
+		go result.run(tg)
+	}
+	return result
+}
+
+// Enqueues event for every target which filters match the event.
+// Events dispatched after close are dropped.
+func (d *dispatcher) Dispatch(event contracts.PipelineEvent) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.closed {
+		d.logger.Errorf("Dispatcher is closed, event of pipeline %d is dropped", event.PipelineId)
+		return
+	}
+	for _, t := range d.targets {
+		if !t.matches(event) {
+			continue
+		}
+		select {
+		case t.queue <- event:
+		default:
+			d.logger.Errorf("Queue of target %s is full, event is moved to dead letters", t.Name)
+			d.deadLetter(t, event, fmt.Errorf(queueOverflow), 0)
+		}
+	}
+}
+
+// Returns all stored dead letters.
+func (d *dispatcher) DeadLetters() ([]contracts.DeadLetter, error) {
+	return d.deadLetters.List()
+}
+
+// Stops delivery and waits for target goroutines.
+// Events that are still in queues are moved to dead letters.
+func (d *dispatcher) Close() error {
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return nil
+	}
+	d.closed = true
+	close(d.done)
+	for _, t := range d.targets {
+		close(t.queue)
+	}
+	d.lock.Unlock()
+	d.wg.Wait()
+	return d.deadLetters.Close()
+}
+
+func (d *dispatcher) run(t *target) {
+	defer d.wg.Done()
+	for event := range t.queue {
+		select {
+		case <-d.done:
+			d.deadLetter(t, event, fmt.Errorf(dispatcherClosed), 0)
+			continue
+		default:
+		}
+		attempts, err := d.deliver(t, event)
+		if err != nil {
+			d.logger.Errorf("Unable to deliver event to target %s after %d attempts: %v", t.Name, attempts, err)
+			d.deadLetter(t, event, err, attempts)
+		}
+	}
+}
+
+// Sends event to target, retrying with exponential backoff.
+// Returns number of attempts made and the last error.
+func (d *dispatcher) deliver(t *target, event contracts.PipelineEvent) (attempts int, err error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	headers := map[string]string{
+		contentType:    jsonType,
+		eventHeader:    pipelineEvent,
+		deliveryHeader: uuid.New().String(),
+	}
+	if t.Secret != "" {
+		headers[signatureHeader] = sign(body, t.Secret)
+	}
+	backoff := d.backoff
+	for attempts = 1; ; attempts++ {
+		var response *http.Response
+		response, err = utils.PerformRequest(d.client, http.MethodPost, t.Url, headers, bytes.NewReader(body), d.logger)
+		if response != nil {
+			response.Body.Close()
+		}
+		if err == nil || attempts > t.MaxRetries {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-d.done:
+			err = fmt.Errorf(dispatcherClosed)
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (d *dispatcher) deadLetter(t *target, event contracts.PipelineEvent, err error, attempts int) {
+	record := contracts.DeadLetter{
+		Target:   t.Name,
+		Url:      t.Url,
+		Event:    event,
+		Error:    err.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	}
+	if err := d.deadLetters.Add(record); err != nil {
+		d.logger.Errorf("Unable to store dead letter for target %s: %v", t.Name, err)
+	}
+}
+
+// Checks that event passes all target filters.
+func (t *target) matches(event contracts.PipelineEvent) bool {
+	if len(t.Namespaces) != 0 && !utils.ContainsString(t.Namespaces, event.Namespace) {
+		return false
+	}
+	if len(t.Statuses) != 0 && !utils.ContainsString(t.Statuses, event.Status) {
+		return false
+	}
+	if len(t.Projects) != 0 {
+		found := false
+		for _, id := range t.Projects {
+			found = found || id == event.ProjectId
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(t.Branches) == 0 || utils.MatchBranch(t.Branches, event.Branch)
+}
+
+// Returns 'sha256=<hex>' HMAC signature of body.
+func sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
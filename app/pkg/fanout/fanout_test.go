@@ -0,0 +1,201 @@
+package fanout
+
+import (
+	"encoding/json"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const secret = "secret"
+
+type memoryDeadLetters struct {
+	sync.Mutex
+	records []contracts.DeadLetter
+}
+
+func (m *memoryDeadLetters) Close() error {
+	return nil
+}
+
+func (m *memoryDeadLetters) Add(record contracts.DeadLetter) error {
+	m.Lock()
+	defer m.Unlock()
+	m.records = append(m.records, record)
+	return nil
+}
+
+func (m *memoryDeadLetters) List() ([]contracts.DeadLetter, error) {
+	m.Lock()
+	defer m.Unlock()
+	return append([]contracts.DeadLetter(nil), m.records...), nil
+}
+
+func TestDispatcher_Dispatch_Signed(t *testing.T) {
+	received := make(chan contracts.PipelineEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(signatureHeader) != sign(body, secret) || r.Header.Get(deliveryHeader) == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var event contracts.PipelineEvent
+		_ = json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer ts.Close()
+
+	d := newDispatcher([]config.Target{{Name: "t1", Url: ts.URL, Secret: secret}},
+		new(memoryDeadLetters), createLogger(), time.Millisecond)
+	defer d.Close()
+	expected := contracts.PipelineEvent{ProjectId: 1, Status: "failed"}
+	d.Dispatch(expected)
+
+	select {
+	case actual := <-received:
+		assert.Equal(t, expected, actual)
+	case <-time.After(time.Second):
+		assert.Fail(t, "event hasn't been delivered")
+	}
+}
+
+func TestDispatcher_Dispatch_RetriesAndDeadLetter(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		requests int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	deadLetters := new(memoryDeadLetters)
+	d := newDispatcher([]config.Target{{Name: "t1", Url: ts.URL, MaxRetries: 2}},
+		deadLetters, createLogger(), time.Millisecond)
+	d.Dispatch(contracts.PipelineEvent{ProjectId: 1})
+	// wait until target queue is processed
+	assert.Eventually(t, func() bool {
+		records, _ := deadLetters.List()
+		return len(records) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, d.Close())
+
+	records, _ := deadLetters.List()
+	assert.Equal(t, "t1", records[0].Target)
+	assert.Equal(t, 3, records[0].Attempts)
+	assert.Equal(t, int64(1), records[0].Event.ProjectId)
+	assert.Equal(t, 3, requests)
+}
+
+func TestDispatcher_Close(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		requests int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	deadLetters := new(memoryDeadLetters)
+	d := newDispatcher([]config.Target{{Name: "t1", Url: ts.URL, MaxRetries: 10}},
+		deadLetters, createLogger(), time.Minute)
+	for id := int64(1); id <= 3; id++ {
+		d.Dispatch(contracts.PipelineEvent{PipelineId: id})
+	}
+	// wait until the first event is waiting for retry
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, d.Close())
+	assert.NoError(t, d.Close())
+	d.Dispatch(contracts.PipelineEvent{PipelineId: 4})
+
+	records, _ := deadLetters.List()
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, 1, records[0].Attempts)
+		for i, record := range records {
+			assert.Equal(t, int64(i+1), record.Event.PipelineId)
+			assert.Equal(t, dispatcherClosed, record.Error)
+		}
+		assert.Equal(t, 0, records[2].Attempts)
+	}
+	assert.Equal(t, 1, requests)
+}
+
+func TestTarget_Matches(t *testing.T) {
+	tg := &target{Target: config.Target{
+		Namespaces: []string{"ns"},
+		Projects:   []int64{1, 2},
+		Branches:   []string{"master", "release/*"},
+		Statuses:   []string{"failed"},
+	}}
+	event := contracts.PipelineEvent{ProjectId: 2, Namespace: "ns", Branch: "release/1.0", Status: "failed"}
+	assert.True(t, tg.matches(event))
+
+	other := event
+	other.Branch = "feature/1"
+	assert.False(t, tg.matches(other))
+	other = event
+	other.ProjectId = 3
+	assert.False(t, tg.matches(other))
+	other = event
+	other.Status = "success"
+	assert.False(t, tg.matches(other))
+	other = event
+	other.Namespace = "other"
+	assert.False(t, tg.matches(other))
+
+	assert.True(t, new(target).matches(other))
+}
+
+func TestDeadLetterStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fanout")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewDeadLetterStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, store.Add(contracts.DeadLetter{Target: "t1"}))
+	assert.NoError(t, store.Close())
+
+	store, err = NewDeadLetterStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer store.Close()
+	assert.NoError(t, store.Add(contracts.DeadLetter{Target: "t2"}))
+	records, err := store.List()
+	if assert.NoError(t, err) && assert.Len(t, records, 2) {
+		assert.Equal(t, uint64(1), records[0].Id)
+		assert.Equal(t, "t1", records[0].Target)
+		assert.Equal(t, uint64(2), records[1].Id)
+	}
+}
+
+func createLogger() *tests.MockLogger {
+	logger := new(tests.MockLogger)
+	logger.On("Infof")
+	logger.On("Errorf")
+	return logger
+}
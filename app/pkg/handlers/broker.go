@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"net/http"
+)
+
+// brokerDeadLettersResponse lists poison messages and failures count of every subscriber.
+type brokerDeadLettersResponse struct {
+	DeadLetters []broker.DeadLetterRecord `json:"dead_letters"`
+	Failures    map[string]uint64         `json:"failures"`
+}
+
+// brokerStatsResponse describes state of every broker topic.
+type brokerStatsResponse struct {
+	Topics []broker.TopicStats `json:"topics"`
+}
+
+// Creates handler that returns stats of message broker topics.
+func NewBrokerStats(msgBroker broker.MessageBroker) HandlerFunc {
+	return func(c Context) {
+		c.ToJson(http.StatusOK, brokerStatsResponse{msgBroker.Stats()})
+	}
+}
+
+// Creates handler that lists messages which broker subscribers failed to process.
+func NewBrokerDeadLetters(store broker.DeadLetterStore, msgBroker broker.MessageBroker) HandlerFunc {
+	return func(c Context) {
+		c.ToJson(http.StatusOK, brokerDeadLettersResponse{
+			DeadLetters: store.List(),
+			Failures:    msgBroker.Failures(),
+		})
+	}
+}
+
+// Creates handler that passes message of the dead letter again to the subscriber that failed to process it.
+func NewBrokerDeadLetterReplay(store broker.DeadLetterStore) HandlerFunc {
+	return func(c Context) {
+		err := store.Replay(c.Param("id"))
+		switch err {
+		case nil:
+			c.SetStatusCode(http.StatusAccepted)
+		case broker.ErrDeadLetterNotFound:
+			c.ToJson(http.StatusNotFound, contracts.NewErrorResponse(err))
+		default:
+			c.ToJson(http.StatusInternalServerError, contracts.NewErrorResponse(err))
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestNewBrokerStats(t *testing.T) {
+	mockBroker := new(tests.MockMessageBroker)
+	mockBroker.On("Stats").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("ToJson").Once()
+
+	NewBrokerStats(mockBroker)(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockBroker.AssertExpectations(t)
+}
+
+func TestNewBrokerDeadLetters(t *testing.T) {
+	mockStore := new(tests.MockDeadLetterStore)
+	mockStore.On("List").Once()
+	mockBroker := new(tests.MockMessageBroker)
+	mockBroker.On("Failures").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("ToJson").Once()
+
+	NewBrokerDeadLetters(mockStore, mockBroker)(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockStore.AssertExpectations(t)
+	mockBroker.AssertExpectations(t)
+}
+
+func TestNewBrokerDeadLetterReplay(t *testing.T) {
+	mockStore := new(tests.MockDeadLetterStore)
+	mockStore.On("Replay", "1").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.Params = map[string]string{"id": "1"}
+	mockCtx.On("Param", "id").Once()
+	mockCtx.On("SetStatusCode").Once()
+
+	NewBrokerDeadLetterReplay(mockStore)(mockCtx)
+
+	assert.Equal(t, http.StatusAccepted, mockCtx.Status)
+	mockStore.AssertExpectations(t)
+}
+
+func TestNewBrokerDeadLetterReplay_NotFound(t *testing.T) {
+	mockStore := new(tests.MockDeadLetterStore)
+	mockStore.ReplayError = broker.ErrDeadLetterNotFound
+	mockStore.On("Replay", "2").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.Params = map[string]string{"id": "2"}
+	mockCtx.On("Param", "id").Once()
+	mockCtx.On("ToJson").Once()
+
+	NewBrokerDeadLetterReplay(mockStore)(mockCtx)
+
+	assert.Equal(t, http.StatusNotFound, mockCtx.Status)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/caching"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"net/http"
+	"strconv"
+)
+
+const projectIdParam = "project_id"
+
+// Errors
+const (
+	projectIdInvalid = "invalid project id: %s"
+)
+
+// cacheHandler reports and manages projects cache.
+type cacheHandler struct {
+	cache caching.ProjectsCache
+}
+
+// Creates handler that returns projects cache stats.
+func NewCacheStats(cache caching.ProjectsCache) HandlerFunc {
+	handler := &cacheHandler{cache}
+	return func(c Context) {
+		c.ToJson(http.StatusOK, handler.cache.Stats())
+	}
+}
+
+// Creates handler that loads all projects or single project given by 'project_id' query param
+// from gitlab immediately and returns cache stats.
+func NewCacheRefresh(cache caching.ProjectsCache) HandlerFunc {
+	handler := &cacheHandler{cache}
+	return func(c Context) {
+		handler.refresh(c)
+	}
+}
+
+// Creates handler that removes all cached projects.
+func NewCacheClear(cache caching.ProjectsCache) HandlerFunc {
+	handler := &cacheHandler{cache}
+	return func(c Context) {
+		handler.cache.Clear()
+		c.SetStatusCode(http.StatusNoContent)
+	}
+}
+
+// Handles 'POST /admin/cache/refresh' request.
+func (handler *cacheHandler) refresh(c Context) {
+	var err error
+	if param := c.QueryParam(projectIdParam); param != "" {
+		id, parseErr := strconv.ParseInt(param, 10, 64)
+		if parseErr != nil {
+			c.ToJson(http.StatusBadRequest, contracts.NewErrorResponse(fmt.Errorf(projectIdInvalid, param)))
+			return
+		}
+		err = handler.cache.Refresh(id)
+	} else {
+		err = handler.cache.Reload()
+	}
+	if err != nil {
+		c.ToJson(http.StatusBadGateway, contracts.NewErrorResponse(err))
+		return
+	}
+	c.ToJson(http.StatusOK, handler.cache.Stats())
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestNewCacheStats(t *testing.T) {
+	mockCache := new(tests.MockProjectsCache)
+	mockCache.On("Stats").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("ToJson").Once()
+
+	NewCacheStats(mockCache)(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockCache.AssertExpectations(t)
+}
+
+func TestNewCacheRefresh(t *testing.T) {
+	mockCache := new(tests.MockProjectsCache)
+	mockCache.On("Reload").Once()
+	mockCache.On("Stats").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("QueryParam", projectIdParam).Once()
+	mockCtx.On("ToJson").Once()
+
+	NewCacheRefresh(mockCache)(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockCache.AssertExpectations(t)
+}
+
+func TestNewCacheRefresh_Project(t *testing.T) {
+	mockCache := new(tests.MockProjectsCache)
+	mockCache.On("Refresh", int64(10)).Once()
+	mockCache.On("Stats").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.QueryParams = map[string]string{projectIdParam: "10"}
+	mockCtx.On("QueryParam", projectIdParam).Once()
+	mockCtx.On("ToJson").Once()
+
+	NewCacheRefresh(mockCache)(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockCache.AssertExpectations(t)
+}
+
+func TestNewCacheRefresh_Errors(t *testing.T) {
+	mockCache := new(tests.MockProjectsCache)
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.QueryParams = map[string]string{projectIdParam: "abc"}
+	mockCtx.On("QueryParam", projectIdParam).Once()
+	mockCtx.On("ToJson").Once()
+	NewCacheRefresh(mockCache)(mockCtx)
+	assert.Equal(t, http.StatusBadRequest, mockCtx.Status)
+
+	mockCache.Err = fmt.Errorf("gitlab is unavailable")
+	mockCache.On("Reload").Once()
+	mockCtx = tests.DefaultMockContext()
+	mockCtx.On("QueryParam", projectIdParam).Once()
+	mockCtx.On("ToJson").Once()
+	NewCacheRefresh(mockCache)(mockCtx)
+	assert.Equal(t, http.StatusBadGateway, mockCtx.Status)
+	mockCache.AssertExpectations(t)
+}
+
+func TestNewCacheClear(t *testing.T) {
+	mockCache := new(tests.MockProjectsCache)
+	mockCache.On("Clear").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("SetStatusCode").Once()
+
+	NewCacheClear(mockCache)(mockCtx)
+
+	assert.Equal(t, http.StatusNoContent, mockCtx.Status)
+	mockCache.AssertExpectations(t)
+}
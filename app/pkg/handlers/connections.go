@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"net/http"
+	"sync"
+)
+
+// Errors
+const (
+	socketConnectionsExceeded   = "too many websocket connections"
+	socketIpConnectionsExceeded = "too many websocket connections from %s"
+)
+
+// SocketLimits restricts websocket clients, zero limit means unlimited.
+// MaxPending is number of messages queued for client but not written yet,
+// client that reaches it is too slow and its connection is closed.
+type SocketLimits struct {
+	MaxConnections      int
+	MaxConnectionsPerIp int
+	MaxPending          int
+}
+
+// SocketConnections counts connected websocket clients and rejects new ones over the limits.
+type SocketConnections struct {
+	lock     *sync.Mutex
+	limits   SocketLimits
+	total    int
+	clients  map[string]int
+	rejected uint64
+	evicted  uint64
+}
+
+// socketLimitError is returned when client can't connect, status is status code of response.
+type socketLimitError struct {
+	status int
+	err    error
+}
+
+func (e *socketLimitError) Error() string {
+	return e.err.Error()
+}
+
+// Creates counter of websocket connections.
+func NewSocketConnections(limits SocketLimits) *SocketConnections {
+	return &SocketConnections{
+		lock:    new(sync.Mutex),
+		limits:  limits,
+		clients: make(map[string]int),
+	}
+}
+
+// Creates handler that returns stats of connected websocket clients.
+func NewSocketStats(connections *SocketConnections) HandlerFunc {
+	return func(c Context) {
+		c.ToJson(http.StatusOK, connections.Stats())
+	}
+}
+
+// Returns numbers of connected, rejected and evicted clients.
+func (c *SocketConnections) Stats() contracts.SocketStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	clients := make(map[string]int, len(c.clients))
+	for ip, count := range c.clients {
+		clients[ip] = count
+	}
+	return contracts.SocketStats{
+		Connections:         c.total,
+		Clients:             clients,
+		MaxConnections:      c.limits.MaxConnections,
+		MaxConnectionsPerIp: c.limits.MaxConnectionsPerIp,
+		Rejected:            c.rejected,
+		Evicted:             c.evicted,
+	}
+}
+
+// Reserves connection for client ip, connection must be released when client disconnects.
+func (c *SocketConnections) acquire(ip string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.limits.MaxConnections > 0 && c.total >= c.limits.MaxConnections {
+		c.rejected++
+		return &socketLimitError{http.StatusServiceUnavailable, errors.New(socketConnectionsExceeded)}
+	}
+	if c.limits.MaxConnectionsPerIp > 0 && c.clients[ip] >= c.limits.MaxConnectionsPerIp {
+		c.rejected++
+		return &socketLimitError{http.StatusTooManyRequests, fmt.Errorf(socketIpConnectionsExceeded, ip)}
+	}
+	c.total++
+	c.clients[ip]++
+	return nil
+}
+
+// Releases connection of client ip.
+func (c *SocketConnections) release(ip string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.total--
+	if c.clients[ip]--; c.clients[ip] <= 0 {
+		delete(c.clients, ip)
+	}
+}
+
+// Counts client disconnected because it was too slow.
+func (c *SocketConnections) evict() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evicted++
+}
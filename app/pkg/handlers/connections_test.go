@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestSocketConnections_acquire(t *testing.T) {
+	connections := NewSocketConnections(SocketLimits{MaxConnections: 3, MaxConnectionsPerIp: 2})
+	assert.NoError(t, connections.acquire("10.0.0.1"))
+	assert.NoError(t, connections.acquire("10.0.0.1"))
+
+	err := connections.acquire("10.0.0.1")
+	assert.EqualError(t, err, "too many websocket connections from 10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, err.(*socketLimitError).status)
+
+	assert.NoError(t, connections.acquire("10.0.0.2"))
+	err = connections.acquire("10.0.0.3")
+	assert.EqualError(t, err, "too many websocket connections")
+	assert.Equal(t, http.StatusServiceUnavailable, err.(*socketLimitError).status)
+
+	connections.release("10.0.0.2")
+	connections.evict()
+	actual := connections.Stats()
+	assert.Equal(t, 2, actual.Connections)
+	assert.Equal(t, map[string]int{"10.0.0.1": 2}, actual.Clients)
+	assert.Equal(t, uint64(2), actual.Rejected)
+	assert.Equal(t, uint64(1), actual.Evicted)
+	assert.Equal(t, 3, actual.MaxConnections)
+	assert.Equal(t, 2, actual.MaxConnectionsPerIp)
+}
+
+func TestSocketConnections_acquire_Unlimited(t *testing.T) {
+	connections := NewSocketConnections(SocketLimits{})
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, connections.acquire("10.0.0.1"))
+	}
+	assert.Equal(t, 10, connections.Stats().Connections)
+}
+
+func TestNewSocketStats(t *testing.T) {
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("ToJson").Once()
+
+	NewSocketStats(NewSocketConnections(SocketLimits{}))(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockCtx.AssertExpectations(t)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
 	"net/http"
@@ -25,6 +26,9 @@ type Context interface {
 	GetWriter() http.ResponseWriter
 	GetRequest() *http.Request
 	QueryParam(key string) string
+	Param(key string) string
+	GetHeader(key string) string
+	GetCorrelationId() string
 }
 
 type GinContext struct {
@@ -56,6 +60,14 @@ func (c *GinContext) GetLogger() logging.Logger {
 	return nil
 }
 
+func (c *GinContext) GetCorrelationId() string {
+	correlationId, exists := c.Get(logging.CorrelationIdKey)
+	if exists {
+		return fmt.Sprint(correlationId)
+	}
+	return ""
+}
+
 func (c *GinContext) SetStatusCode(code int) {
 	c.Status(code)
 }
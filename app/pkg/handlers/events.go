@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/journal"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"net/http"
+	"strconv"
+)
+
+// eventsHandler exposes webhook events journal for browsing and replaying.
+type eventsHandler struct {
+	journal journal.Journal
+	broker  broker.MessageBroker
+	source  string
+	logger  logging.Logger
+}
+
+// Creates handler that lists journal events.
+// Supported query params: limit, before, project_id, kind.
+func NewEvents(journal journal.Journal, logger logging.Logger) HandlerFunc {
+	handler := &eventsHandler{journal: journal, logger: logger}
+	return func(c Context) {
+		handler.list(c)
+	}
+}
+
+// Creates handler that publishes journal event with id from path to pipeline replay topic of its namespace.
+// Replayed event gets new envelope with InstanceName from conf as source.
+func NewEventReplay(
+	journal journal.Journal,
+	broker broker.MessageBroker,
+	conf *config.Config,
+	logger logging.Logger) HandlerFunc {
+
+	handler := &eventsHandler{journal, broker, conf.InstanceName, logger}
+	return func(c Context) {
+		handler.replay(c)
+	}
+}
+
+// Handles 'GET /admin/events' request.
+func (handler *eventsHandler) list(c Context) {
+	var (
+		query journal.Query
+		err   error
+	)
+	if param := c.QueryParam("limit"); param != "" {
+		if query.Limit, err = strconv.Atoi(param); err != nil {
+			c.ToJson(http.StatusBadRequest, contracts.NewErrorResponse(err))
+			return
+		}
+	}
+	if param := c.QueryParam("before"); param != "" {
+		if query.Before, err = strconv.ParseUint(param, 10, 64); err != nil {
+			c.ToJson(http.StatusBadRequest, contracts.NewErrorResponse(err))
+			return
+		}
+	}
+	if param := c.QueryParam("project_id"); param != "" {
+		if query.ProjectId, err = strconv.ParseInt(param, 10, 64); err != nil {
+			c.ToJson(http.StatusBadRequest, contracts.NewErrorResponse(err))
+			return
+		}
+	}
+	query.Kind = c.QueryParam("kind")
+
+	events, err := handler.journal.List(query)
+	if err != nil {
+		handler.getLogger(c).Errorf("Unable to list journal events: %v", err)
+		c.ToJson(http.StatusInternalServerError, contracts.NewErrorResponse(err))
+		return
+	}
+	c.ToJson(http.StatusOK, contracts.NewEventsResponse(events))
+}
+
+// Handles 'POST /admin/events/:id/replay' request.
+func (handler *eventsHandler) replay(c Context) {
+	logger := handler.getLogger(c)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.ToJson(http.StatusBadRequest, contracts.NewErrorResponse(err))
+		return
+	}
+	event, err := handler.journal.Get(id)
+	if err == journal.ErrEventNotFound {
+		c.ToJson(http.StatusNotFound, contracts.NewErrorResponse(err))
+		return
+	}
+	if err != nil {
+		logger.Errorf("Unable to get journal event id=%d: %v", id, err)
+		c.ToJson(http.StatusInternalServerError, contracts.NewErrorResponse(err))
+		return
+	}
+
+	envelope := broker.NewPipelineEnvelope(handler.source, c.GetCorrelationId(), event.Payload)
+	topicName := broker.PipelineReplayTopic(handler.source, namespace(event.Payload))
+	logger.Infof("Replaying event id=%d as %s to topic %s", id, envelope.Id, topicName)
+	if err := publish(handler.broker, topicName, envelope); err != nil {
+		logger.Errorf("Message publishing error: %v", err)
+		c.ToJson(http.StatusInternalServerError, contracts.NewErrorResponse(err))
+		return
+	}
+	c.ToJson(http.StatusOK, event)
+}
+
+func (handler *eventsHandler) getLogger(c Context) logging.Logger {
+	if logger := c.GetLogger(); logger != nil {
+		return logger
+	}
+	return handler.logger
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/journal"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestEventsHandler_List(t *testing.T) {
+	mockJournal := new(tests.MockJournal)
+	mockJournal.On("List", journal.Query{Limit: 10, Before: 5, ProjectId: 1, Kind: "pipeline"}).Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.QueryParams = map[string]string{
+		"limit":      "10",
+		"before":     "5",
+		"project_id": "1",
+		"kind":       "pipeline",
+	}
+	mockCtx.On("QueryParam", "limit").Once()
+	mockCtx.On("QueryParam", "before").Once()
+	mockCtx.On("QueryParam", "project_id").Once()
+	mockCtx.On("QueryParam", "kind").Once()
+	mockCtx.On("ToJson").Once()
+
+	NewEvents(mockJournal, new(tests.MockLogger))(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockJournal.AssertExpectations(t)
+}
+
+func TestEventsHandler_List_BadRequest(t *testing.T) {
+	mockJournal := new(tests.MockJournal)
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.QueryParams = map[string]string{"limit": "ten"}
+	mockCtx.On("QueryParam", "limit").Once()
+	mockCtx.On("ToJson").Once()
+
+	NewEvents(mockJournal, new(tests.MockLogger))(mockCtx)
+
+	assert.Equal(t, http.StatusBadRequest, mockCtx.Status)
+}
+
+func TestEventsHandler_Replay_Success(t *testing.T) {
+	const topic = "gitlab.instance.pipeline.public.replay"
+	push := contracts.PipelinePush{Kind: "pipeline", Project: &contracts.PipelineProject{Namespace: "public"}}
+	mockJournal := new(tests.MockJournal)
+	mockJournal.Events = []contracts.JournalEvent{{Id: 1, Payload: push}}
+	mockJournal.On("Get", uint64(1)).Once()
+	mockBroker := new(tests.MockMessageBroker)
+	mockBroker.On("AddTopic", topic).Once()
+	mockBroker.On("Publish", topic, pipelineEnvelope(push)).Once()
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.Params = map[string]string{"id": "1"}
+	mockCtx.Logger = func() logging.Logger {
+		return mockLogger
+	}
+	mockCtx.On("GetLogger").Once()
+	mockCtx.On("Param", "id").Once()
+	mockCtx.On("GetCorrelationId").Once()
+	mockCtx.On("ToJson").Once()
+
+	NewEventReplay(mockJournal, mockBroker, &config.Config{InstanceName: "instance"}, mockLogger)(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockBroker.AssertExpectations(t)
+}
+
+func TestEventsHandler_Replay_NotFound(t *testing.T) {
+	mockJournal := new(tests.MockJournal)
+	mockJournal.On("Get", uint64(2)).Once()
+	mockBroker := new(tests.MockMessageBroker)
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.Params = map[string]string{"id": "2"}
+	mockCtx.On("GetLogger").Once()
+	mockCtx.On("Param", "id").Once()
+	mockCtx.On("ToJson").Once()
+
+	NewEventReplay(mockJournal, mockBroker, new(config.Config), new(tests.MockLogger))(mockCtx)
+
+	assert.Equal(t, http.StatusNotFound, mockCtx.Status)
+	mockBroker.AssertNotCalled(t, "Publish")
+}
+
+func TestEventsHandler_Replay_BadRequest(t *testing.T) {
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.Params = map[string]string{"id": "abc"}
+	mockCtx.On("GetLogger").Once()
+	mockCtx.On("Param", "id").Once()
+	mockCtx.On("ToJson").Once()
+
+	NewEventReplay(new(tests.MockJournal), new(tests.MockMessageBroker), new(config.Config), new(tests.MockLogger))(mockCtx)
+
+	assert.Equal(t, http.StatusBadRequest, mockCtx.Status)
+}
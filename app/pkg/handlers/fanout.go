@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/fanout"
+	"net/http"
+)
+
+// Creates handler that lists events which couldn't be delivered to fan-out targets.
+func NewDeadLetters(dispatcher fanout.Dispatcher) HandlerFunc {
+	return func(c Context) {
+		deadLetters, err := dispatcher.DeadLetters()
+		if err != nil {
+			c.ToJson(http.StatusInternalServerError, contracts.NewErrorResponse(err))
+			return
+		}
+		c.ToJson(http.StatusOK, contracts.NewDeadLettersResponse(deadLetters))
+	}
+}
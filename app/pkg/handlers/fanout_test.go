@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestNewDeadLetters(t *testing.T) {
+	mockDispatcher := new(tests.MockDispatcher)
+	mockDispatcher.On("DeadLetters").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("ToJson").Once()
+
+	NewDeadLetters(mockDispatcher)(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockDispatcher.AssertExpectations(t)
+}
+
+func TestNewDeadLetters_Error(t *testing.T) {
+	mockDispatcher := new(tests.MockDispatcher)
+	mockDispatcher.Err = fmt.Errorf("db error")
+	mockDispatcher.On("DeadLetters").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("ToJson").Once()
+
+	NewDeadLetters(mockDispatcher)(mockCtx)
+
+	assert.Equal(t, http.StatusInternalServerError, mockCtx.Status)
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/hooks"
+	"net/http"
+)
+
+// hooksHandler reports and syncs gitlab project hooks state.
+type hooksHandler struct {
+	manager hooks.Manager
+}
+
+// Creates handler that returns result of the last hooks sync.
+func NewHooks(manager hooks.Manager) HandlerFunc {
+	handler := &hooksHandler{manager}
+	return func(c Context) {
+		c.ToJson(http.StatusOK, handler.manager.Status())
+	}
+}
+
+// Creates handler that syncs hooks immediately and returns the result.
+func NewHooksSync(manager hooks.Manager) HandlerFunc {
+	handler := &hooksHandler{manager}
+	return func(c Context) {
+		handler.sync(c)
+	}
+}
+
+// Handles 'POST /admin/hooks/sync' request.
+func (handler *hooksHandler) sync(c Context) {
+	if err := handler.manager.Sync(); err != nil {
+		c.ToJson(http.StatusBadGateway, contracts.NewErrorResponse(err))
+		return
+	}
+	c.ToJson(http.StatusOK, handler.manager.Status())
+}
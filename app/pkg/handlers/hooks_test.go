@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestHooksHandler_Status(t *testing.T) {
+	mockManager := new(tests.MockHooksManager)
+	mockManager.On("Status").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("ToJson").Once()
+
+	NewHooks(mockManager)(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockManager.AssertExpectations(t)
+}
+
+func TestHooksHandler_Sync(t *testing.T) {
+	mockManager := new(tests.MockHooksManager)
+	mockManager.On("Sync").Once()
+	mockManager.On("Status").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("ToJson").Once()
+
+	NewHooksSync(mockManager)(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockManager.AssertExpectations(t)
+}
+
+func TestHooksHandler_Sync_Error(t *testing.T) {
+	mockManager := new(tests.MockHooksManager)
+	mockManager.SyncError = fmt.Errorf("sync error")
+	mockManager.On("Sync").Once()
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.On("ToJson").Once()
+
+	NewHooksSync(mockManager)(mockCtx)
+
+	assert.Equal(t, http.StatusBadGateway, mockCtx.Status)
+	mockManager.AssertNotCalled(t, "Status")
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"sync"
+)
+
+// replayEvent is change of cached project numbered in order it was sent to clients.
+type replayEvent struct {
+	seq     uint64
+	change  contracts.CacheChange
+	message []byte
+}
+
+// replayBuffer keeps last N sent events, so reconnected clients can receive events they missed.
+type replayBuffer struct {
+	lock   *sync.RWMutex
+	size   int
+	last   uint64
+	events []replayEvent
+}
+
+// Creates buffer of given size, size less than 1 disables replay.
+func newReplayBuffer(size int) *replayBuffer {
+	if size < 0 {
+		size = 0
+	}
+	return &replayBuffer{
+		lock:   new(sync.RWMutex),
+		size:   size,
+		events: make([]replayEvent, 0, size),
+	}
+}
+
+// Numbers change with next sequence number and adds it to buffer, the oldest event is dropped if buffer is full.
+func (b *replayBuffer) append(change contracts.CacheChange) (result replayEvent, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	result.seq = b.last + 1
+	result.change = change
+	result.message, err = json.Marshal(contracts.SocketMessage{Type: change.Type, Seq: result.seq, CacheChange: &change})
+	if err != nil {
+		return
+	}
+	b.last = result.seq
+	if b.size == 0 {
+		return
+	}
+	if len(b.events) == b.size {
+		copy(b.events, b.events[1:])
+		b.events = b.events[:len(b.events)-1]
+	}
+	b.events = append(b.events, result)
+	return
+}
+
+// Returns sequence number of the last event.
+func (b *replayBuffer) lastSeq() uint64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.last
+}
+
+// Returns events sent after given sequence number and sequence number of the last event.
+// ok is false if some of these events are already dropped,
+// or if sequence number is unknown, e.g. it was received before restart of the service.
+func (b *replayBuffer) since(seq uint64) (events []replayEvent, last uint64, ok bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if seq > b.last {
+		return nil, b.last, false
+	}
+	if seq == b.last {
+		return nil, b.last, true
+	}
+	if len(b.events) == 0 || b.events[0].seq > seq+1 {
+		return nil, b.last, false
+	}
+	first := len(b.events) - int(b.last-seq)
+	events = make([]replayEvent, len(b.events)-first)
+	copy(events, b.events[first:])
+	return events, b.last, true
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReplayBuffer_append(t *testing.T) {
+	buffer := newReplayBuffer(2)
+	for i := int64(1); i <= 3; i++ {
+		event, err := buffer.append(testChange(i, "master"))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), event.seq)
+		assert.Equal(t, i, event.change.Pipeline.Id)
+
+		var message contracts.SocketMessage
+		assert.NoError(t, json.Unmarshal(event.message, &message))
+		assert.Equal(t, contracts.PipelineUpdated, message.Type)
+		assert.Equal(t, uint64(i), message.Seq)
+		assert.Equal(t, i, message.Pipeline.Id)
+		assert.Equal(t, int64(1), message.ProjectId)
+	}
+	assert.Equal(t, uint64(3), buffer.lastSeq())
+	assert.Len(t, buffer.events, 2)
+	assert.Equal(t, uint64(2), buffer.events[0].seq)
+}
+
+func TestReplayBuffer_since(t *testing.T) {
+	buffer := newReplayBuffer(3)
+	for i := int64(1); i <= 5; i++ {
+		_, err := buffer.append(testChange(i, "master"))
+		assert.NoError(t, err)
+	}
+	testCases := []struct {
+		name     string
+		seq      uint64
+		expected []uint64
+		ok       bool
+	}{
+		{"dropped", 1, nil, false},
+		{"oldest", 2, []uint64{3, 4, 5}, true},
+		{"middle", 3, []uint64{4, 5}, true},
+		{"last", 5, nil, true},
+		{"unknown", 6, nil, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, last, ok := buffer.since(tc.seq)
+			var actual []uint64
+			for _, event := range events {
+				actual = append(actual, event.seq)
+			}
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, actual)
+			assert.Equal(t, uint64(5), last)
+		})
+	}
+}
+
+func TestReplayBuffer_since_Disabled(t *testing.T) {
+	buffer := newReplayBuffer(0)
+	_, err := buffer.append(testChange(1, "master"))
+	assert.NoError(t, err)
+
+	_, last, ok := buffer.since(1)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), last)
+	_, _, ok = buffer.since(0)
+	assert.False(t, ok)
+}
+
+func testChange(pipelineId int64, branch string) contracts.CacheChange {
+	return contracts.CacheChange{
+		Type:      contracts.PipelineUpdated,
+		ProjectId: 1,
+		Namespace: "group",
+		Pipeline:  &contracts.Pipeline{Id: pipelineId, Branch: branch, Status: "running"},
+	}
+}
@@ -2,51 +2,405 @@ package handlers
 
 import (
 	"encoding/json"
-	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/ricdeau/gitlab-extension/app/pkg/caching"
+	"github.com/ricdeau/gitlab-extension/app/pkg/commands"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
 	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"github.com/ricdeau/gitlab-extension/app/pkg/utils"
+	"gopkg.in/olahol/melody.v1"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Session key of client's state.
+const socketSessionKey = "session"
+
+// Close message reason of evicted client.
+const socketTooSlow = "client is too slow"
+
+// Max number of subscriptions of session waiting to be performed.
+const socketMaxSubscriptions = 10
+
+// Errors
+const (
+	socketMessageInvalid = "invalid message: %v"
+	socketTypeUnknown    = "unknown message type: %s"
+	socketUnauthorized   = "authentication is required"
+	socketCommandMissing = "command is missing"
+	socketTooManySubs    = "too many pending subscriptions"
 )
 
 type WsBroadcaster interface {
-	Broadcast(msg []byte) error
-	HandleRequest(w http.ResponseWriter, r *http.Request) error
+	BroadcastFilter(msg []byte, fn func(*melody.Session) bool) error
+	HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, keys map[string]interface{}) error
+	HandleMessage(fn func(*melody.Session, []byte))
+	HandleSentMessage(fn func(*melody.Session, []byte))
 }
 
-// socketHandler handles messages from global broker to websockets.
+// socketHandler sends messages of pipeline stream to websockets.
+// Every client receives only events matching its filter, new client receives all events until it subscribes.
+// Events are numbered, so client that reconnects with number of its last event receives events it missed,
+// or snapshot of projects if these events aren't buffered anymore.
+// Client that doesn't read its messages fast enough is evicted, so it can't fill its buffer.
+// Authenticated client can send commands, they are performed concurrently and their results are matched by request id.
 type socketHandler struct {
 	WsBroadcaster
-	broker broker.MessageBroker
-	logger logging.Logger
+	stream      *PipelineStream
+	connections *SocketConnections
+	cache       caching.ProjectsCache
+	executor    commands.Executor
+	logger      logging.Logger
+}
+
+// socketSession is state of websocket session.
+// It's stored in session keys when session is created, so keys map itself is never modified.
+// Every event from firstSeq to lastSeq has been passed to session's filter, so they aren't sent twice.
+// Live events are held while subscriptions are performed, subscriptions replay them from stream.
+// pending is number of messages queued for session but not written yet.
+// user is set when client authenticates.
+type socketSession struct {
+	pending       int64
+	evicted       int32
+	lock          *sync.RWMutex
+	filter        contracts.SocketFilter
+	firstSeq      uint64
+	lastSeq       uint64
+	subscriptions []contracts.SocketMessage
+	subscribing   bool
+	user          *commands.User
 }
 
 // Create new socketHandler instance
-func NewSocket(topic string, broadcaster WsBroadcaster, broker broker.MessageBroker, logger logging.Logger) HandlerFunc {
-	handler := &socketHandler{broadcaster, broker, logger}
-	if err := handler.broker.AddTopic(topic); err != nil {
-		panic(err)
+// stream - numbered changes of cached projects
+// connections - counter of connected clients and their limits
+// cache - projects cache for snapshots
+// executor - performs commands of authenticated clients
+func NewSocket(
+	stream *PipelineStream,
+	broadcaster WsBroadcaster,
+	connections *SocketConnections,
+	cache caching.ProjectsCache,
+	executor commands.Executor,
+	logger logging.Logger) HandlerFunc {
+
+	handler := &socketHandler{broadcaster, stream, connections, cache, executor, logger}
+	handler.HandleMessage(handler.receive)
+	handler.HandleSentMessage(func(s *melody.Session, _ []byte) {
+		getSession(s).sent()
+	})
+	stream.listen(handler.send)
+	return func(c Context) {
+		handler.handle(c)
 	}
-	err := handler.broker.Subscribe(topic, func(message interface{}) {
-		msgBytes, err := json.Marshal(message)
-		if err != nil {
-			handler.logger.Errorf("error while marshaling message %v to json: %v", message, err)
+}
+
+// Handler http message, upgrades connection to websocket if client doesn't exceed connection limits.
+// Connection is counted until client disconnects.
+// Clients are counted by remote address of connection, forwarding headers can be forged by client.
+func (handler *socketHandler) handle(c Context) {
+	request := c.GetRequest()
+	ip := remoteIp(request)
+	if err := handler.connections.acquire(ip); err != nil {
+		c.ToJson(err.(*socketLimitError).status, contracts.NewErrorResponse(err))
+		return
+	}
+	defer handler.connections.release(ip)
+	keys := map[string]interface{}{
+		socketSessionKey: &socketSession{lock: new(sync.RWMutex)},
+	}
+	err := handler.HandleRequestWithKeys(c.GetWriter(), request, keys)
+	if err != nil {
+		handler.logger.Errorf("websocket request error: %v", err)
+	}
+}
+
+// Sends change to sessions which filters match it.
+func (handler *socketHandler) send(event replayEvent) {
+	err := handler.BroadcastFilter(event.message, func(s *melody.Session) bool {
+		return getSession(s).accept(event) && handler.queue(s)
+	})
+	if err != nil {
+		handler.logger.Errorf("websocket broadcast error on event %d: %v", event.seq, err)
+	}
+}
+
+// Handles message of websocket client.
+// Subscriptions, authentication and commands wait for cache or gitlab,
+// so they are performed in background and don't block reading of the next messages and pongs.
+func (handler *socketHandler) receive(s *melody.Session, msg []byte) {
+	var request contracts.SocketMessage
+	if err := json.Unmarshal(msg, &request); err != nil {
+		handler.write(s, socketError(fmt.Errorf(socketMessageInvalid, err)))
+		return
+	}
+	switch request.Type {
+	case contracts.SocketSubscribe:
+		handler.queueSubscription(s, request)
+	case contracts.SocketAuth:
+		go handler.authenticate(s, request)
+	case contracts.SocketCommand:
+		go handler.execute(s, request)
+	default:
+		handler.reply(s, request, socketError(fmt.Errorf(socketTypeUnknown, request.Type)))
+	}
+}
+
+// Queues subscription of session and starts performing subscriptions if they aren't performed yet.
+// Live events are held from now on until all queued subscriptions are performed.
+func (handler *socketHandler) queueSubscription(s *melody.Session, request contracts.SocketMessage) {
+	session := getSession(s)
+	session.lock.Lock()
+	if len(session.subscriptions) >= socketMaxSubscriptions {
+		session.lock.Unlock()
+		handler.write(s, socketError(errors.New(socketTooManySubs)))
+		return
+	}
+	session.subscriptions = append(session.subscriptions, request)
+	start := !session.subscribing
+	session.subscribing = true
+	session.lock.Unlock()
+	if start {
+		go handler.subscribeAll(s)
+	}
+}
+
+// Performs queued subscriptions of session in order, then resumes live events.
+func (handler *socketHandler) subscribeAll(s *melody.Session) {
+	session := getSession(s)
+	for {
+		session.lock.Lock()
+		if len(session.subscriptions) == 0 {
+			session.subscribing = false
+			session.lock.Unlock()
+			return
 		}
-		err = handler.Broadcast(msgBytes)
+		request := session.subscriptions[0]
+		session.subscriptions = session.subscriptions[1:]
+		session.lock.Unlock()
+		handler.subscribe(s, request)
+	}
+}
+
+// Replaces filter of session.
+// Subscribed client receives events it missed since last_seq,
+// or snapshot of projects if last_seq is empty or too old.
+// Events that have already been passed to session aren't sent again.
+func (handler *socketHandler) subscribe(s *melody.Session, request contracts.SocketMessage) {
+	session := getSession(s)
+	seq := request.LastSeq
+	var snapshot *contracts.SocketMessage
+	if !handler.stream.canResume(seq) {
+		// live events are held, so events sent while projects are loaded are replayed after snapshot
+		seq = handler.stream.buffer.lastSeq()
+		projects, err := handler.cache.GetProjects()
 		if err != nil {
-			handler.logger.Errorf("websocket broadcast error on message %v: %v", message, err)
+			handler.logger.Errorf("websocket snapshot error: %v", err)
+			// events held meanwhile are sent with the previous filter
+			session.lock.Lock()
+			if session.lastSeq != 0 {
+				handler.replay(s, session, session.lastSeq)
+			}
+			session.lock.Unlock()
+			handler.write(s, socketError(err))
+			return
 		}
-	})
+		message := newSnapshot(projects, request.SocketFilter, seq)
+		snapshot = &message
+	}
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.filter = request.SocketFilter
+	handler.write(s, contracts.SocketMessage{Type: contracts.SocketSubscribed, SocketFilter: request.SocketFilter})
+	if snapshot != nil {
+		handler.write(s, *snapshot)
+	}
+	handler.replay(s, session, seq)
+}
+
+// Sends buffered events after seq that match session's filter and haven't been passed to session yet.
+// Session must be locked.
+func (handler *socketHandler) replay(s *melody.Session, session *socketSession, seq uint64) {
+	events, last := handler.stream.since(seq)
+	for _, event := range events {
+		if event.seq >= session.firstSeq && event.seq <= session.lastSeq {
+			continue
+		}
+		if matchesFilter(session.filter, event.change) {
+			handler.writeBytes(s, event.message)
+		}
+	}
+	// session has been passed every event after seq, and every event from firstSeq before
+	if session.firstSeq == 0 || seq+1 < session.firstSeq {
+		session.firstSeq = seq + 1
+	}
+	if last > session.lastSeq {
+		session.lastSeq = last
+	}
+}
+
+// Authenticates session's user by gitlab private token.
+func (handler *socketHandler) authenticate(s *melody.Session, request contracts.SocketMessage) {
+	user, err := handler.executor.Authenticate(request.Token)
 	if err != nil {
-		panic(err)
+		handler.reply(s, request, socketError(err))
+		return
 	}
-	return func(c Context) {
-		handler.handle(c)
+	session := getSession(s)
+	session.lock.Lock()
+	session.user = &user
+	session.lock.Unlock()
+	handler.reply(s, request, contracts.SocketMessage{Type: contracts.SocketAuthenticated, User: user.Username})
+}
+
+// Performs command on behalf of session's user.
+func (handler *socketHandler) execute(s *melody.Session, request contracts.SocketMessage) {
+	session := getSession(s)
+	session.lock.RLock()
+	user := session.user
+	session.lock.RUnlock()
+	if user == nil {
+		handler.reply(s, request, socketError(errors.New(socketUnauthorized)))
+		return
+	}
+	if request.Command == nil {
+		handler.reply(s, request, socketError(errors.New(socketCommandMissing)))
+		return
 	}
+	result, err := handler.executor.Execute(*user, *request.Command)
+	if err != nil {
+		handler.logger.Warnf("websocket command %s of user %s failed: %v", request.Command.Name, user.Username, err)
+		handler.reply(s, request, socketError(err))
+		return
+	}
+	handler.reply(s, request, contracts.SocketMessage{Type: contracts.SocketResult, Result: &result})
 }
 
-// Handler http message. Just a stub.
-func (handler *socketHandler) handle(c Context) {
-	err := handler.HandleRequest(c.GetWriter(), c.GetRequest())
+// Writes response to request, response has the same request id.
+func (handler *socketHandler) reply(s *melody.Session, request contracts.SocketMessage, response contracts.SocketMessage) {
+	response.RequestId = request.RequestId
+	handler.write(s, response)
+}
+
+func (handler *socketHandler) write(s *melody.Session, msg contracts.SocketMessage) {
+	msgBytes, err := json.Marshal(msg)
 	if err != nil {
-		handler.logger.Errorf("websocket request error: %v", err)
+		handler.logger.Errorf("websocket write error: %v", err)
+		return
+	}
+	handler.writeBytes(s, msgBytes)
+}
+
+func (handler *socketHandler) writeBytes(s *melody.Session, msg []byte) {
+	if !handler.queue(s) {
+		return
+	}
+	if err := s.Write(msg); err != nil {
+		handler.logger.Errorf("websocket write error: %v", err)
+	}
+}
+
+// Reserves place for message in session's queue, evicts session that reached the limit.
+func (handler *socketHandler) queue(s *melody.Session) bool {
+	ok, evict := getSession(s).queue(handler.connections.limits.MaxPending)
+	if evict {
+		handler.connections.evict()
+		handler.logger.Warnf("websocket client %s is too slow, closing connection", s.Request.RemoteAddr)
+		msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, socketTooSlow)
+		if err := s.CloseWithMsg(msg); err != nil {
+			handler.logger.Errorf("websocket close error: %v", err)
+		}
+	}
+	return ok
+}
+
+// Returns host of request's remote address.
+func remoteIp(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+func socketError(err error) contracts.SocketMessage {
+	return contracts.SocketMessage{Type: contracts.SocketError, Error: err.Error()}
+}
+
+// Returns state of session, session created without state receives all events.
+func getSession(s *melody.Session) *socketSession {
+	if value, ok := s.Get(socketSessionKey); ok {
+		return value.(*socketSession)
+	}
+	return &socketSession{lock: new(sync.RWMutex)}
+}
+
+// Checks that event is new for session and passes its filter, marks event as sent.
+// Events aren't accepted while session is subscribing, subscription replays them.
+func (f *socketSession) accept(event replayEvent) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.subscribing || event.seq <= f.lastSeq {
+		return false
+	}
+	if f.firstSeq == 0 {
+		f.firstSeq = event.seq
+	}
+	f.lastSeq = event.seq
+	return matchesFilter(f.filter, event.change)
+}
+
+// Counts message queued for session, messages aren't queued after session is evicted.
+// maxPending - limit of queued messages, zero means unlimited
+// evict is true only when session reaches the limit.
+func (f *socketSession) queue(maxPending int) (ok bool, evict bool) {
+	if atomic.LoadInt32(&f.evicted) != 0 {
+		return false, false
+	}
+	if pending := atomic.AddInt64(&f.pending, 1); maxPending <= 0 || pending <= int64(maxPending) {
+		return true, false
+	}
+	atomic.AddInt64(&f.pending, -1)
+	return false, atomic.CompareAndSwapInt32(&f.evicted, 0, 1)
+}
+
+// Counts message written to session.
+func (f *socketSession) sent() {
+	atomic.AddInt64(&f.pending, -1)
+}
+
+// Checks that change passes all filters.
+// Added project is checked only by project filters, its pipelines are sent as they are.
+func matchesFilter(filter contracts.SocketFilter, change contracts.CacheChange) bool {
+	if !matchesProject(filter, contracts.Project{Id: change.ProjectId, Namespace: change.Namespace}) {
+		return false
+	}
+	if change.Pipeline == nil {
+		return true
+	}
+	if len(filter.Statuses) != 0 && !utils.ContainsString(filter.Statuses, change.Pipeline.Status) {
+		return false
+	}
+	return len(filter.Branches) == 0 || utils.MatchBranch(filter.Branches, change.Pipeline.Branch)
+}
+
+// Checks that project passes project and namespace filters.
+func matchesProject(filter contracts.SocketFilter, project contracts.Project) bool {
+	if len(filter.Namespaces) != 0 && !utils.ContainsString(filter.Namespaces, project.Namespace) {
+		return false
+	}
+	if len(filter.ProjectIds) == 0 {
+		return true
+	}
+	for _, id := range filter.ProjectIds {
+		if id == project.Id {
+			return true
+		}
 	}
+	return false
 }
@@ -1,18 +1,415 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/ricdeau/gitlab-extension/app/pkg/caching"
+	"github.com/ricdeau/gitlab-extension/app/pkg/commands"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
 	"github.com/ricdeau/gitlab-extension/app/tests"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gopkg.in/olahol/melody.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewSocket(t *testing.T) {
-	mockBroker := new(tests.MockMessageBroker)
-	mockBroker.On("AddTopic", "topic")
-	mockBroker.On("Subscribe").Once()
 	mockBroadcaster := tests.DefaultMockBroadcaster()
+	mockBroadcaster.On("HandleMessage").Once()
+	mockBroadcaster.On("HandleSentMessage").Once()
 	mockLogger := new(tests.MockLogger)
-	actual := NewSocket("topic", mockBroadcaster, mockBroker, mockLogger)
+	stream := NewPipelineStream(10, mockLogger)
+	connections := NewSocketConnections(SocketLimits{})
+	actual := NewSocket(stream, mockBroadcaster, connections, new(tests.MockProjectsCache), new(fakeExecutor), mockLogger)
 	assert.NotNil(t, actual)
 	assert.IsType(t, HandlerFunc(nil), actual)
+	assert.NotNil(t, mockBroadcaster.MessageHandler)
+	assert.NotNil(t, mockBroadcaster.SentHandler)
+	assert.Len(t, stream.listeners, 1)
+	mockBroadcaster.AssertExpectations(t)
+}
+
+func TestSocketHandler_handle(t *testing.T) {
+	var actualKeys map[string]interface{}
+	mockBroadcaster := tests.DefaultMockBroadcaster()
+	mockBroadcaster.On("HandleRequestWithKeys").Once()
+	mockBroadcaster.HandleRequestFunc = func(w http.ResponseWriter, r *http.Request, keys map[string]interface{}) error {
+		actualKeys = keys
+		return nil
+	}
+	connections := NewSocketConnections(SocketLimits{})
+	handler := &socketHandler{WsBroadcaster: mockBroadcaster, connections: connections, logger: new(tests.MockLogger)}
+	mockContext := tests.DefaultMockContext()
+	mockContext.Request = &http.Request{RemoteAddr: "10.0.0.1:5000"}
+	mockContext.On("GetWriter").Once()
+	mockContext.On("GetRequest").Once()
+	handler.handle(mockContext)
+
+	mockBroadcaster.AssertExpectations(t)
+	assert.IsType(t, &socketSession{}, actualKeys[socketSessionKey])
+	assert.Zero(t, connections.Stats().Connections)
+}
+
+func TestSocketHandler_handle_LimitExceeded(t *testing.T) {
+	mockBroadcaster := tests.DefaultMockBroadcaster()
+	connections := NewSocketConnections(SocketLimits{MaxConnectionsPerIp: 1})
+	assert.NoError(t, connections.acquire("10.0.0.1"))
+	handler := &socketHandler{WsBroadcaster: mockBroadcaster, connections: connections, logger: new(tests.MockLogger)}
+	mockContext := tests.DefaultMockContext()
+	// forwarding headers are ignored, so client can't bypass the limit
+	mockContext.Request = &http.Request{
+		RemoteAddr: "10.0.0.1:5000",
+		Header:     http.Header{"X-Forwarded-For": {"10.0.0.2"}, "X-Real-Ip": {"10.0.0.3"}},
+	}
+	mockContext.On("GetRequest").Once()
+	mockContext.On("ToJson").Once()
+	handler.handle(mockContext)
+
+	assert.Equal(t, http.StatusTooManyRequests, mockContext.Status)
+	mockBroadcaster.AssertNotCalled(t, "HandleRequestWithKeys")
+	assert.Equal(t, 1, connections.Stats().Connections)
+}
+
+func TestSocketHandler_send(t *testing.T) {
+	all := newTestSession(contracts.SocketFilter{})
+	matching := newTestSession(contracts.SocketFilter{ProjectIds: []int64{1}, Branches: []string{"release/*"}})
+	other := newTestSession(contracts.SocketFilter{ProjectIds: []int64{2}})
+	var received []*melody.Session
+	mockBroadcaster := tests.DefaultMockBroadcaster()
+	mockBroadcaster.On("BroadcastFilter", mock.Anything).Once()
+	mockBroadcaster.BroadcastFunc = func(msg []byte, fn func(*melody.Session) bool) error {
+		for _, s := range []*melody.Session{all, matching, other} {
+			if fn(s) {
+				received = append(received, s)
+			}
+		}
+		return nil
+	}
+	stream := NewPipelineStream(10, new(tests.MockLogger))
+	handler := &socketHandler{
+		WsBroadcaster: mockBroadcaster,
+		stream:        stream,
+		connections:   NewSocketConnections(SocketLimits{}),
+		logger:        new(tests.MockLogger),
+	}
+	stream.listen(handler.send)
+	stream.Send(testChange(10, "release/1.0"))
+
+	mockBroadcaster.AssertExpectations(t)
+	assert.Equal(t, []*melody.Session{all, matching}, received)
+	assert.Equal(t, uint64(1), stream.buffer.lastSeq())
+	assert.Equal(t, uint64(1), getSession(other).lastSeq)
+}
+
+func TestMatchesFilter(t *testing.T) {
+	change := contracts.CacheChange{
+		Type:      contracts.PipelineUpdated,
+		ProjectId: 1,
+		Namespace: "group",
+		Pipeline:  &contracts.Pipeline{Branch: "feature/login", Status: "failed"},
+	}
+	added := contracts.CacheChange{Type: contracts.ProjectAdded, ProjectId: 1, Namespace: "group"}
+	testCases := []struct {
+		name     string
+		filter   contracts.SocketFilter
+		expected bool
+		added    bool
+	}{
+		{"empty", contracts.SocketFilter{}, true, true},
+		{"project", contracts.SocketFilter{ProjectIds: []int64{2, 1}}, true, true},
+		{"other project", contracts.SocketFilter{ProjectIds: []int64{2}}, false, false},
+		{"namespace", contracts.SocketFilter{Namespaces: []string{"group"}}, true, true},
+		{"other namespace", contracts.SocketFilter{Namespaces: []string{"other"}}, false, false},
+		{"status", contracts.SocketFilter{Statuses: []string{"success", "failed"}}, true, true},
+		{"other status", contracts.SocketFilter{Statuses: []string{"success"}}, false, true},
+		{"branch glob", contracts.SocketFilter{Branches: []string{"master", "feature/*"}}, true, true},
+		{"other branch", contracts.SocketFilter{Branches: []string{"master"}}, false, true},
+		{"all fields", contracts.SocketFilter{
+			ProjectIds: []int64{1},
+			Namespaces: []string{"group"},
+			Branches:   []string{"feature/*"},
+			Statuses:   []string{"failed"},
+		}, true, true},
+		{"one field mismatch", contracts.SocketFilter{
+			ProjectIds: []int64{1},
+			Statuses:   []string{"success"},
+		}, false, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, matchesFilter(tc.filter, change))
+			assert.Equal(t, tc.added, matchesFilter(tc.filter, added))
+		})
+	}
+}
+
+func TestSocketSession_accept(t *testing.T) {
+	filter := getSession(newTestSession(contracts.SocketFilter{ProjectIds: []int64{1}}))
+	assert.True(t, filter.accept(replayEvent{seq: 2, change: contracts.CacheChange{ProjectId: 1}}))
+	assert.False(t, filter.accept(replayEvent{seq: 1, change: contracts.CacheChange{ProjectId: 1}}))
+	assert.False(t, filter.accept(replayEvent{seq: 3, change: contracts.CacheChange{ProjectId: 2}}))
+	assert.Equal(t, uint64(3), filter.lastSeq)
+}
+
+func TestSocketSession_queue(t *testing.T) {
+	session := getSession(newTestSession(contracts.SocketFilter{}))
+	for i := 0; i < 2; i++ {
+		ok, evict := session.queue(2)
+		assert.True(t, ok)
+		assert.False(t, evict)
+	}
+	session.sent()
+	ok, _ := session.queue(2)
+	assert.True(t, ok)
+	ok, evict := session.queue(2)
+	assert.False(t, ok)
+	assert.True(t, evict)
+	session.sent()
+	ok, evict = session.queue(2)
+	assert.False(t, ok)
+	assert.False(t, evict)
+}
+
+func TestGetSession_NoKeys(t *testing.T) {
+	actual := getSession(&melody.Session{})
+	assert.True(t, actual.accept(replayEvent{seq: 1, change: contracts.CacheChange{ProjectId: 1}}))
+}
+
+func TestSocketHandler_receive_Snapshot(t *testing.T) {
+	cache := &tests.MockProjectsCache{Projects: []contracts.Project{{Id: 1, Namespace: "group"}, {Id: 2, Namespace: "other"}}}
+	cache.On("GetProjects")
+	handler, server := newTestSocketServer(cache, 10)
+	defer server.Close()
+	handler.stream.Send(testChange(1, "master"))
+	conn := dialTestSocket(t, server)
+	defer conn.Close()
+
+	writeSocketMessage(t, conn, contracts.SocketMessage{
+		Type:         contracts.SocketSubscribe,
+		SocketFilter: contracts.SocketFilter{Namespaces: []string{"group"}, Branches: []string{"release/*"}},
+	})
+	assert.Equal(t, contracts.SocketSubscribed, readSocketMessage(t, conn).Type)
+	snapshot := readSocketMessage(t, conn)
+	assert.Equal(t, contracts.SocketSnapshot, snapshot.Type)
+	assert.Equal(t, uint64(1), snapshot.Seq)
+	assert.Equal(t, []contracts.Project{{Id: 1, Namespace: "group"}}, snapshot.Projects)
+
+	handler.stream.Send(testChange(2, "master"))
+	handler.stream.Send(testChange(3, "release/1.0"))
+	event := readSocketMessage(t, conn)
+	assert.Equal(t, contracts.PipelineUpdated, event.Type)
+	assert.Equal(t, uint64(3), event.Seq)
+	assert.Equal(t, int64(3), event.Pipeline.Id)
+}
+
+func TestSocketHandler_receive_Resume(t *testing.T) {
+	cache := new(tests.MockProjectsCache)
+	handler, server := newTestSocketServer(cache, 10)
+	defer server.Close()
+	for i := int64(1); i <= 3; i++ {
+		handler.stream.Send(testChange(i, "master"))
+	}
+	conn := dialTestSocket(t, server)
+	defer conn.Close()
+
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: contracts.SocketSubscribe, LastSeq: 1})
+	assert.Equal(t, contracts.SocketSubscribed, readSocketMessage(t, conn).Type)
+	assert.Equal(t, uint64(2), readSocketMessage(t, conn).Seq)
+	assert.Equal(t, uint64(3), readSocketMessage(t, conn).Seq)
+	handler.stream.Send(testChange(4, "master"))
+	assert.Equal(t, uint64(4), readSocketMessage(t, conn).Seq)
+	cache.AssertNotCalled(t, "GetProjects")
+}
+
+func TestSocketHandler_receive_ResumeAfterLiveEvents(t *testing.T) {
+	cache := new(tests.MockProjectsCache)
+	handler, server := newTestSocketServer(cache, 10)
+	defer server.Close()
+	handler.stream.Send(testChange(1, "master"))
+	handler.stream.Send(testChange(2, "master"))
+	conn := dialTestSocket(t, server)
+	defer conn.Close()
+	waitTestSocket(t, conn)
+
+	// client receives live events until it subscribes
+	handler.stream.Send(testChange(3, "master"))
+	assert.Equal(t, uint64(3), readSocketMessage(t, conn).Seq)
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: contracts.SocketSubscribe, LastSeq: 1})
+	assert.Equal(t, contracts.SocketSubscribed, readSocketMessage(t, conn).Type)
+	assert.Equal(t, uint64(2), readSocketMessage(t, conn).Seq)
+	handler.stream.Send(testChange(4, "master"))
+	assert.Equal(t, uint64(4), readSocketMessage(t, conn).Seq)
+}
+
+func TestSocketHandler_receive_SnapshotHoldsLiveEvents(t *testing.T) {
+	var handler *socketHandler
+	cache := &tests.MockProjectsCache{Projects: []contracts.Project{{Id: 1, Namespace: "group"}}}
+	cache.On("GetProjects").Run(func(mock.Arguments) {
+		handler.stream.Send(testChange(2, "master"))
+		// let hub offer event to session before snapshot is sent
+		time.Sleep(20 * time.Millisecond)
+	})
+	handler, server := newTestSocketServer(cache, 10)
+	defer server.Close()
+	handler.stream.Send(testChange(1, "master"))
+	conn := dialTestSocket(t, server)
+	defer conn.Close()
+	waitTestSocket(t, conn)
+
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: contracts.SocketSubscribe})
+	assert.Equal(t, contracts.SocketSubscribed, readSocketMessage(t, conn).Type)
+	snapshot := readSocketMessage(t, conn)
+	assert.Equal(t, contracts.SocketSnapshot, snapshot.Type)
+	assert.Equal(t, uint64(1), snapshot.Seq)
+	assert.Equal(t, uint64(2), readSocketMessage(t, conn).Seq)
+	handler.stream.Send(testChange(3, "master"))
+	assert.Equal(t, uint64(3), readSocketMessage(t, conn).Seq)
+}
+
+func TestSocketHandler_receive_ResumeTooOld(t *testing.T) {
+	cache := &tests.MockProjectsCache{Projects: []contracts.Project{{Id: 1}}}
+	cache.On("GetProjects")
+	handler, server := newTestSocketServer(cache, 2)
+	defer server.Close()
+	for i := int64(1); i <= 4; i++ {
+		handler.stream.Send(testChange(i, "master"))
+	}
+	conn := dialTestSocket(t, server)
+	defer conn.Close()
+
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: contracts.SocketSubscribe, LastSeq: 1})
+	assert.Equal(t, contracts.SocketSubscribed, readSocketMessage(t, conn).Type)
+	snapshot := readSocketMessage(t, conn)
+	assert.Equal(t, contracts.SocketSnapshot, snapshot.Type)
+	assert.Equal(t, uint64(4), snapshot.Seq)
+	handler.stream.Send(testChange(5, "master"))
+	assert.Equal(t, uint64(5), readSocketMessage(t, conn).Seq)
+}
+
+func TestSocketHandler_receive_Command(t *testing.T) {
+	handler, server := newTestSocketServer(new(tests.MockProjectsCache), 10)
+	defer server.Close()
+	handler.logger.(*tests.MockLogger).On("Warnf")
+	conn := dialTestSocket(t, server)
+	defer conn.Close()
+	command := &contracts.Command{Name: contracts.CommandRetryPipeline, ProjectId: 1, PipelineId: 10}
+
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: contracts.SocketCommand, RequestId: "1", Command: command})
+	response := readSocketMessage(t, conn)
+	assert.Equal(t, contracts.SocketError, response.Type)
+	assert.Equal(t, "1", response.RequestId)
+	assert.Equal(t, "authentication is required", response.Error)
+
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: contracts.SocketAuth, RequestId: "2", Token: "invalid"})
+	response = readSocketMessage(t, conn)
+	assert.Equal(t, contracts.SocketError, response.Type)
+	assert.Equal(t, "2", response.RequestId)
+
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: contracts.SocketAuth, RequestId: "3", Token: "token"})
+	response = readSocketMessage(t, conn)
+	assert.Equal(t, contracts.SocketAuthenticated, response.Type)
+	assert.Equal(t, "3", response.RequestId)
+	assert.Equal(t, "developer", response.User)
+
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: contracts.SocketCommand, RequestId: "4", Command: command})
+	response = readSocketMessage(t, conn)
+	assert.Equal(t, contracts.SocketResult, response.Type)
+	assert.Equal(t, "4", response.RequestId)
+	assert.Equal(t, contracts.CommandRetryPipeline, response.Result.Command)
+	assert.Equal(t, int64(10), response.Result.Pipeline.Id)
+
+	command.Name = "delete_project"
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: contracts.SocketCommand, RequestId: "5", Command: command})
+	response = readSocketMessage(t, conn)
+	assert.Equal(t, contracts.SocketError, response.Type)
+	assert.Equal(t, "5", response.RequestId)
+	assert.Equal(t, "unknown command: delete_project", response.Error)
+}
+
+func TestSocketHandler_receive_UnknownType(t *testing.T) {
+	_, server := newTestSocketServer(new(tests.MockProjectsCache), 10)
+	defer server.Close()
+	conn := dialTestSocket(t, server)
+	defer conn.Close()
+
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: "unsubscribe"})
+	response := readSocketMessage(t, conn)
+	assert.Equal(t, contracts.SocketError, response.Type)
+	assert.Equal(t, "unknown message type: unsubscribe", response.Error)
+}
+
+// fakeExecutor authenticates "token" and retries pipelines.
+type fakeExecutor struct{}
+
+func (e *fakeExecutor) Authenticate(token string) (commands.User, error) {
+	if token != "token" {
+		return commands.User{}, errors.New("unexpected status code: 401")
+	}
+	return commands.User{Id: 1, Username: "developer"}, nil
+}
+
+func (e *fakeExecutor) Execute(_ commands.User, command contracts.Command) (contracts.CommandResult, error) {
+	if command.Name != contracts.CommandRetryPipeline {
+		return contracts.CommandResult{}, fmt.Errorf("unknown command: %s", command.Name)
+	}
+	return contracts.CommandResult{Command: command.Name, Pipeline: &contracts.Pipeline{Id: command.PipelineId}}, nil
+}
+
+func newTestSession(filter contracts.SocketFilter) *melody.Session {
+	return &melody.Session{Keys: map[string]interface{}{
+		socketSessionKey: &socketSession{lock: new(sync.RWMutex), filter: filter},
+	}}
+}
+
+// Starts websocket server with real melody instance.
+func newTestSocketServer(cache caching.ProjectsCache, replaySize int) (*socketHandler, *httptest.Server) {
+	socket := melody.New()
+	handler := &socketHandler{
+		socket,
+		NewPipelineStream(replaySize, new(tests.MockLogger)),
+		NewSocketConnections(SocketLimits{MaxPending: 10}),
+		cache,
+		new(fakeExecutor),
+		new(tests.MockLogger),
+	}
+	socket.HandleMessage(handler.receive)
+	socket.HandleSentMessage(func(s *melody.Session, _ []byte) {
+		getSession(s).sent()
+	})
+	handler.stream.listen(handler.send)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/ws", HandlerFunc(handler.handle).Handler())
+	return handler, httptest.NewServer(router)
+}
+
+func dialTestSocket(t *testing.T, server *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Waits until session of connection is registered, so it receives live events.
+func waitTestSocket(t *testing.T, conn *websocket.Conn) {
+	writeSocketMessage(t, conn, contracts.SocketMessage{Type: "ping"})
+	assert.Equal(t, contracts.SocketError, readSocketMessage(t, conn).Type)
+}
+
+func writeSocketMessage(t *testing.T, conn *websocket.Conn, msg contracts.SocketMessage) {
+	assert.NoError(t, conn.WriteJSON(msg))
+}
+
+func readSocketMessage(t *testing.T, conn *websocket.Conn) (msg contracts.SocketMessage) {
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	assert.NoError(t, conn.ReadJSON(&msg))
+	return
 }
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/caching"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lastEventIdHeader = "Last-Event-ID"
+	// Max number of events waiting to be written to client, slower client is disconnected and has to resume.
+	sseBufferSize = 64
+	// Heartbeat interval used when configured one isn't positive.
+	sseDefaultHeartbeat = 15 * time.Second
+)
+
+// Errors
+const (
+	lastEventIdInvalid   = "invalid Last-Event-ID: %s"
+	streamingUnsupported = "streaming is not supported"
+)
+
+// sseHandler sends messages of pipeline stream to clients as Server-Sent Events.
+// Messages are the same as websocket messages, event id is sequence number,
+// so client that reconnects with Last-Event-ID receives events it missed, or snapshot of projects.
+type sseHandler struct {
+	stream    *PipelineStream
+	cache     caching.ProjectsCache
+	heartbeat time.Duration
+	logger    logging.Logger
+}
+
+// Creates handler of Server-Sent Events.
+// Supported query params are comma separated lists: project_ids, namespaces, branches, statuses.
+// stream - numbered changes of cached projects
+// cache - projects cache for snapshots
+// heartbeat - interval of comments that keep connection alive, default interval is used if it isn't positive
+func NewServerEvents(
+	stream *PipelineStream,
+	cache caching.ProjectsCache,
+	heartbeat time.Duration,
+	logger logging.Logger) HandlerFunc {
+
+	if heartbeat <= 0 {
+		heartbeat = sseDefaultHeartbeat
+	}
+	handler := &sseHandler{stream, cache, heartbeat, logger}
+	return func(c Context) {
+		handler.handle(c)
+	}
+}
+
+// Handles 'GET /events' request, streams events until client disconnects, falls behind or stream is closed.
+func (handler *sseHandler) handle(c Context) {
+	filter, err := parseFilter(c)
+	if err != nil {
+		c.ToJson(http.StatusBadRequest, contracts.NewErrorResponse(err))
+		return
+	}
+	var seq uint64
+	if header := c.GetHeader(lastEventIdHeader); header != "" {
+		if seq, err = strconv.ParseUint(header, 10, 64); err != nil {
+			c.ToJson(http.StatusBadRequest, contracts.NewErrorResponse(fmt.Errorf(lastEventIdInvalid, header)))
+			return
+		}
+	}
+	writer := c.GetWriter()
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		c.ToJson(http.StatusInternalServerError, contracts.NewErrorResponse(errors.New(streamingUnsupported)))
+		return
+	}
+	var snapshot *contracts.SocketMessage
+	if !handler.stream.canResume(seq) {
+		seq = handler.stream.buffer.lastSeq()
+		projects, err := handler.cache.GetProjects()
+		if err != nil {
+			c.ToJson(http.StatusBadGateway, contracts.NewErrorResponse(err))
+			return
+		}
+		message := newSnapshot(projects, filter, seq)
+		snapshot = &message
+	}
+
+	events := make(chan replayEvent, sseBufferSize)
+	lagging := make(chan struct{})
+	once := new(sync.Once)
+	id, last := handler.stream.listen(func(event replayEvent) {
+		if !matchesFilter(filter, event.change) {
+			return
+		}
+		select {
+		case events <- event:
+		default:
+			once.Do(func() {
+				close(lagging)
+			})
+		}
+	})
+	defer handler.stream.unlisten(id)
+
+	header := writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+	if snapshot != nil {
+		message, err := json.Marshal(snapshot)
+		if err != nil {
+			handler.logger.Errorf("server events snapshot error: %v", err)
+			return
+		}
+		if !handler.write(writer, snapshot.Seq, message) {
+			return
+		}
+	}
+	replay, _ := handler.stream.since(seq)
+	for _, event := range replay {
+		if event.seq > last {
+			break
+		}
+		if matchesFilter(filter, event.change) && !handler.write(writer, event.seq, event.message) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(handler.heartbeat)
+	defer ticker.Stop()
+	done := c.GetRequest().Context().Done()
+	for {
+		select {
+		case event := <-events:
+			if !handler.write(writer, event.seq, event.message) {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-lagging:
+			handler.logger.Warnf("server events client is too slow, disconnecting")
+			return
+		case <-done:
+			return
+		case <-handler.stream.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Writes event with given id, returns false if client is disconnected.
+func (handler *sseHandler) write(writer http.ResponseWriter, id uint64, message []byte) bool {
+	_, err := fmt.Fprintf(writer, "id: %d\ndata: %s\n\n", id, message)
+	return err == nil
+}
+
+// Parses events filter from query params.
+func parseFilter(c Context) (filter contracts.SocketFilter, err error) {
+	for _, param := range splitParam(c.QueryParam("project_ids")) {
+		id, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf(projectIdInvalid, param)
+		}
+		filter.ProjectIds = append(filter.ProjectIds, id)
+	}
+	filter.Namespaces = splitParam(c.QueryParam("namespaces"))
+	filter.Branches = splitParam(c.QueryParam("branches"))
+	filter.Statuses = splitParam(c.QueryParam("statuses"))
+	return
+}
+
+func splitParam(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/ricdeau/gitlab-extension/app/pkg/caching"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serverEvent is event read from text/event-stream response.
+type serverEvent struct {
+	id      string
+	comment string
+	message contracts.SocketMessage
+}
+
+func TestSseHandler_handle_Snapshot(t *testing.T) {
+	cache := &tests.MockProjectsCache{Projects: []contracts.Project{{Id: 1, Namespace: "group"}, {Id: 2, Namespace: "other"}}}
+	cache.On("GetProjects")
+	stream, server := newTestSseServer(cache, time.Minute)
+	defer server.Close()
+	stream.Send(testChange(1, "master"))
+
+	response := getServerEvents(t, server, "?namespaces=group&branches=release/*", "")
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+	reader := bufio.NewReader(response.Body)
+	snapshot := readServerEvent(t, reader)
+	assert.Equal(t, "1", snapshot.id)
+	assert.Equal(t, contracts.SocketSnapshot, snapshot.message.Type)
+	assert.Equal(t, []contracts.Project{{Id: 1, Namespace: "group"}}, snapshot.message.Projects)
+
+	stream.Send(testChange(2, "master"))
+	stream.Send(testChange(3, "release/1.0"))
+	event := readServerEvent(t, reader)
+	assert.Equal(t, "3", event.id)
+	assert.Equal(t, contracts.PipelineUpdated, event.message.Type)
+	assert.Equal(t, int64(3), event.message.Pipeline.Id)
+}
+
+func TestSseHandler_handle_Resume(t *testing.T) {
+	cache := new(tests.MockProjectsCache)
+	stream, server := newTestSseServer(cache, time.Minute)
+	defer server.Close()
+	for i := int64(1); i <= 3; i++ {
+		stream.Send(testChange(i, "master"))
+	}
+
+	response := getServerEvents(t, server, "", "1")
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+	assert.Equal(t, "2", readServerEvent(t, reader).id)
+	assert.Equal(t, "3", readServerEvent(t, reader).id)
+	cache.AssertNotCalled(t, "GetProjects")
+}
+
+func TestSseHandler_handle_Heartbeat(t *testing.T) {
+	cache := new(tests.MockProjectsCache)
+	cache.On("GetProjects")
+	_, server := newTestSseServer(cache, 10*time.Millisecond)
+	defer server.Close()
+
+	response := getServerEvents(t, server, "", "")
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+	assert.Equal(t, contracts.SocketSnapshot, readServerEvent(t, reader).message.Type)
+	assert.Equal(t, "heartbeat", readServerEvent(t, reader).comment)
+}
+
+func TestSseHandler_handle_DefaultHeartbeat(t *testing.T) {
+	cache := new(tests.MockProjectsCache)
+	cache.On("GetProjects")
+	_, server := newTestSseServer(cache, 0)
+	defer server.Close()
+
+	response := getServerEvents(t, server, "", "")
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, contracts.SocketSnapshot, readServerEvent(t, bufio.NewReader(response.Body)).message.Type)
+}
+
+func TestSseHandler_handle_Close(t *testing.T) {
+	cache := new(tests.MockProjectsCache)
+	cache.On("GetProjects")
+	stream, server := newTestSseServer(cache, time.Minute)
+	defer server.Close()
+
+	response := getServerEvents(t, server, "", "")
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+	readServerEvent(t, reader)
+	stream.Close()
+	_, err := reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	assert.Empty(t, stream.listeners)
+}
+
+func TestSseHandler_handle_BadRequest(t *testing.T) {
+	_, server := newTestSseServer(new(tests.MockProjectsCache), time.Minute)
+	defer server.Close()
+	testCases := []struct {
+		name        string
+		query       string
+		lastEventId string
+		expected    string
+	}{
+		{"project id", "?project_ids=1,a", "", "invalid project id: a"},
+		{"last event id", "", "a", "invalid Last-Event-ID: a"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := getServerEvents(t, server, tc.query, tc.lastEventId)
+			defer response.Body.Close()
+			var actual contracts.ErrorResponse
+			assert.NoError(t, json.NewDecoder(response.Body).Decode(&actual))
+			assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+			assert.Equal(t, tc.expected, actual.Error)
+		})
+	}
+}
+
+func newTestSseServer(cache caching.ProjectsCache, heartbeat time.Duration) (*PipelineStream, *httptest.Server) {
+	stream := NewPipelineStream(10, new(tests.MockLogger))
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/events", NewServerEvents(stream, cache, heartbeat, new(tests.MockLogger)).Handler())
+	return stream, httptest.NewServer(router)
+}
+
+func getServerEvents(t *testing.T, server *httptest.Server, query string, lastEventId string) *http.Response {
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/events"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventId != "" {
+		request.Header.Set(lastEventIdHeader, lastEventId)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// Reads lines until empty line that ends event.
+func readServerEvent(t *testing.T, reader *bufio.Reader) (event serverEvent) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return
+		case strings.HasPrefix(line, ": "):
+			event.comment = strings.TrimPrefix(line, ": ")
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.message))
+		}
+	}
+}
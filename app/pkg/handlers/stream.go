@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"sync"
+)
+
+// PipelineStream numbers changes of cached projects and delivers them to websocket and SSE clients.
+// Changes are numbered and delivered under lock, so every listener receives them in order.
+type PipelineStream struct {
+	buffer    *replayBuffer
+	lock      *sync.Mutex
+	listeners map[uint64]func(replayEvent)
+	nextId    uint64
+	logger    logging.Logger
+	done      chan struct{}
+	once      *sync.Once
+}
+
+// Creates stream of cached projects changes.
+// replaySize - number of the last events that can be replayed to reconnected clients
+func NewPipelineStream(replaySize int, logger logging.Logger) *PipelineStream {
+	return &PipelineStream{
+		buffer:    newReplayBuffer(replaySize),
+		lock:      new(sync.Mutex),
+		listeners: make(map[uint64]func(replayEvent)),
+		logger:    logger,
+		done:      make(chan struct{}),
+		once:      new(sync.Once),
+	}
+}
+
+// Numbers change of cached project and passes it to every listener, empty change isn't sent.
+func (s *PipelineStream) Send(change contracts.CacheChange) {
+	if change.Type == "" {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	event, err := s.buffer.append(change)
+	if err != nil {
+		s.logger.Errorf("error while marshaling %s change of project %d to json: %v", change.Type, change.ProjectId, err)
+		return
+	}
+	for _, listener := range s.listeners {
+		listener(event)
+	}
+}
+
+// Adds listener of new events, returns listener id and sequence number of the last event sent before it's added.
+func (s *PipelineStream) listen(listener func(replayEvent)) (id uint64, lastSeq uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextId++
+	s.listeners[s.nextId] = listener
+	return s.nextId, s.buffer.lastSeq()
+}
+
+// Removes listener by its id.
+func (s *PipelineStream) unlisten(id uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.listeners, id)
+}
+
+// Ends streaming responses, so server can be shut down gracefully.
+func (s *PipelineStream) Close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// Checks whether client that received events up to given sequence number can receive the rest of them from buffer.
+// Client without sequence number is new and receives snapshot.
+func (s *PipelineStream) canResume(seq uint64) bool {
+	_, _, ok := s.buffer.since(seq)
+	return seq != 0 && ok
+}
+
+// Returns buffered events after given sequence number.
+func (s *PipelineStream) since(seq uint64) ([]replayEvent, uint64) {
+	events, last, _ := s.buffer.since(seq)
+	return events, last
+}
+
+// Creates snapshot message with projects matching filter.
+// seq - sequence number of the last event sent before projects are loaded
+func newSnapshot(projects []contracts.Project, filter contracts.SocketFilter, seq uint64) contracts.SocketMessage {
+	snapshot := contracts.SocketMessage{Type: contracts.SocketSnapshot, Seq: seq, Projects: []contracts.Project{}}
+	for _, project := range projects {
+		if matchesProject(filter, project) {
+			snapshot.Projects = append(snapshot.Projects, project)
+		}
+	}
+	return snapshot
+}
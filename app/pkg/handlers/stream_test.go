@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPipelineStream_Send_NoChange(t *testing.T) {
+	stream := NewPipelineStream(10, new(tests.MockLogger))
+	stream.Send(contracts.CacheChange{ProjectId: 1})
+	assert.Zero(t, stream.buffer.lastSeq())
+}
+
+func TestPipelineStream_listen(t *testing.T) {
+	stream := NewPipelineStream(10, new(tests.MockLogger))
+	stream.Send(testChange(1, "master"))
+	var first, second []uint64
+	firstId, last := stream.listen(func(event replayEvent) {
+		first = append(first, event.seq)
+	})
+	assert.Equal(t, uint64(1), last)
+	stream.listen(func(event replayEvent) {
+		second = append(second, event.seq)
+	})
+	stream.Send(testChange(2, "master"))
+	stream.unlisten(firstId)
+	stream.Send(testChange(3, "master"))
+
+	assert.Equal(t, []uint64{2}, first)
+	assert.Equal(t, []uint64{2, 3}, second)
+}
+
+func TestPipelineStream_canResume(t *testing.T) {
+	stream := NewPipelineStream(2, new(tests.MockLogger))
+	for i := int64(1); i <= 4; i++ {
+		stream.Send(testChange(i, "master"))
+	}
+	assert.False(t, stream.canResume(0))
+	assert.False(t, stream.canResume(1))
+	assert.True(t, stream.canResume(2))
+	assert.True(t, stream.canResume(4))
+	assert.False(t, stream.canResume(5))
+}
+
+func TestNewSnapshot(t *testing.T) {
+	projects := []contracts.Project{{Id: 1, Namespace: "group"}, {Id: 2, Namespace: "other"}}
+	actual := newSnapshot(projects, contracts.SocketFilter{Namespaces: []string{"other"}}, 5)
+	assert.Equal(t, contracts.SocketSnapshot, actual.Type)
+	assert.Equal(t, uint64(5), actual.Seq)
+	assert.Equal(t, []contracts.Project{{Id: 2, Namespace: "other"}}, actual.Projects)
+
+	actual = newSnapshot(projects, contracts.SocketFilter{ProjectIds: []int64{3}}, 5)
+	assert.NotNil(t, actual.Projects)
+	assert.Empty(t, actual.Projects)
+}
@@ -1,33 +1,46 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"github.com/gin-gonic/gin"
 	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
 	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
 	"net/http"
 )
 
+const gitlabToken = "X-Gitlab-Token"
+
 // WebhookHandler handles http message from gitlab webhook pushes.
 type webhookHandler struct {
-	broker    broker.MessageBroker
-	publishTo []string
+	broker broker.MessageBroker
+	secret string
+	source string
 }
 
 // Creates new WebhookHandler instance.
-func NewWebhook(broker broker.MessageBroker, publishTo ...string) HandlerFunc {
-	handler := &webhookHandler{broker, publishTo}
+// conf - Global config, WebhookSecret is expected in X-Gitlab-Token header unless it's empty,
+// InstanceName is used as source of published envelopes
+func NewWebhook(broker broker.MessageBroker, conf *config.Config) HandlerFunc {
+	handler := &webhookHandler{broker, conf.WebhookSecret, conf.InstanceName}
 	return func(c Context) {
 		handler.handle(c)
 	}
 }
 
-// Publishes http message to global broker topic.
+// Publishes http message to pipeline topic of its namespace.
 func (handler *webhookHandler) handle(c Context) {
 	logger := c.GetLogger()
 	if logger == nil {
 		c.SetStatusCode(http.StatusInternalServerError)
 		return
 	}
+	if handler.secret != "" &&
+		subtle.ConstantTimeCompare([]byte(c.GetHeader(gitlabToken)), []byte(handler.secret)) != 1 {
+		logger.Warnf("Request has invalid %s header", gitlabToken)
+		c.SetStatusCode(http.StatusUnauthorized)
+		return
+	}
 	var message contracts.PipelinePush
 	if err := c.FromJson(&message); err != nil {
 		logger.Errorf("Request body doesn't match type: %T", message)
@@ -35,11 +48,27 @@ func (handler *webhookHandler) handle(c Context) {
 		return
 	}
 
-	for _, topicName := range handler.publishTo {
-		logger.Infof("Publishing message %+v to topic %s", message, topicName)
-		if err := handler.broker.Publish(topicName, message); err != nil {
-			logger.Errorf("Message publishing error: %v", err)
-		}
+	envelope := broker.NewPipelineEnvelope(handler.source, c.GetCorrelationId(), message)
+	topicName := broker.PipelineTopic(handler.source, namespace(message))
+	logger.Infof("Publishing message %s %+v to topic %s", envelope.Id, message, topicName)
+	if err := publish(handler.broker, topicName, envelope); err != nil {
+		logger.Errorf("Message publishing error: %v", err)
 	}
 	c.SetStatusCode(http.StatusOK)
 }
+
+// Publishes envelope to topic, that is added first if it doesn't exist.
+func publish(msgBroker broker.MessageBroker, topicName string, envelope broker.Envelope) error {
+	if err := msgBroker.AddTopic(topicName); err != nil {
+		return err
+	}
+	return msgBroker.Publish(topicName, envelope)
+}
+
+// Returns namespace of pipeline project, or empty string if message has no project.
+func namespace(message contracts.PipelinePush) string {
+	if message.Project == nil {
+		return ""
+	}
+	return message.Project.Namespace
+}
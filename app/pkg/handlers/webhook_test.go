@@ -2,10 +2,13 @@ package handlers
 
 import (
 	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
 	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
 	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
 	"github.com/ricdeau/gitlab-extension/app/tests"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"net/http"
 	"reflect"
 	"testing"
@@ -13,46 +16,55 @@ import (
 
 func TestNewWebhookHandler(t *testing.T) {
 	mockBroker := new(tests.MockMessageBroker)
-	actual := NewWebhook(mockBroker)
+	actual := NewWebhook(mockBroker, new(config.Config))
 	assert.NotNil(t, actual)
 	assert.IsType(t, HandlerFunc(nil), actual)
 }
 
 func TestWebhookHandler_Handle_Success(t *testing.T) {
 	const (
-		topic = "some topic"
+		topic = "gitlab.instance.pipeline.Gitlab Org"
 		kind  = "some kind"
 	)
+	message := contracts.PipelinePush{Kind: kind, Project: &contracts.PipelineProject{Namespace: "Gitlab Org"}}
 	mockCtx := tests.DefaultMockContext()
 	mockCtx.On("GetLogger").Once()
 	mockCtx.On("FromJson").Once()
+	mockCtx.On("GetCorrelationId").Once()
 	mockCtx.On("SetStatusCode").Once()
 	mockBroker := new(tests.MockMessageBroker)
-	mockBroker.On("Publish", topic, contracts.PipelinePush{Kind: kind}).Once()
+	mockBroker.On("AddTopic", topic).Once()
+	mockBroker.On("Publish", topic, pipelineEnvelope(message)).Once()
 	mockLogger := new(tests.MockLogger)
 	mockLogger.On("Infof").Once()
 	mockCtx.BindJSON = func(m interface{}) error {
 		v := reflect.ValueOf(m).Elem()
-		v.Set(reflect.ValueOf(contracts.PipelinePush{Kind: kind}))
+		v.Set(reflect.ValueOf(message))
 		return nil
 	}
 	mockCtx.Logger = func() logging.Logger {
 		return mockLogger
 	}
 
-	handlerFunc := NewWebhook(mockBroker, topic)
+	handlerFunc := NewWebhook(mockBroker, &config.Config{InstanceName: "instance"})
 	handlerFunc(mockCtx)
 
 	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockBroker.AssertExpectations(t)
 }
 
-func TestWebhookHandler_Handle_NoTopics(t *testing.T) {
+func TestWebhookHandler_Handle_NoProject(t *testing.T) {
+	const topic = "gitlab.instance.pipeline._"
 	mockCtx := tests.DefaultMockContext()
 	mockCtx.On("GetLogger").Once()
 	mockCtx.On("FromJson").Once()
+	mockCtx.On("GetCorrelationId").Once()
 	mockCtx.On("SetStatusCode").Once()
 	mockBroker := new(tests.MockMessageBroker)
+	mockBroker.On("AddTopic", topic).Once()
+	mockBroker.On("Publish", topic, pipelineEnvelope(contracts.PipelinePush{})).Once()
 	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof").Once()
 	mockCtx.BindJSON = func(m interface{}) error {
 		return nil
 	}
@@ -60,10 +72,11 @@ func TestWebhookHandler_Handle_NoTopics(t *testing.T) {
 		return mockLogger
 	}
 
-	handlerFunc := NewWebhook(mockBroker)
+	handlerFunc := NewWebhook(mockBroker, &config.Config{InstanceName: "instance"})
 	handlerFunc(mockCtx)
 
 	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockBroker.AssertExpectations(t)
 }
 
 func TestWebhookHandler_Handle_BadRequests(t *testing.T) {
@@ -81,28 +94,25 @@ func TestWebhookHandler_Handle_BadRequests(t *testing.T) {
 		return mockLogger
 	}
 
-	handlerFunc := NewWebhook(mockBroker)
+	handlerFunc := NewWebhook(mockBroker, new(config.Config))
 	handlerFunc(mockCtx)
 
 	assert.Equal(t, http.StatusBadRequest, mockCtx.Status)
 }
 
 func TestWebhookHandler_Handle_PublishError(t *testing.T) {
-	const (
-		topic1 = "some topic 1"
-		topic2 = "some topic 2"
-	)
 	mockCtx := tests.DefaultMockContext()
 	mockCtx.On("GetLogger").Once()
 	mockCtx.On("FromJson").Once()
+	mockCtx.On("GetCorrelationId").Once()
 	mockCtx.On("SetStatusCode").Once()
 	mockBroker := new(tests.MockMessageBroker)
 	mockBroker.PublishError = true
-	mockBroker.On("Publish", topic1, contracts.PipelinePush{}).Once()
-	mockBroker.On("Publish", topic2, contracts.PipelinePush{}).Once()
+	mockBroker.On("AddTopic", mock.Anything).Once()
+	mockBroker.On("Publish", mock.Anything, pipelineEnvelope(contracts.PipelinePush{})).Once()
 	mockLogger := new(tests.MockLogger)
-	mockLogger.On("Infof").Twice()
-	mockLogger.On("Errorf").Twice()
+	mockLogger.On("Infof").Once()
+	mockLogger.On("Errorf").Once()
 	mockCtx.BindJSON = func(interface{}) error {
 		return nil
 	}
@@ -110,24 +120,103 @@ func TestWebhookHandler_Handle_PublishError(t *testing.T) {
 		return mockLogger
 	}
 
-	handlerFunc := NewWebhook(mockBroker, topic1, topic2)
+	handlerFunc := NewWebhook(mockBroker, new(config.Config))
 	handlerFunc(mockCtx)
 
 	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockLogger.AssertExpectations(t)
 }
 
 func TestWebhookHandler_Handle_NoLogger(t *testing.T) {
-	const (
-		topic1 = "some topic 1"
-		topic2 = "some topic 2"
-	)
 	mockCtx := tests.DefaultMockContext()
 	mockCtx.On("GetLogger").Once()
 	mockCtx.On("SetStatusCode").Once()
 	mockBroker := new(tests.MockMessageBroker)
 
-	handlerFunc := NewWebhook(mockBroker, topic1, topic2)
+	handlerFunc := NewWebhook(mockBroker, new(config.Config))
 	handlerFunc(mockCtx)
 
 	assert.Equal(t, http.StatusInternalServerError, mockCtx.Status)
 }
+
+func TestWebhookHandler_Handle_InvalidSecret(t *testing.T) {
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.Headers = map[string]string{gitlabToken: "wrong"}
+	mockCtx.On("GetLogger").Once()
+	mockCtx.On("GetHeader", gitlabToken).Once()
+	mockCtx.On("SetStatusCode").Once()
+	mockBroker := new(tests.MockMessageBroker)
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Warnf").Once()
+	mockCtx.Logger = func() logging.Logger {
+		return mockLogger
+	}
+
+	handlerFunc := NewWebhook(mockBroker, &config.Config{WebhookSecret: "secret"})
+	handlerFunc(mockCtx)
+
+	assert.Equal(t, http.StatusUnauthorized, mockCtx.Status)
+	mockBroker.AssertNotCalled(t, "Publish")
+}
+
+func TestWebhookHandler_Handle_ValidSecret(t *testing.T) {
+	const topic = "gitlab._.pipeline._"
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.Headers = map[string]string{gitlabToken: "secret"}
+	mockCtx.On("GetLogger").Once()
+	mockCtx.On("GetHeader", gitlabToken).Once()
+	mockCtx.On("FromJson").Once()
+	mockCtx.On("GetCorrelationId").Once()
+	mockCtx.On("SetStatusCode").Once()
+	mockBroker := new(tests.MockMessageBroker)
+	mockBroker.On("AddTopic", topic).Once()
+	mockBroker.On("Publish", topic, pipelineEnvelope(contracts.PipelinePush{})).Once()
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof").Once()
+	mockCtx.Logger = func() logging.Logger {
+		return mockLogger
+	}
+
+	handlerFunc := NewWebhook(mockBroker, &config.Config{WebhookSecret: "secret"})
+	handlerFunc(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockBroker.AssertExpectations(t)
+}
+
+func TestWebhookHandler_Handle_Envelope(t *testing.T) {
+	const topic = "gitlab.instance.pipeline._"
+	mockCtx := tests.DefaultMockContext()
+	mockCtx.Correlation = "correlation"
+	mockCtx.On("GetLogger").Once()
+	mockCtx.On("FromJson").Once()
+	mockCtx.On("GetCorrelationId").Once()
+	mockCtx.On("SetStatusCode").Once()
+	mockBroker := new(tests.MockMessageBroker)
+	mockBroker.On("AddTopic", topic).Once()
+	mockBroker.On("Publish", topic, mock.MatchedBy(func(envelope broker.Envelope) bool {
+		return envelope.Id != "" &&
+			envelope.Source == "instance" &&
+			envelope.CorrelationId == "correlation" &&
+			envelope.Kind == broker.KindPipeline
+	})).Once()
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof").Once()
+	mockCtx.Logger = func() logging.Logger {
+		return mockLogger
+	}
+
+	handlerFunc := NewWebhook(mockBroker, &config.Config{InstanceName: "instance"})
+	handlerFunc(mockCtx)
+
+	assert.Equal(t, http.StatusOK, mockCtx.Status)
+	mockBroker.AssertExpectations(t)
+}
+
+// Matches envelope with given pipeline webhook message.
+func pipelineEnvelope(expected contracts.PipelinePush) interface{} {
+	return mock.MatchedBy(func(envelope broker.Envelope) bool {
+		actual, err := envelope.PipelinePush()
+		return err == nil && reflect.DeepEqual(expected, actual)
+	})
+}
@@ -0,0 +1,282 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"github.com/ricdeau/gitlab-extension/app/pkg/utils"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	privateToken = "Private-Token"
+	contentType  = "Content-Type"
+	jsonType     = "application/json"
+	nextPage     = "X-Next-Page"
+	webhookPath  = "/webhook"
+	driftMissing = "missing"
+)
+
+// urls
+const (
+	projectsUrl = "%s/projects?per_page=100&page=%s"
+	hooksUrl    = "%s/projects/%d/hooks"
+	hookUrl     = "%s/projects/%d/hooks/%d"
+)
+
+// Errors
+const (
+	intervalInvalid = "hooks sync interval must be positive, got %v"
+	publicUrlEmpty  = "public url is not configured, hooks can't point to the service"
+)
+
+// Events the hook must be subscribed (true) or unsubscribed (false) to.
+var hookEvents = map[string]bool{
+	"pipeline_events": true,
+	"push_events":     false,
+}
+
+type Manager interface {
+	io.Closer
+	Start(interval time.Duration) error
+	Sync() error
+	Status() contracts.HooksResponse
+}
+
+// manager ensures that every project in configured gitlab namespaces
+// has a project hook pointing to '/webhook' of this service.
+// Hook token can't be read back from gitlab API, so only url and events are checked for drift,
+// token is written on every create and update.
+type manager struct {
+	config  *config.Config
+	client  *http.Client
+	logger  logging.Logger
+	hookUrl string
+	// syncLock serializes syncs, lock guards status only
+	syncLock *sync.Mutex
+	lock     *sync.Mutex
+	status   contracts.HooksResponse
+	done     chan struct{}
+	once     *sync.Once
+}
+
+type project struct {
+	Id        int64  `json:"id"`
+	Name      string `json:"name"`
+	Namespace struct {
+		Name string `json:"name"`
+	} `json:"namespace"`
+}
+
+// Creates new hook manager.
+// conf - Global config, PublicUrl and WebhookSecret are used to build hook
+// logger - Logging module
+func New(conf *config.Config, logger logging.Logger) Manager {
+	result := &manager{
+		config:   conf,
+		logger:   logger,
+		hookUrl:  strings.TrimSuffix(conf.PublicUrl, "/") + webhookPath,
+		syncLock: new(sync.Mutex),
+		lock:     new(sync.Mutex),
+		done:     make(chan struct{}),
+		once:     new(sync.Once),
+		client: &http.Client{
+			Timeout: time.Second * 30,
+		},
+	}
+	result.status.HookUrl = result.hookUrl
+	return result
+}
+
+// Syncs hooks immediately and then periodically with given interval until manager is closed.
+func (m *manager) Start(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf(intervalInvalid, interval)
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := m.Sync(); err != nil {
+				m.logger.Errorf("Hooks sync error: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-m.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stops periodic syncing, sync in progress isn't interrupted.
+func (m *manager) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+	})
+	return nil
+}
+
+// Checks hooks of all monitored projects, creates missing and fixes drifted ones.
+// Concurrent syncs are performed one after another.
+// Fails without public url of the service, so hooks without host aren't created.
+func (m *manager) Sync() error {
+	if m.config.PublicUrl == "" {
+		return errors.New(publicUrlEmpty)
+	}
+	m.syncLock.Lock()
+	defer m.syncLock.Unlock()
+	projects, err := m.getProjects()
+	if err != nil {
+		return err
+	}
+	statuses := make([]contracts.HookStatus, 0, len(projects))
+	for _, p := range projects {
+		status := m.syncProject(p)
+		if status.State != contracts.HookStateOk {
+			m.logger.Warnf("Hook of project id=%d is %s, drift: %v, error: %s",
+				status.ProjectId, status.State, status.Drift, status.Error)
+		}
+		statuses = append(statuses, status)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.status.LastSync = time.Now().UTC()
+	m.status.Hooks = statuses
+	return nil
+}
+
+// Returns result of the last sync.
+func (m *manager) Status() contracts.HooksResponse {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	result := m.status
+	result.Hooks = append([]contracts.HookStatus(nil), m.status.Hooks...)
+	return result
+}
+
+func (m *manager) syncProject(p project) (status contracts.HookStatus) {
+	status = contracts.HookStatus{
+		ProjectId: p.Id,
+		Project:   p.Name,
+		Namespace: p.Namespace.Name,
+		CheckedAt: time.Now().UTC(),
+	}
+	var hooks []map[string]interface{}
+	err := m.request(http.MethodGet, fmt.Sprintf(hooksUrl, m.config.GitlabUri, p.Id), nil, &hooks)
+	if err != nil {
+		status.State, status.Error = contracts.HookStateError, err.Error()
+		return
+	}
+
+	var hook map[string]interface{}
+	for _, h := range hooks {
+		if h["url"] == m.hookUrl {
+			hook = h
+			break
+		}
+	}
+	if hook == nil {
+		status.Drift = []string{driftMissing}
+		err = m.request(http.MethodPost, fmt.Sprintf(hooksUrl, m.config.GitlabUri, p.Id), m.hookBody(), &hook)
+		if err != nil {
+			status.State, status.Error = contracts.HookStateError, err.Error()
+			return
+		}
+		status.State = contracts.HookStateCreated
+		status.HookId = hookId(hook)
+		return
+	}
+
+	status.HookId = hookId(hook)
+	for event, enabled := range hookEvents {
+		if actual, _ := hook[event].(bool); actual != enabled {
+			status.Drift = append(status.Drift, event)
+		}
+	}
+	if len(status.Drift) == 0 {
+		status.State = contracts.HookStateOk
+		return
+	}
+	err = m.request(http.MethodPut, fmt.Sprintf(hookUrl, m.config.GitlabUri, p.Id, status.HookId), m.hookBody(), nil)
+	if err != nil {
+		status.State, status.Error = contracts.HookStateError, err.Error()
+		return
+	}
+	status.State = contracts.HookStateUpdated
+	return
+}
+
+// Gets all projects from configured namespaces, following gitlab pagination.
+func (m *manager) getProjects() (result []project, err error) {
+	namespaces := make(map[string]struct{})
+	for _, ns := range m.config.GitlabNamespaces {
+		namespaces[ns] = struct{}{}
+	}
+	for page := "1"; page != ""; {
+		headers := map[string]string{privateToken: m.config.GitlabToken}
+		url := fmt.Sprintf(projectsUrl, m.config.GitlabUri, page)
+		response, err := utils.PerformGetRequest(m.client, url, headers, m.logger)
+		if err != nil {
+			return nil, err
+		}
+		var projects []project
+		err = json.NewDecoder(response.Body).Decode(&projects)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range projects {
+			if _, ok := namespaces[p.Namespace.Name]; ok {
+				result = append(result, p)
+			}
+		}
+		page = response.Header.Get(nextPage)
+	}
+	return
+}
+
+func (m *manager) hookBody() map[string]interface{} {
+	body := map[string]interface{}{
+		"url":                     m.hookUrl,
+		"token":                   m.config.WebhookSecret,
+		"enable_ssl_verification": true,
+	}
+	for event, enabled := range hookEvents {
+		body[event] = enabled
+	}
+	return body
+}
+
+// Performs gitlab API request with json body and decodes json response into result if it's not nil.
+func (m *manager) request(method, url string, body interface{}, result interface{}) error {
+	headers := map[string]string{privateToken: m.config.GitlabToken, contentType: jsonType}
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	response, err := utils.PerformRequest(m.client, method, url, headers, &reqBody, m.logger)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil || result == nil {
+		return err
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func hookId(hook map[string]interface{}) int64 {
+	id, _ := hook["id"].(float64)
+	return int64(id)
+}
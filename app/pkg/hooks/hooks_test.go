@@ -0,0 +1,193 @@
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	publicUrl = "https://dashboard.example.com/"
+	secret    = "secret"
+)
+
+// fakeGitlab emulates projects and hooks endpoints of gitlab API.
+type fakeGitlab struct {
+	sync.Mutex
+	hooks   map[int64][]map[string]interface{}
+	created []map[string]interface{}
+	updated []map[string]interface{}
+}
+
+func TestManager_Sync(t *testing.T) {
+	hookUrl := publicUrl + "webhook"
+	gitlab := &fakeGitlab{hooks: map[int64][]map[string]interface{}{
+		1: {{"id": 10.0, "url": hookUrl, "pipeline_events": true, "push_events": false}},
+		2: {{"id": 20.0, "url": hookUrl, "pipeline_events": false, "push_events": false}},
+		3: {{"id": 30.0, "url": "http://other", "pipeline_events": true}},
+	}}
+	ts := httptest.NewServer(gitlab.handler())
+	defer ts.Close()
+
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof")
+	mockLogger.On("Warnf")
+	conf := &config.Config{
+		GitlabUri:        ts.URL,
+		GitlabNamespaces: []string{"monitored"},
+		PublicUrl:        publicUrl,
+		WebhookSecret:    secret,
+	}
+	m := New(conf, mockLogger)
+
+	err := m.Sync()
+	if !assert.NoError(t, err) {
+		return
+	}
+	status := m.Status()
+	assert.Equal(t, "https://dashboard.example.com/webhook", status.HookUrl)
+	assert.False(t, status.LastSync.IsZero())
+	if assert.Len(t, status.Hooks, 3) {
+		assert.Equal(t, contracts.HookStateOk, status.Hooks[0].State)
+		assert.Equal(t, int64(10), status.Hooks[0].HookId)
+		assert.Equal(t, contracts.HookStateUpdated, status.Hooks[1].State)
+		assert.Equal(t, []string{"pipeline_events"}, status.Hooks[1].Drift)
+		assert.Equal(t, contracts.HookStateCreated, status.Hooks[2].State)
+		assert.Equal(t, []string{driftMissing}, status.Hooks[2].Drift)
+	}
+	if assert.Len(t, gitlab.created, 1) {
+		assert.Equal(t, hookUrl, gitlab.created[0]["url"])
+		assert.Equal(t, secret, gitlab.created[0]["token"])
+		assert.Equal(t, true, gitlab.created[0]["pipeline_events"])
+	}
+	assert.Len(t, gitlab.updated, 1)
+}
+
+func TestManager_Sync_Error(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof")
+	mockLogger.On("Errorf")
+	m := New(&config.Config{GitlabUri: ts.URL, PublicUrl: publicUrl}, mockLogger)
+
+	err := m.Sync()
+	assert.Error(t, err)
+	assert.Empty(t, m.Status().Hooks)
+}
+
+func TestManager_Sync_NoPublicUrl(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer ts.Close()
+	m := New(&config.Config{GitlabUri: ts.URL}, new(tests.MockLogger))
+
+	assert.EqualError(t, m.Sync(), "public url is not configured, hooks can't point to the service")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+}
+
+func TestManager_Sync_Serialized(t *testing.T) {
+	var active, maxActive int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		if current > atomic.LoadInt32(&maxActive) {
+			atomic.StoreInt32(&maxActive, current)
+		}
+		time.Sleep(time.Millisecond * 10)
+		_, _ = fmt.Fprint(w, `[]`)
+	}))
+	defer ts.Close()
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof")
+	m := New(&config.Config{GitlabUri: ts.URL, PublicUrl: publicUrl}, mockLogger)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, m.Sync())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxActive))
+}
+
+func TestManager_Start(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = fmt.Fprint(w, `[]`)
+	}))
+	defer ts.Close()
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof")
+	m := New(&config.Config{GitlabUri: ts.URL, PublicUrl: publicUrl}, mockLogger)
+
+	assert.EqualError(t, m.Start(0), "hooks sync interval must be positive, got 0s")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+
+	assert.NoError(t, m.Start(time.Millisecond*10))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&requests) >= 2
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, m.Close())
+	assert.NoError(t, m.Close())
+	time.Sleep(time.Millisecond * 30)
+	stopped := atomic.LoadInt32(&requests)
+	time.Sleep(time.Millisecond * 30)
+	assert.Equal(t, stopped, atomic.LoadInt32(&requests))
+}
+
+func (g *fakeGitlab) handler() http.Handler {
+	r := http.NewServeMux()
+	r.HandleFunc("/projects", func(w http.ResponseWriter, r *http.Request) {
+		// second page contains project from namespace that is not monitored
+		if r.URL.Query().Get("page") == "1" {
+			w.Header().Set(nextPage, "2")
+			_, _ = fmt.Fprint(w, `[{"id":1,"name":"p1","namespace":{"name":"monitored"}},
+								   {"id":2,"name":"p2","namespace":{"name":"monitored"}}]`)
+			return
+		}
+		_, _ = fmt.Fprint(w, `[{"id":3,"name":"p3","namespace":{"name":"monitored"}},
+							   {"id":4,"name":"p4","namespace":{"name":"other"}}]`)
+	})
+	for id := int64(1); id <= 4; id++ {
+		projectId := id
+		r.HandleFunc(fmt.Sprintf(hooksUrl, "", projectId), func(w http.ResponseWriter, r *http.Request) {
+			g.Lock()
+			defer g.Unlock()
+			switch r.Method {
+			case http.MethodGet:
+				_ = json.NewEncoder(w).Encode(g.hooks[projectId])
+			case http.MethodPost:
+				var hook map[string]interface{}
+				_ = json.NewDecoder(r.Body).Decode(&hook)
+				g.created = append(g.created, hook)
+				hook["id"] = 100
+				_ = json.NewEncoder(w).Encode(hook)
+			}
+		})
+		r.HandleFunc(fmt.Sprintf(hooksUrl+"/", "", projectId), func(w http.ResponseWriter, r *http.Request) {
+			g.Lock()
+			defer g.Unlock()
+			var hook map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&hook)
+			g.updated = append(g.updated, hook)
+			_ = json.NewEncoder(w).Encode(hook)
+		})
+	}
+	return r
+}
@@ -0,0 +1,254 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prologic/bitcask"
+	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventPrefix     = "event_"
+	eventKeyFormat  = eventPrefix + "%020d"
+	redacted        = "[redacted]"
+	maxValueSize    = 1 << 20
+	defaultLimit    = 50
+	compactInterval = 10 * time.Minute
+)
+
+// Errors
+const (
+	eventKeyInvalid = "invalid journal key: %s"
+)
+
+var ErrEventNotFound = errors.New("event not found")
+
+// Query filters events returned by Journal.List.
+// Before - return only events with id lower than given, 0 means no upper bound
+// Limit - max number of events, newest first
+// ProjectId - return only events of given gitlab project, 0 means any project
+// Kind - return only events of given kind, empty means any kind
+type Query struct {
+	Before    uint64
+	Limit     int
+	ProjectId int64
+	Kind      string
+}
+
+type Journal interface {
+	io.Closer
+	Append(envelope broker.Envelope) (contracts.JournalEvent, error)
+	Get(id uint64) (contracts.JournalEvent, error)
+	List(query Query) ([]contracts.JournalEvent, error)
+	Compact() error
+}
+
+// journal is an append-only store of webhook events backed by bitcask.
+// Events are kept until they are older than retention or there are more than maxEvents of them.
+type journal struct {
+	db        *bitcask.Bitcask
+	lock      *sync.Mutex
+	lastId    uint64
+	retention time.Duration
+	maxEvents int
+	done      chan struct{}
+}
+
+// Opens journal at given path and starts periodic compaction.
+// path - bitcask database directory
+// retention - max age of stored events, 0 disables age limit
+// maxEvents - max number of stored events, 0 disables count limit
+func New(path string, retention time.Duration, maxEvents int) (Journal, error) {
+	db, err := bitcask.Open(path, bitcask.WithMaxValueSize(maxValueSize))
+	if err != nil {
+		return nil, err
+	}
+	result := &journal{
+		db:        db,
+		lock:      new(sync.Mutex),
+		retention: retention,
+		maxEvents: maxEvents,
+		done:      make(chan struct{}),
+	}
+	ids, err := result.ids()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if len(ids) > 0 {
+		result.lastId = ids[len(ids)-1]
+	}
+	go result.compactPeriodically()
+	return result, nil
+}
+
+// Stops compaction and closes underlying database.
+func (j *journal) Close() error {
+	close(j.done)
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.db.Close()
+}
+
+// Redacts and stores webhook message from envelope, returns stored event.
+func (j *journal) Append(envelope broker.Envelope) (event contracts.JournalEvent, err error) {
+	push, err := envelope.PipelinePush()
+	if err != nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	event = contracts.JournalEvent{
+		Id:            j.lastId + 1,
+		EnvelopeId:    envelope.Id,
+		Source:        envelope.Source,
+		CorrelationId: envelope.CorrelationId,
+		ReceivedAt:    envelope.ReceivedAt,
+		Kind:          envelope.Kind,
+		Payload:       redact(push),
+	}
+	value, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if err = j.db.Put(key(event.Id), value); err != nil {
+		return
+	}
+	j.lastId = event.Id
+	return
+}
+
+// Gets event by id, returns ErrEventNotFound if there is no such event.
+func (j *journal) Get(id uint64) (event contracts.JournalEvent, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.get(id)
+}
+
+// Lists events matching query, newest first.
+func (j *journal) List(query Query) (result []contracts.JournalEvent, err error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultLimit
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	ids, err := j.ids()
+	if err != nil {
+		return
+	}
+	for i := len(ids) - 1; i >= 0 && len(result) < query.Limit; i-- {
+		if query.Before != 0 && ids[i] >= query.Before {
+			continue
+		}
+		event, err := j.get(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		if query.Kind != "" && event.Kind != query.Kind {
+			continue
+		}
+		if query.ProjectId != 0 && (event.Payload.Project == nil || event.Payload.Project.Id != query.ProjectId) {
+			continue
+		}
+		result = append(result, event)
+	}
+	return
+}
+
+// Removes events that exceed retention settings and reclaims disk space.
+func (j *journal) Compact() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	ids, err := j.ids()
+	if err != nil {
+		return err
+	}
+	expired := 0
+	if j.maxEvents > 0 && len(ids) > j.maxEvents {
+		expired = len(ids) - j.maxEvents
+	}
+	if j.retention > 0 {
+		deadline := time.Now().Add(-j.retention)
+		for ; expired < len(ids); expired++ {
+			event, err := j.get(ids[expired])
+			if err != nil {
+				return err
+			}
+			if event.ReceivedAt.After(deadline) {
+				break
+			}
+		}
+	}
+	if expired == 0 {
+		return nil
+	}
+	for _, id := range ids[:expired] {
+		if err := j.db.Delete(key(id)); err != nil {
+			return err
+		}
+	}
+	return j.db.Merge()
+}
+
+func (j *journal) compactPeriodically() {
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = j.Compact()
+		case <-j.done:
+			return
+		}
+	}
+}
+
+func (j *journal) get(id uint64) (event contracts.JournalEvent, err error) {
+	value, err := j.db.Get(key(id))
+	if err == bitcask.ErrKeyNotFound {
+		return event, ErrEventNotFound
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(value, &event)
+	return
+}
+
+// Returns ids of all stored events in ascending order.
+func (j *journal) ids() (result []uint64, err error) {
+	err = j.db.Scan([]byte(eventPrefix), func(k []byte) error {
+		id, err := strconv.ParseUint(strings.TrimPrefix(string(k), eventPrefix), 10, 64)
+		if err != nil {
+			return fmt.Errorf(eventKeyInvalid, k)
+		}
+		result = append(result, id)
+		return nil
+	})
+	return
+}
+
+func key(id uint64) []byte {
+	return []byte(fmt.Sprintf(eventKeyFormat, id))
+}
+
+// Returns copy of webhook message without personal data.
+func redact(push contracts.PipelinePush) contracts.PipelinePush {
+	if push.Commit != nil && push.Commit.Author != nil {
+		commit := *push.Commit
+		author := *commit.Author
+		if author.Email != "" {
+			author.Email = redacted
+		}
+		commit.Author = &author
+		push.Commit = &commit
+	}
+	return push
+}
@@ -0,0 +1,182 @@
+package journal
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+const email = "user@gitlab.com"
+
+func TestJournal_AppendGet(t *testing.T) {
+	j, cleanup := createJournal(t, 0, 0)
+	defer cleanup()
+
+	event, err := j.Append(createEnvelope(1))
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(1), event.Id)
+		assert.Equal(t, broker.KindPipeline, event.Kind)
+		assert.Equal(t, "instance", event.Source)
+		assert.Equal(t, "correlation", event.CorrelationId)
+		assert.NotEmpty(t, event.EnvelopeId)
+		assert.Equal(t, redacted, event.Payload.Commit.Author.Email)
+	}
+
+	actual, err := j.Get(event.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, event.Id, actual.Id)
+		assert.Equal(t, event.Payload, actual.Payload)
+	}
+
+	_, err = j.Get(100)
+	assert.Equal(t, ErrEventNotFound, err)
+}
+
+func TestJournal_Append_DoesNotModifyOriginal(t *testing.T) {
+	j, cleanup := createJournal(t, 0, 0)
+	defer cleanup()
+
+	push := createPush(1)
+	_, err := j.Append(broker.NewPipelineEnvelope("", "", push))
+	assert.NoError(t, err)
+	assert.Equal(t, email, push.Commit.Author.Email)
+}
+
+func TestJournal_List(t *testing.T) {
+	j, cleanup := createJournal(t, 0, 0)
+	defer cleanup()
+	for _, projectId := range []int64{1, 2, 1, 2, 1} {
+		_, err := j.Append(createEnvelope(projectId))
+		assert.NoError(t, err)
+	}
+
+	all, err := j.List(Query{})
+	if assert.NoError(t, err) {
+		assert.Len(t, all, 5)
+		assert.Equal(t, uint64(5), all[0].Id)
+		assert.Equal(t, uint64(1), all[4].Id)
+	}
+
+	filtered, err := j.List(Query{Before: 5, Limit: 2, ProjectId: 1})
+	if assert.NoError(t, err) {
+		assert.Len(t, filtered, 2)
+		assert.Equal(t, uint64(3), filtered[0].Id)
+		assert.Equal(t, uint64(1), filtered[1].Id)
+	}
+
+	none, err := j.List(Query{Kind: "push"})
+	assert.NoError(t, err)
+	assert.Empty(t, none)
+
+	_, err = j.Append(broker.NewEnvelope("", "", "push", "payload"))
+	assert.Error(t, err)
+}
+
+func TestJournal_Compact_MaxEvents(t *testing.T) {
+	j, cleanup := createJournal(t, 0, 2)
+	defer cleanup()
+	for i := 0; i < 4; i++ {
+		_, err := j.Append(createEnvelope(1))
+		assert.NoError(t, err)
+	}
+
+	err := j.Compact()
+	if assert.NoError(t, err) {
+		events, err := j.List(Query{})
+		assert.NoError(t, err)
+		assert.Len(t, events, 2)
+		assert.Equal(t, uint64(4), events[0].Id)
+		assert.Equal(t, uint64(3), events[1].Id)
+	}
+}
+
+func TestJournal_Compact_Retention(t *testing.T) {
+	j, cleanup := createJournal(t, 100*time.Millisecond, 0)
+	defer cleanup()
+	_, err := j.Append(createEnvelope(1))
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = j.Append(createEnvelope(1))
+	assert.NoError(t, err)
+
+	err = j.Compact()
+	if assert.NoError(t, err) {
+		events, err := j.List(Query{})
+		assert.NoError(t, err)
+		assert.Len(t, events, 1)
+		assert.Equal(t, uint64(2), events[0].Id)
+	}
+}
+
+func TestJournal_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := New(dir, 0, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = j.Append(createEnvelope(1))
+	assert.NoError(t, err)
+	assert.NoError(t, j.Close())
+
+	j, err = New(dir, 0, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer j.Close()
+	event, err := j.Append(createEnvelope(1))
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(2), event.Id)
+	}
+}
+
+func createJournal(t *testing.T, retention time.Duration, maxEvents int) (Journal, func()) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := New(dir, retention, maxEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, func() {
+		_ = j.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func createEnvelope(projectId int64) broker.Envelope {
+	return broker.NewPipelineEnvelope("instance", "correlation", createPush(projectId))
+}
+
+func createPush(projectId int64) contracts.PipelinePush {
+	return contracts.PipelinePush{
+		Kind: "pipeline",
+		Attributes: &contracts.Attributes{
+			Id:     31,
+			Branch: "master",
+			Status: "success",
+		},
+		Project: &contracts.PipelineProject{
+			Id:        projectId,
+			Name:      "Gitlab Test",
+			Namespace: "Gitlab Org",
+		},
+		Commit: &contracts.PipelineCommit{
+			Id:      "bcbb5ec396a2c0f828686f14fac9b80b780504f2",
+			Message: "test\n",
+			Author: &contracts.Author{
+				Name:  "User",
+				Email: email,
+			},
+		},
+	}
+}
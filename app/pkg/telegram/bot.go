@@ -5,18 +5,62 @@ import (
 	"fmt"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
+	"github.com/ricdeau/gitlab-extension/app/pkg/caching"
 	"github.com/ricdeau/gitlab-extension/app/pkg/config"
 	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
 	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
 	"github.com/ricdeau/gitlab-extension/app/pkg/utils"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 const (
 	chatPrefix = "chat"
+	// Name of bot subscription.
+	subscriberName = "telegram_bot"
+	namespacesUrl  = "%s/namespaces"
 )
 
+// Bot commands
+const (
+	commandStart       = "start"
+	commandHelp        = "help"
+	commandSubscribe   = "subscribe"
+	commandUnsubscribe = "unsubscribe"
+	commandList        = "list"
+	commandStatus      = "status"
+	commandFilter      = "filter"
+)
+
+// Replies
+const (
+	startText          = "Hi! I send updates of gitlab pipelines to this chat."
+	helpText           = "Available commands:\n%s"
+	unknownCommandText = "Unknown command, send /help to see available commands."
+	errorText          = "Sorry something went wrong."
+	subscribeUsage     = "Please provide your gitlab private token: /subscribe <token>"
+	noGroupsText       = "You don't have any available groups."
+	subscribedText     = "You have been subscribed to groups: %s"
+	unsubscribedText   = "You have been unsubscribed from groups: %s"
+	notSubscribedText  = "You aren't subscribed to any group."
+	listText           = "You are subscribed to groups: %s"
+	statusUsage        = "Please provide project name: /status <project>"
+	projectNotFound    = "Project %s is not found in your groups."
+	noPipelinesText    = "Project %s doesn't have pipelines."
+	filterText         = "Notification filters:\n%s\n\nChange them: /filter statuses|branches|projects [values...] or /filter reset"
+	filterResetText    = "Notification filters are reset, you receive all pipeline events."
+	filterInvalidText  = "Unable to change filters: %v"
+)
+
+// botCommand is command of telegram bot, commands with description are registered as BotFather hints.
+type botCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+	handle      func(chatId int64, args string)
+}
+
 type GitlabMessage contracts.PipelinePush
 
 // Telegram bot that forwards messages form global queue topic to telegram chats.
@@ -26,29 +70,57 @@ type Bot struct {
 	topic     string
 	db        BotDb
 	queue     broker.MessageBroker
+	cache     caching.ProjectsCache
 	logger    logging.Logger
 	updatesCh tgbotapi.UpdatesChannel
+	commands  []botCommand
+	history   *pipelineHistory
 }
 
 // Creates new instance of telegram bot.
+// cache - projects cache, pipelines of its projects are sent on /status
 func NewBot(
 	topic string,
 	config *config.Config,
 	db BotDb,
 	queue broker.MessageBroker,
+	cache caching.ProjectsCache,
 	logger logging.Logger) (*Bot, error) {
 
 	botApi, err := tgbotapi.NewBotAPI(config.BotToken)
 	if err != nil {
 		return nil, err
 	}
+	return newBot(botApi, topic, config, db, queue, cache, logger)
+}
+
+func newBot(
+	botApi *tgbotapi.BotAPI,
+	topic string,
+	config *config.Config,
+	db BotDb,
+	queue broker.MessageBroker,
+	cache caching.ProjectsCache,
+	logger logging.Logger) (*Bot, error) {
+
 	bot := &Bot{}
 	bot.topic = topic
 	bot.BotAPI = botApi
 	bot.db = db
 	bot.queue = queue
+	bot.cache = cache
 	bot.Config = config
 	bot.logger = logger
+	bot.history = newPipelineHistory()
+	bot.commands = []botCommand{
+		{commandStart, "", bot.start},
+		{commandSubscribe, "Subscribe to pipelines of your gitlab groups: /subscribe <private token>", bot.subscribe},
+		{commandUnsubscribe, "Unsubscribe from all or given groups: /unsubscribe [group...]", bot.unsubscribe},
+		{commandList, "List groups you are subscribed to", bot.list},
+		{commandStatus, "Show the last pipelines of project: /status <project>", bot.status},
+		{commandFilter, "Show or change notification filters: /filter statuses failed fixed", bot.filter},
+		{commandHelp, "Show available commands", bot.help},
+	}
 	updates, err := bot.GetUpdatesChan(tgbotapi.UpdateConfig{Timeout: 5})
 	if err != nil {
 		return nil, err
@@ -59,43 +131,172 @@ func NewBot(
 }
 
 // Start handling messages.
+// Commands are registered as BotFather hints, bot works without them if they can't be registered.
 func (bot *Bot) Start() error {
 	if err := bot.subscribeToTopic(); err != nil {
 		return err
 	}
+	if err := bot.registerCommands(); err != nil {
+		bot.logger.Errorf("Unable to register telegram bot commands: %v", err)
+	}
 	go func() {
 		for update := range bot.updatesCh {
-			chatId := update.Message.Chat.ID
 			if update.Message == nil {
 				continue
 			}
-			if update.Message.Text == "/start" {
-				bot.Send(chatId, "Please provide your gitlab private token.")
-				continue
-			}
-			availableNamespaces := bot.getAvailableNamespaces(update.Message.Text)
-			if len(availableNamespaces) == 0 {
-				bot.Send(chatId, "You don't have any available groups.")
-				continue
-			}
-
-			err := bot.setChatNamespaces(chatId, availableNamespaces)
-			if err != nil {
-				bot.logger.Errorf("ErrorResponse while updating gitlab namespaces for chat id=%d", chatId)
-				bot.Send(chatId, "Sorry something went wrong.")
-			}
-			availableNamespaces, err = bot.getChatNamespaces(chatId)
-			if err != nil {
-				bot.logger.Errorf("ErrorResponse while updating gitlab namespaces for chat id=%d", chatId)
-				bot.Send(chatId, "Sorry something went wrong.")
-			}
-			namespacesString := strings.Join(availableNamespaces, ", ")
-			bot.Send(chatId, fmt.Sprintf("You have been subscribed to group: %s", namespacesString))
+			bot.handle(update.Message)
 		}
 	}()
 	return nil
 }
 
+// Routes message to handler of its command.
+func (bot *Bot) handle(message *tgbotapi.Message) {
+	chatId := message.Chat.ID
+	if !message.IsCommand() {
+		bot.Send(chatId, unknownCommandText)
+		return
+	}
+	for _, command := range bot.commands {
+		if command.Command == message.Command() {
+			command.handle(chatId, strings.TrimSpace(message.CommandArguments()))
+			return
+		}
+	}
+	bot.Send(chatId, unknownCommandText)
+}
+
+// Sets list of commands that telegram clients suggest to user.
+func (bot *Bot) registerCommands() error {
+	var hints []botCommand
+	for _, command := range bot.commands {
+		if command.Description != "" {
+			hints = append(hints, command)
+		}
+	}
+	body, err := json.Marshal(hints)
+	if err != nil {
+		return err
+	}
+	_, err = bot.MakeRequest("setMyCommands", url.Values{"commands": {string(body)}})
+	return err
+}
+
+func (bot *Bot) start(chatId int64, _ string) {
+	bot.Send(chatId, startText+"\n\n"+bot.helpText())
+}
+
+func (bot *Bot) help(chatId int64, _ string) {
+	bot.Send(chatId, bot.helpText())
+}
+
+func (bot *Bot) helpText() string {
+	var lines []string
+	for _, command := range bot.commands {
+		if command.Description != "" {
+			lines = append(lines, fmt.Sprintf("/%s - %s", command.Command, command.Description))
+		}
+	}
+	return fmt.Sprintf(helpText, strings.Join(lines, "\n"))
+}
+
+// Subscribes chat to namespaces available with gitlab private token.
+func (bot *Bot) subscribe(chatId int64, token string) {
+	if token == "" {
+		bot.Send(chatId, subscribeUsage)
+		return
+	}
+	availableNamespaces := bot.getAvailableNamespaces(token)
+	if len(availableNamespaces) == 0 {
+		bot.Send(chatId, noGroupsText)
+		return
+	}
+	err := bot.setChatNamespaces(chatId, availableNamespaces)
+	if err != nil {
+		bot.logger.Errorf("ErrorResponse while updating gitlab namespaces for chat id=%d: %v", chatId, err)
+		bot.Send(chatId, errorText)
+		return
+	}
+	namespaces, err := bot.getChatNamespaces(chatId)
+	if err != nil {
+		bot.logger.Errorf("ErrorResponse while getting gitlab namespaces for chat id=%d: %v", chatId, err)
+		bot.Send(chatId, errorText)
+		return
+	}
+	bot.Send(chatId, fmt.Sprintf(subscribedText, strings.Join(namespaces, ", ")))
+}
+
+// Unsubscribes chat from given namespaces, or from all namespaces if none is given.
+func (bot *Bot) unsubscribe(chatId int64, args string) {
+	namespaces, err := bot.getChatNamespaces(chatId)
+	if err != nil {
+		bot.logger.Errorf("ErrorResponse while getting gitlab namespaces for chat id=%d: %v", chatId, err)
+		bot.Send(chatId, errorText)
+		return
+	}
+	if requested := strings.Fields(args); len(requested) != 0 {
+		var removed []string
+		for _, ns := range requested {
+			if utils.ContainsString(namespaces, ns) {
+				removed = append(removed, ns)
+			}
+		}
+		namespaces = removed
+	}
+	if len(namespaces) == 0 {
+		bot.Send(chatId, notSubscribedText)
+		return
+	}
+	if err = bot.removeChatNamespaces(chatId, namespaces); err != nil {
+		bot.logger.Errorf("ErrorResponse while removing gitlab namespaces for chat id=%d: %v", chatId, err)
+		bot.Send(chatId, errorText)
+		return
+	}
+	bot.Send(chatId, fmt.Sprintf(unsubscribedText, strings.Join(namespaces, ", ")))
+}
+
+// Lists namespaces chat is subscribed to.
+func (bot *Bot) list(chatId int64, _ string) {
+	namespaces, err := bot.getChatNamespaces(chatId)
+	if err != nil {
+		bot.logger.Errorf("ErrorResponse while getting gitlab namespaces for chat id=%d: %v", chatId, err)
+		bot.Send(chatId, errorText)
+		return
+	}
+	if len(namespaces) == 0 {
+		bot.Send(chatId, notSubscribedText)
+		return
+	}
+	bot.Send(chatId, fmt.Sprintf(listText, strings.Join(namespaces, ", ")))
+}
+
+// Sends cached pipelines of project from chat's namespaces.
+// Project is matched by name or by 'namespace/name'.
+func (bot *Bot) status(chatId int64, name string) {
+	if name == "" {
+		bot.Send(chatId, statusUsage)
+		return
+	}
+	namespaces, err := bot.getChatNamespaces(chatId)
+	if err != nil {
+		bot.logger.Errorf("ErrorResponse while getting gitlab namespaces for chat id=%d: %v", chatId, err)
+		bot.Send(chatId, errorText)
+		return
+	}
+	// snapshot doesn't load expired projects, so command doesn't block updates loop on gitlab requests
+	projects, _ := bot.cache.Snapshot()
+	for _, project := range projects {
+		if !utils.ContainsString(namespaces, project.Namespace) {
+			continue
+		}
+		if strings.EqualFold(project.Name, name) || strings.EqualFold(project.Namespace+"/"+project.Name, name) {
+			bot.Send(chatId, projectStatusText(project))
+			return
+		}
+	}
+	bot.Send(chatId, fmt.Sprintf(projectNotFound, name))
+}
+
 // Send message to chat.
 // chatId - identifier of telegram chat.
 // text - message's text.
@@ -109,6 +310,40 @@ func (bot *Bot) Send(chatId int64, text string) {
 	}
 }
 
+// Shows filters of chat or changes one of them.
+// '/filter <field> [values...]' replaces values of field, '/filter reset' removes all filters.
+func (bot *Bot) filter(chatId int64, args string) {
+	filter, err := bot.getChatFilter(chatId)
+	if err != nil {
+		bot.logger.Errorf("ErrorResponse while getting filter for chat id=%d: %v", chatId, err)
+		bot.Send(chatId, errorText)
+		return
+	}
+	fields := strings.Fields(args)
+	switch {
+	case len(fields) == 0:
+		bot.Send(chatId, fmt.Sprintf(filterText, filter))
+		return
+	case fields[0] == filterReset:
+		filter = ChatFilter{}
+	default:
+		if err = filter.set(fields[0], fields[1:]); err != nil {
+			bot.Send(chatId, fmt.Sprintf(filterInvalidText, err))
+			return
+		}
+	}
+	if err = bot.setChatFilter(chatId, filter); err != nil {
+		bot.logger.Errorf("ErrorResponse while saving filter for chat id=%d: %v", chatId, err)
+		bot.Send(chatId, errorText)
+		return
+	}
+	if fields[0] == filterReset {
+		bot.Send(chatId, filterResetText)
+		return
+	}
+	bot.Send(chatId, fmt.Sprintf(filterText, filter))
+}
+
 // Get namespaces that have been bound to given chat id.
 func (bot *Bot) getChatNamespaces(chatId int64) (result []string, err error) {
 	prefix := fmt.Sprintf("%s_%d_", chatPrefix, chatId)
@@ -123,11 +358,26 @@ func (bot *Bot) getChatNamespaces(chatId int64) (result []string, err error) {
 func (bot *Bot) setChatNamespaces(chatId int64, namespaces []string) (err error) {
 	err = bot.db.Transaction(func() error {
 		for _, ns := range namespaces {
-			key := fmt.Sprintf("%s_%d_%s", chatPrefix, chatId, ns)
+			key := chatKey(chatId, ns)
 			if bot.db.Contains(key) {
 				continue
 			}
-			return bot.db.Set(key)
+			if err := bot.db.Set(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Unbinds namespaces from given chat id.
+func (bot *Bot) removeChatNamespaces(chatId int64, namespaces []string) (err error) {
+	err = bot.db.Transaction(func() error {
+		for _, ns := range namespaces {
+			if err := bot.db.Delete(chatKey(chatId, ns)); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
@@ -138,9 +388,8 @@ func (bot *Bot) setChatNamespaces(chatId int64, namespaces []string) (err error)
 // Namespaces matched by "name" field
 // Returns slice of accessible namespaces
 func (bot *Bot) getAvailableNamespaces(privateToken string) (result []string) {
-	url := fmt.Sprintf("%s/api/v4/namespaces", bot.GitlabUri)
 	headers := map[string]string{"Private-Token": privateToken}
-	response, err := utils.PerformGetRequest(bot.Client, url, headers, bot.logger)
+	response, err := utils.PerformGetRequest(bot.Client, fmt.Sprintf(namespacesUrl, bot.GitlabUri), headers, bot.logger)
 	if err != nil {
 		return
 	}
@@ -152,8 +401,9 @@ func (bot *Bot) getAvailableNamespaces(privateToken string) (result []string) {
 		return
 	}
 	for _, el := range rawJson {
+		name, _ := el["name"].(string)
 		for _, ns := range bot.GitlabNamespaces {
-			if el["name"].(string) == ns {
+			if name == ns {
 				result = append(result, ns)
 			}
 		}
@@ -161,30 +411,59 @@ func (bot *Bot) getAvailableNamespaces(privateToken string) (result []string) {
 	return result
 }
 
-// Subscribes bot to specific topic in global queue.
+// Subscribes bot to specific topic or topic pattern in global queue.
+// Message is sent to chats subscribed to its namespace if it passes their filters.
 func (bot *Bot) subscribeToTopic() (err error) {
-	if err = bot.queue.AddTopic(bot.topic); err != nil {
-		panic(err)
-	}
-	return bot.queue.Subscribe(bot.topic, func(message interface{}) {
-		msg := GitlabMessage(message.(contracts.PipelinePush))
+	_, err = broker.SubscribePipelines(bot.queue, bot.topic, func(_ broker.Envelope, push contracts.PipelinePush) {
+		msg := GitlabMessage(push)
+		if msg.Attributes == nil || msg.Project == nil {
+			bot.logger.Errorf("Pipeline event without attributes or project isn't sent to telegram")
+			return
+		}
+		fixed := bot.history.record(&msg)
 		err := bot.db.Scan(chatPrefix, func(key string) error {
-			if strings.HasSuffix(key, msg.Project.Namespace) {
-				parts := strings.Split(key, "_")
-				if len(parts) > 2 {
-					chatId, err := strconv.ParseInt(parts[1], 10, 64)
-					if err != nil {
-						return err
-					}
-					bot.Send(chatId, msg.toTelegramMessageText())
-				}
+			parts := strings.SplitN(key, "_", 3)
+			if len(parts) < 3 || parts[2] != msg.Project.Namespace {
+				return nil
+			}
+			chatId, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return err
+			}
+			filter, err := bot.getChatFilter(chatId)
+			if err != nil {
+				return err
+			}
+			if filter.matches(&msg, fixed) {
+				bot.Send(chatId, msg.toTelegramMessageText())
 			}
 			return nil
 		})
 		if err != nil {
 			bot.logger.Errorf("ErrorResponse while sending gitlab update to telegram: %v", err)
 		}
+	}, bot.logger, broker.WithName(subscriberName))
+	return
+}
+
+// Formats cached pipelines of project, the newest first.
+func projectStatusText(project contracts.Project) string {
+	if len(project.Pipelines) == 0 {
+		return fmt.Sprintf(noPipelinesText, project.Name)
+	}
+	pipelines := append([]contracts.Pipeline(nil), project.Pipelines...)
+	sort.Slice(pipelines, func(i, j int) bool {
+		return pipelines[i].Id > pipelines[j].Id
 	})
+	lines := []string{fmt.Sprintf("Project: %s/%s", project.Namespace, project.Name)}
+	for _, pipeline := range pipelines {
+		lines = append(lines, fmt.Sprintf("#%d %s: %s", pipeline.Id, pipeline.Branch, pipeline.Status))
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+func chatKey(chatId int64, namespace string) string {
+	return fmt.Sprintf("%s_%d_%s", chatPrefix, chatId, namespace)
 }
 
 // Formats gitlab message to telegram's message text.
@@ -192,15 +471,22 @@ func (msg *GitlabMessage) toTelegramMessageText() string {
 	template := "Operation: %s\r\nStatus: %s\r\nNamespace: %s\r\nProject : %s\r\nBranch: %s\r\nCommit sha: %s\r\n" +
 		"Commit message: %s\r\nUser: %s\r\nCreatedAt: %s\r\nFinishedAt: %s\r\nDuration: %d"
 
+	commit, user := contracts.PipelineCommit{}, contracts.User{}
+	if msg.Commit != nil {
+		commit = *msg.Commit
+	}
+	if msg.User != nil {
+		user = *msg.User
+	}
 	return fmt.Sprintf(template,
 		msg.Kind,
 		msg.Attributes.Status,
 		msg.Project.Namespace,
 		msg.Project.Name,
 		msg.Attributes.Branch,
-		msg.Commit.Id,
-		msg.Commit.Message,
-		msg.User.Name,
+		commit.Id,
+		commit.Message,
+		user.Name,
 		msg.Attributes.CreatedAt,
 		msg.Attributes.FinishedAt,
 		msg.Attributes.Duration)
@@ -0,0 +1,338 @@
+package telegram
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
+	"github.com/ricdeau/gitlab-extension/app/pkg/config"
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/tests"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	botToken     = "bot-token"
+	gitlabToken  = "gitlab-token"
+	testChatId   = int64(42)
+	replyTimeout = 5 * time.Second
+)
+
+// fakeTelegram emulates telegram bot API: sent messages are recorded, updates are returned from queue.
+type fakeTelegram struct {
+	lock     sync.Mutex
+	updates  []tgbotapi.Update
+	commands string
+	sent     chan url.Values
+}
+
+// telegramTransport redirects requests of telegram bot API to fake server.
+type telegramTransport struct {
+	host string
+}
+
+// memoryDb is BotDb that keeps keys and values in map.
+type memoryDb struct {
+	lock sync.Mutex
+	keys map[string][]byte
+}
+
+func TestBot_handle(t *testing.T) {
+	bot, telegram, stop := newTestBot(t)
+	defer stop()
+	testCases := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"start", "/start", "Hi! I send updates of gitlab pipelines to this chat.\n\nAvailable commands:\n/subscribe"},
+		{"help", "/help", "Available commands:\n/subscribe - Subscribe to pipelines"},
+		{"not command", gitlabToken, "Unknown command, send /help to see available commands."},
+		{"unknown command", "/delete", "Unknown command, send /help to see available commands."},
+		{"subscribe without token", "/subscribe", "Please provide your gitlab private token: /subscribe <token>"},
+		{"subscribe invalid token", "/subscribe invalid", "You don't have any available groups."},
+		{"list empty", "/list", "You aren't subscribed to any group."},
+		{"subscribe", "/subscribe " + gitlabToken, "You have been subscribed to groups: private, public"},
+		{"list", "/list", "You are subscribed to groups: private, public"},
+		{"status without project", "/status", "Please provide project name: /status <project>"},
+		{"status", "/status API", "Project: public/api\r\n#11 master: failed\r\n#10 master: success"},
+		{"status by path", "/status public/api", "Project: public/api\r\n#11 master: failed"},
+		{"status of other group", "/status other", "Project other is not found in your groups."},
+		{"unsubscribe group", "/unsubscribe private other", "You have been unsubscribed from groups: private"},
+		{"unsubscribe all", "/unsubscribe", "You have been unsubscribed from groups: public"},
+		{"unsubscribe again", "/unsubscribe", "You aren't subscribed to any group."},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bot.handle(newTestMessage(tc.text))
+			actual := telegram.nextMessage(t)
+			assert.Equal(t, fmt.Sprint(testChatId), actual.Get("chat_id"))
+			assert.True(t, strings.HasPrefix(actual.Get("text"), tc.expected), actual.Get("text"))
+		})
+	}
+}
+
+func TestBot_filter(t *testing.T) {
+	bot, telegram, stop := newTestBot(t)
+	defer stop()
+	testCases := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"empty", "/filter", "Notification filters:\nstatuses: any\nbranches: any\nprojects: any\n\nChange them"},
+		{"statuses", "/filter statuses Failed fixed", "Notification filters:\nstatuses: failed, fixed\nbranches: any\n"},
+		{"branches", "/filter branches master release/*", "Notification filters:\nstatuses: failed, fixed\nbranches: master, release/*\n"},
+		{"clear branches", "/filter branches", "Notification filters:\nstatuses: failed, fixed\nbranches: any\n"},
+		{"unknown status", "/filter statuses broken", "Unable to change filters: unknown status: broken"},
+		{"invalid branch", "/filter branches [", "Unable to change filters: invalid branch pattern: ["},
+		{"unknown field", "/filter users me", "Unable to change filters: unknown filter: users"},
+		{"reset", "/filter reset", "Notification filters are reset, you receive all pipeline events."},
+		{"after reset", "/filter", "Notification filters:\nstatuses: any\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bot.handle(newTestMessage(tc.text))
+			actual := telegram.nextMessage(t).Get("text")
+			assert.True(t, strings.HasPrefix(actual, tc.expected), actual)
+		})
+	}
+}
+
+func TestBot_subscribeToTopic(t *testing.T) {
+	bot, telegram, stop := newTestBot(t)
+	defer stop()
+	topic := broker.PipelineTopic("instance", "public")
+	assert.NoError(t, bot.queue.AddTopic(topic))
+	assert.NoError(t, bot.Start())
+	assert.NoError(t, bot.setChatNamespaces(testChatId, []string{"public"}))
+	assert.NoError(t, bot.setChatNamespaces(testChatId+1, []string{"public"}))
+	assert.NoError(t, bot.setChatNamespaces(testChatId+2, []string{"private"}))
+	assert.NoError(t, bot.setChatFilter(testChatId, ChatFilter{Statuses: []string{"failed", "fixed"}}))
+
+	// incomplete events are skipped
+	assert.NoError(t, bot.queue.Publish(topic, broker.NewPipelineEnvelope("test", "", contracts.PipelinePush{
+		Attributes: &contracts.Attributes{Status: "failed"},
+	})))
+	assert.NoError(t, bot.queue.Publish(topic, broker.NewPipelineEnvelope("test", "", contracts.PipelinePush{
+		Project: &contracts.PipelineProject{Id: 1, Name: "api", Namespace: "public"},
+	})))
+	for i, status := range []string{"running", "failed", "running", "success"} {
+		push := contracts.PipelinePush{
+			Project:    &contracts.PipelineProject{Id: 1, Name: "api", Namespace: "public"},
+			Attributes: &contracts.Attributes{Id: int64(i), Branch: "master", Status: status},
+			User:       &contracts.User{Name: "developer"},
+			Commit:     &contracts.PipelineCommit{Id: "abc"},
+		}
+		assert.NoError(t, bot.queue.Publish(topic, broker.NewPipelineEnvelope("test", "", push)))
+	}
+
+	received := make(map[string][]string)
+	for i := 0; i < 6; i++ {
+		message := telegram.nextMessage(t)
+		status := strings.Split(strings.Split(message.Get("text"), "Status: ")[1], "\r\n")[0]
+		received[message.Get("chat_id")] = append(received[message.Get("chat_id")], status)
+	}
+	assert.Equal(t, map[string][]string{
+		fmt.Sprint(testChatId):     {"failed", "success"},
+		fmt.Sprint(testChatId + 1): {"running", "failed", "running", "success"},
+	}, received)
+}
+
+func TestBot_Start(t *testing.T) {
+	bot, telegram, stop := newTestBot(t)
+	defer stop()
+	assert.NoError(t, bot.Start())
+
+	// update without message is skipped
+	telegram.addUpdate(tgbotapi.Update{UpdateID: 1, CallbackQuery: &tgbotapi.CallbackQuery{ID: "1"}})
+	telegram.addUpdate(tgbotapi.Update{UpdateID: 2, Message: newTestMessage("/list")})
+	assert.Equal(t, "You aren't subscribed to any group.", telegram.nextMessage(t).Get("text"))
+
+	telegram.lock.Lock()
+	defer telegram.lock.Unlock()
+	var hints []botCommand
+	assert.NoError(t, json.Unmarshal([]byte(telegram.commands), &hints))
+	var names []string
+	for _, hint := range hints {
+		names = append(names, hint.Command)
+		assert.NotEmpty(t, hint.Description)
+	}
+	assert.Equal(t, []string{"subscribe", "unsubscribe", "list", "status", "filter", "help"}, names)
+}
+
+// Creates bot connected to fake telegram and gitlab servers, stop closes them.
+func newTestBot(t *testing.T) (bot *Bot, telegram *fakeTelegram, stop func()) {
+	telegram = &fakeTelegram{sent: make(chan url.Values, 10)}
+	telegramServer := httptest.NewServer(telegram)
+	gitlabServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/namespaces" || r.Header.Get("Private-Token") != gitlabToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"name": "public"}, {"name": "private"}, {"name": "personal"}})
+	}))
+
+	client := &http.Client{Transport: &telegramTransport{strings.TrimPrefix(telegramServer.URL, "http://")}}
+	botApi, err := tgbotapi.NewBotAPIWithClient(botToken, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockLogger := new(tests.MockLogger)
+	mockLogger.On("Infof")
+	mockLogger.On("Errorf")
+	cache := &tests.MockProjectsCache{Projects: []contracts.Project{
+		{Id: 1, Name: "api", Namespace: "public", Pipelines: []contracts.Pipeline{
+			{Id: 10, Branch: "master", Status: "success"},
+			{Id: 11, Branch: "master", Status: "failed"},
+		}},
+		{Id: 2, Name: "other", Namespace: "other"},
+	}}
+	cache.On("Snapshot")
+	conf := &config.Config{GitlabUri: gitlabServer.URL, GitlabNamespaces: []string{"public", "private"}}
+	db := &memoryDb{keys: make(map[string][]byte)}
+	bot, err = newBot(botApi, broker.PipelinesPattern, conf, db, broker.New(), cache, mockLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot, telegram, func() {
+		bot.StopReceivingUpdates()
+		telegramServer.Close()
+		gitlabServer.Close()
+	}
+}
+
+func newTestMessage(text string) *tgbotapi.Message {
+	message := &tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: testChatId}, Text: text}
+	if strings.HasPrefix(text, "/") {
+		command := strings.Fields(text)[0]
+		message.Entities = &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+	}
+	return message
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var result interface{} = true
+	switch strings.TrimPrefix(r.URL.Path, "/bot"+botToken+"/") {
+	case "getMe":
+		result = tgbotapi.User{ID: 1, FirstName: "bot", UserName: "test_bot"}
+	case "getUpdates":
+		result = f.takeUpdates()
+	case "sendMessage":
+		f.sent <- r.PostForm
+		result = tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: testChatId}, Text: r.PostForm.Get("text")}
+	case "setMyCommands":
+		f.lock.Lock()
+		f.commands = r.PostForm.Get("commands")
+		f.lock.Unlock()
+	}
+	body, _ := json.Marshal(result)
+	_ = json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: body})
+}
+
+func (f *fakeTelegram) addUpdate(update tgbotapi.Update) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.updates = append(f.updates, update)
+}
+
+// Returns queued updates, waits a bit if there aren't any, as long polling does.
+func (f *fakeTelegram) takeUpdates() []tgbotapi.Update {
+	for i := 0; i < 10; i++ {
+		f.lock.Lock()
+		updates := f.updates
+		f.updates = nil
+		f.lock.Unlock()
+		if len(updates) != 0 {
+			return updates
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return []tgbotapi.Update{}
+}
+
+func (f *fakeTelegram) nextMessage(t *testing.T) url.Values {
+	select {
+	case message := <-f.sent:
+		return message
+	case <-time.After(replyTimeout):
+		t.Fatal("message is not sent")
+		return nil
+	}
+}
+
+func (tr *telegramTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host == "api.telegram.org" {
+		r.URL.Scheme, r.URL.Host = "http", tr.host
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (db *memoryDb) Close() error {
+	return nil
+}
+
+func (db *memoryDb) Scan(prefix string, scanner func(string) error) error {
+	db.lock.Lock()
+	var keys []string
+	for key := range db.keys {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	db.lock.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := scanner(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *memoryDb) Contains(key string) bool {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, ok := db.keys[key]
+	return ok
+}
+
+func (db *memoryDb) Set(key string) error {
+	return db.Put(key, nil)
+}
+
+func (db *memoryDb) Get(key string) ([]byte, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.keys[key], nil
+}
+
+func (db *memoryDb) Put(key string, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.keys[key] = value
+	return nil
+}
+
+func (db *memoryDb) Delete(key string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	delete(db.keys, key)
+	return nil
+}
+
+func (db *memoryDb) Transaction(action func() error) error {
+	return action()
+}
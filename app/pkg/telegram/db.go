@@ -16,6 +16,10 @@ type BotDb interface {
 	Scan(prefix string, scanner func(string) error) error
 	Contains(key string) bool
 	Set(key string) error
+	// Returns value of key, nil if key doesn't exist.
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
 	Transaction(action func() error) error
 }
 
@@ -49,6 +53,21 @@ func (b *botDb) Set(key string) error {
 	return b.Bitcask.Put([]byte(key), nil)
 }
 
+func (b *botDb) Get(key string) ([]byte, error) {
+	if !b.Bitcask.Has([]byte(key)) {
+		return nil, nil
+	}
+	return b.Bitcask.Get([]byte(key))
+}
+
+func (b *botDb) Put(key string, value []byte) error {
+	return b.Bitcask.Put([]byte(key), value)
+}
+
+func (b *botDb) Delete(key string) error {
+	return b.Bitcask.Delete([]byte(key))
+}
+
 func (b *botDb) Transaction(action func() error) error {
 	err := b.Bitcask.Lock()
 	defer b.Bitcask.Unlock()
@@ -0,0 +1,168 @@
+package telegram
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ricdeau/gitlab-extension/app/pkg/utils"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	filterPrefix = "filter"
+	// Pseudo status of successful pipeline when the previous finished pipeline of its branch failed.
+	statusFixed = "fixed"
+)
+
+// Filter fields
+const (
+	filterStatuses = "statuses"
+	filterBranches = "branches"
+	filterProjects = "projects"
+	filterReset    = "reset"
+)
+
+// Errors
+const (
+	filterStatusUnknown = "unknown status: %s"
+	filterBranchInvalid = "invalid branch pattern: %s"
+	filterFieldUnknown  = "unknown filter: %s"
+)
+
+// Pipeline statuses that can be used in filter.
+var filterStatusValues = []string{
+	"created", "waiting_for_resource", "preparing", "pending", "running",
+	"success", "failed", "canceled", "skipped", "manual", "scheduled", statusFixed,
+}
+
+// Statuses of finished pipelines, fixed pipelines are found by them.
+var finishedStatuses = []string{"success", "failed", "canceled", "skipped"}
+
+// ChatFilter selects pipeline events sent to chat.
+// Empty filter matches any value, branches are matched as globs,
+// projects are matched by name or by 'namespace/name'.
+type ChatFilter struct {
+	Statuses []string `json:"statuses,omitempty"`
+	Branches []string `json:"branches,omitempty"`
+	Projects []string `json:"projects,omitempty"`
+}
+
+// pipelineHistory keeps the last finished status of every branch to find fixed pipelines.
+// It's kept in memory, so the first pipeline after restart is never fixed.
+type pipelineHistory struct {
+	lock     *sync.Mutex
+	statuses map[string]string
+}
+
+func newPipelineHistory() *pipelineHistory {
+	return &pipelineHistory{
+		lock:     new(sync.Mutex),
+		statuses: make(map[string]string),
+	}
+}
+
+// Records status of pipeline, returns true if pipeline fixed its branch.
+// Event without attributes or project isn't recorded.
+func (h *pipelineHistory) record(msg *GitlabMessage) bool {
+	if msg.Attributes == nil || msg.Project == nil {
+		return false
+	}
+	status := msg.Attributes.Status
+	if !utils.ContainsString(finishedStatuses, status) {
+		return false
+	}
+	key := fmt.Sprintf("%d/%s", msg.Project.Id, msg.Attributes.Branch)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	previous := h.statuses[key]
+	h.statuses[key] = status
+	return status == "success" && previous == "failed"
+}
+
+// Changes field of filter, field without values matches any value.
+func (f *ChatFilter) set(field string, values []string) error {
+	switch field {
+	case filterStatuses:
+		for i, status := range values {
+			values[i] = strings.ToLower(status)
+			if !utils.ContainsString(filterStatusValues, values[i]) {
+				return fmt.Errorf(filterStatusUnknown, status)
+			}
+		}
+		f.Statuses = values
+	case filterBranches:
+		for _, pattern := range values {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf(filterBranchInvalid, pattern)
+			}
+		}
+		f.Branches = values
+	case filterProjects:
+		f.Projects = values
+	default:
+		return fmt.Errorf(filterFieldUnknown, field)
+	}
+	return nil
+}
+
+// Checks that pipeline event passes all filters, event without attributes or project never passes.
+// fixed - pipeline fixed its branch, it matches both 'success' and 'fixed' statuses
+func (f ChatFilter) matches(msg *GitlabMessage, fixed bool) bool {
+	if msg.Attributes == nil || msg.Project == nil {
+		return false
+	}
+	if len(f.Statuses) != 0 && !utils.ContainsString(f.Statuses, msg.Attributes.Status) &&
+		!(fixed && utils.ContainsString(f.Statuses, statusFixed)) {
+		return false
+	}
+	if len(f.Projects) != 0 {
+		found := false
+		for _, name := range f.Projects {
+			found = found || strings.EqualFold(name, msg.Project.Name) ||
+				strings.EqualFold(name, msg.Project.Namespace+"/"+msg.Project.Name)
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(f.Branches) == 0 || utils.MatchBranch(f.Branches, msg.Attributes.Branch)
+}
+
+// Formats filter as list of its fields.
+func (f ChatFilter) String() string {
+	field := func(name string, values []string) string {
+		if len(values) == 0 {
+			return name + ": any"
+		}
+		return name + ": " + strings.Join(values, ", ")
+	}
+	return strings.Join([]string{
+		field(filterStatuses, f.Statuses),
+		field(filterBranches, f.Branches),
+		field(filterProjects, f.Projects),
+	}, "\n")
+}
+
+// Gets filter of chat, chat without filter receives all events.
+func (bot *Bot) getChatFilter(chatId int64) (filter ChatFilter, err error) {
+	value, err := bot.db.Get(filterKey(chatId))
+	if err != nil || value == nil {
+		return
+	}
+	err = json.Unmarshal(value, &filter)
+	return
+}
+
+// Saves filter of chat.
+func (bot *Bot) setChatFilter(chatId int64, filter ChatFilter) error {
+	value, err := json.Marshal(filter)
+	if err != nil {
+		return err
+	}
+	return bot.db.Put(filterKey(chatId), value)
+}
+
+func filterKey(chatId int64) string {
+	return fmt.Sprintf("%s_%d", filterPrefix, chatId)
+}
@@ -0,0 +1,68 @@
+package telegram
+
+import (
+	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestChatFilter_matches(t *testing.T) {
+	msg := &GitlabMessage{
+		Project:    &contracts.PipelineProject{Id: 1, Name: "api", Namespace: "group"},
+		Attributes: &contracts.Attributes{Branch: "release/1.0", Status: "success"},
+	}
+	testCases := []struct {
+		name     string
+		filter   ChatFilter
+		expected bool
+		fixed    bool
+	}{
+		{"empty", ChatFilter{}, true, true},
+		{"status", ChatFilter{Statuses: []string{"failed", "success"}}, true, true},
+		{"other status", ChatFilter{Statuses: []string{"failed"}}, false, false},
+		{"fixed status", ChatFilter{Statuses: []string{"failed", "fixed"}}, false, true},
+		{"branch glob", ChatFilter{Branches: []string{"master", "release/*"}}, true, true},
+		{"other branch", ChatFilter{Branches: []string{"master"}}, false, false},
+		{"project name", ChatFilter{Projects: []string{"API"}}, true, true},
+		{"project path", ChatFilter{Projects: []string{"group/api"}}, true, true},
+		{"other project", ChatFilter{Projects: []string{"other/api"}}, false, false},
+		{"all fields", ChatFilter{
+			Statuses: []string{"fixed"},
+			Branches: []string{"release/*"},
+			Projects: []string{"api"},
+		}, false, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.filter.matches(msg, false))
+			assert.Equal(t, tc.fixed, tc.filter.matches(msg, true))
+		})
+	}
+	assert.False(t, ChatFilter{}.matches(&GitlabMessage{Project: msg.Project}, false))
+	assert.False(t, ChatFilter{}.matches(&GitlabMessage{Attributes: msg.Attributes}, false))
+}
+
+func TestPipelineHistory_record(t *testing.T) {
+	history := newPipelineHistory()
+	var actual []bool
+	for _, push := range []struct {
+		branch string
+		status string
+	}{
+		{"master", "success"},
+		{"master", "failed"},
+		{"feature", "success"},
+		{"master", "running"},
+		{"master", "success"},
+		{"master", "success"},
+	} {
+		msg := &GitlabMessage{
+			Project:    &contracts.PipelineProject{Id: 1},
+			Attributes: &contracts.Attributes{Branch: push.branch, Status: push.status},
+		}
+		actual = append(actual, history.record(msg))
+	}
+	assert.Equal(t, []bool{false, false, false, false, true, false}, actual)
+	assert.False(t, history.record(&GitlabMessage{Project: &contracts.PipelineProject{Id: 1}}))
+	assert.False(t, history.record(&GitlabMessage{Attributes: &contracts.Attributes{Status: "success"}}))
+}
@@ -3,10 +3,17 @@ package utils
 import (
 	"fmt"
 	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
+	"io"
 	"net/http"
+	"path"
 	"sync"
 )
 
+const redacted = "[REDACTED]"
+
+// Headers with credentials that must not be logged.
+var secretHeaders = []string{"Private-Token", "Authorization"}
+
 // PerformGetRequest - performs GET request with Private-Token header and returns response.
 // client - http client to perform request
 // url - request's url
@@ -16,15 +23,31 @@ func PerformGetRequest(
 	url string,
 	headers map[string]string,
 	logger logging.Logger) (resp *http.Response, err error) {
+	return PerformRequest(client, http.MethodGet, url, headers, nil, logger)
+}
+
+// PerformRequest - performs request with given method and body and returns response.
+// client - http client to perform request
+// method - request's http method
+// url - request's url
+// headers - request's headers map
+// body - request's body, can be nil
+func PerformRequest(
+	client *http.Client,
+	method string,
+	url string,
+	headers map[string]string,
+	body io.Reader,
+	logger logging.Logger) (resp *http.Response, err error) {
 
-	request, err := http.NewRequest("GET", url, nil)
+	request, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return
 	}
 	for k, v := range headers {
 		request.Header.Set(k, v)
 	}
-	reqString := fmt.Sprintf("(Method: %s, Path: %s, Headers: %s)", request.Method, request.URL, request.Header)
+	reqString := fmt.Sprintf("(Method: %s, Path: %s, Headers: %s)", request.Method, request.URL, redactHeaders(request.Header))
 	logger.Infof("Request: %s", reqString)
 	resp, err = client.Do(request)
 	switch {
@@ -37,6 +60,37 @@ func PerformGetRequest(
 	return
 }
 
+// Returns copy of headers with values of credential headers replaced.
+func redactHeaders(headers http.Header) http.Header {
+	result := headers.Clone()
+	for _, name := range secretHeaders {
+		if _, ok := result[http.CanonicalHeaderKey(name)]; ok {
+			result.Set(name, redacted)
+		}
+	}
+	return result
+}
+
+// ContainsString - checks that values contain value.
+func ContainsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchBranch - checks that branch matches any of glob patterns, invalid pattern matches nothing.
+func MatchBranch(patterns []string, branch string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
 type CountingSemaphore struct {
 	Count   int
 	wg      sync.WaitGroup
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"github.com/ricdeau/gitlab-extension/app/tests"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -42,6 +43,21 @@ func TestPerformGetRequest_Success(t *testing.T) {
 	}
 }
 
+func TestRedactHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Private-Token", "token")
+	headers.Set("Authorization", "Bearer token")
+	headers.Set("Timeout", "10")
+
+	actual := redactHeaders(headers)
+
+	assert.Equal(t, redacted, actual.Get("Private-Token"))
+	assert.Equal(t, redacted, actual.Get("Authorization"))
+	assert.Equal(t, "10", actual.Get("Timeout"))
+	assert.Equal(t, "token", headers.Get("Private-Token"), "original headers are changed")
+	assert.NotContains(t, redactHeaders(http.Header{}), "Private-Token")
+}
+
 func TestPerformGetRequest_Error(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
 
@@ -87,3 +103,48 @@ func TestPerformGetRequest_BadStatusCode(t *testing.T) {
 		assert.Contains(t, err.Error(), strconv.Itoa(statusCode))
 	}
 }
+
+func TestPerformRequest_Body(t *testing.T) {
+	expected := []byte(`{"url":"http://example.com"}`)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	logger := new(tests.MockLogger)
+	logger.On("Infof").Once()
+
+	client := ts.Client()
+	resp, err := PerformRequest(client, http.MethodPost, ts.URL, nil, bytes.NewReader(expected), logger)
+
+	mock.AssertExpectationsForObjects(t, logger)
+
+	if assert.NoError(t, err) {
+		actual, err := ioutil.ReadAll(resp.Body)
+		defer resp.Body.Close()
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, actual, "response body does't match")
+		}
+	}
+}
+
+func TestContainsString(t *testing.T) {
+	assert.True(t, ContainsString([]string{"failed", "success"}, "success"))
+	assert.False(t, ContainsString([]string{"failed", "success"}, "running"))
+	assert.False(t, ContainsString(nil, ""))
+}
+
+func TestMatchBranch(t *testing.T) {
+	patterns := []string{"master", "release/*", "[invalid"}
+	assert.True(t, MatchBranch(patterns, "master"))
+	assert.True(t, MatchBranch(patterns, "release/1.0"))
+	assert.False(t, MatchBranch(patterns, "release/1.0/hotfix"))
+	assert.False(t, MatchBranch(patterns, "[invalid"))
+	assert.False(t, MatchBranch(nil, "master"))
+}
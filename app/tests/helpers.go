@@ -1,13 +1,17 @@
 package tests
 
 import (
+	"context"
 	"fmt"
 	"github.com/ricdeau/gitlab-extension/app/pkg/broker"
 	"github.com/ricdeau/gitlab-extension/app/pkg/contracts"
+	"github.com/ricdeau/gitlab-extension/app/pkg/journal"
 	"github.com/ricdeau/gitlab-extension/app/pkg/logging"
 	"github.com/stretchr/testify/mock"
+	"gopkg.in/olahol/melody.v1"
 	"net/http"
 	"net/http/httptest"
+	"time"
 )
 
 type MockLogger struct {
@@ -36,19 +40,44 @@ func (m *MockMessageBroker) AddTopic(name string) error {
 	return nil
 }
 
-func (m *MockMessageBroker) Publish(topicName string, message interface{}) error {
-	m.Called(topicName, message)
+func (m *MockMessageBroker) Publish(topicName string, envelope broker.Envelope) error {
+	m.Called(topicName, envelope)
 	if m.PublishError {
 		return fmt.Errorf("publish error")
 	}
 	return nil
 }
 
-func (m *MockMessageBroker) Subscribe(_ string, _ broker.Consumer) error {
+func (m *MockMessageBroker) Subscribe(topicName string, _ broker.Consumer, _ ...broker.SubscribeOption) (broker.Subscription, error) {
 	m.Called()
 	if m.SubscribeError {
-		return fmt.Errorf("subscribe error")
+		return broker.Subscription{}, fmt.Errorf("subscribe error")
 	}
+	return broker.Subscription{Topic: topicName}, nil
+}
+
+func (m *MockMessageBroker) Unsubscribe(subscription broker.Subscription) error {
+	m.Called(subscription)
+	return nil
+}
+
+func (m *MockMessageBroker) Redeliver(topicName, subscriberName string, envelope broker.Envelope) error {
+	m.Called(topicName, subscriberName, envelope)
+	return nil
+}
+
+func (m *MockMessageBroker) Failures() map[string]uint64 {
+	m.Called()
+	return map[string]uint64{}
+}
+
+func (m *MockMessageBroker) Stats() []broker.TopicStats {
+	m.Called()
+	return []broker.TopicStats{}
+}
+
+func (m *MockMessageBroker) Close(_ context.Context) error {
+	m.Called()
 	return nil
 }
 
@@ -60,6 +89,10 @@ type MockContext struct {
 	Logger      func() logging.Logger
 	SetStatus   func(int)
 	QueryParams map[string]string
+	Params      map[string]string
+	Headers     map[string]string
+	Correlation string
+	Request     *http.Request
 }
 
 func (m *MockContext) QueryParam(key string) string {
@@ -71,6 +104,25 @@ func (m *MockContext) QueryParam(key string) string {
 	return ""
 }
 
+func (m *MockContext) Param(key string) string {
+	m.Called(key)
+	val, exist := m.Params[key]
+	if exist {
+		return val
+	}
+	return ""
+}
+
+func (m *MockContext) GetHeader(key string) string {
+	m.Called(key)
+	return m.Headers[key]
+}
+
+func (m *MockContext) GetCorrelationId() string {
+	m.Called()
+	return m.Correlation
+}
+
 func DefaultMockContext() *MockContext {
 	result := &MockContext{
 		Mock:      mock.Mock{},
@@ -118,54 +170,214 @@ func (m *MockContext) GetWriter() http.ResponseWriter {
 
 func (m *MockContext) GetRequest() *http.Request {
 	m.Called()
-	return nil
+	return m.Request
 }
 
 type MockBroadcaster struct {
 	mock.Mock
-	BroadcastFunc     func([]byte) error
-	HandleRequestFunc func(http.ResponseWriter, *http.Request) error
+	BroadcastFunc     func([]byte, func(*melody.Session) bool) error
+	HandleRequestFunc func(http.ResponseWriter, *http.Request, map[string]interface{}) error
+	MessageHandler    func(*melody.Session, []byte)
+	SentHandler       func(*melody.Session, []byte)
 }
 
 func DefaultMockBroadcaster() *MockBroadcaster {
 	result := new(MockBroadcaster)
-	result.BroadcastFunc = func([]byte) error {
+	result.BroadcastFunc = func([]byte, func(*melody.Session) bool) error {
 		return nil
 	}
-	result.HandleRequestFunc = func(http.ResponseWriter, *http.Request) error {
+	result.HandleRequestFunc = func(http.ResponseWriter, *http.Request, map[string]interface{}) error {
 		return nil
 	}
 	return result
 }
 
-func (m *MockBroadcaster) Broadcast(msg []byte) error {
+func (m *MockBroadcaster) BroadcastFilter(msg []byte, fn func(*melody.Session) bool) error {
 	m.Called(msg)
-	return m.BroadcastFunc(msg)
+	return m.BroadcastFunc(msg, fn)
+}
+
+func (m *MockBroadcaster) HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, keys map[string]interface{}) error {
+	m.Called()
+	return m.HandleRequestFunc(w, r, keys)
+}
+
+func (m *MockBroadcaster) HandleMessage(fn func(*melody.Session, []byte)) {
+	m.Called()
+	m.MessageHandler = fn
 }
 
-func (m *MockBroadcaster) HandleRequest(w http.ResponseWriter, r *http.Request) error {
+func (m *MockBroadcaster) HandleSentMessage(fn func(*melody.Session, []byte)) {
 	m.Called()
-	return m.HandleRequestFunc(w, r)
+	m.SentHandler = fn
 }
 
 type MockProjectsCache struct {
 	mock.Mock
 	Projects []contracts.Project
+	Err      error
 }
 
-func (m *MockProjectsCache) GetProjects() (projects []contracts.Project, exists bool) {
+func (m *MockProjectsCache) GetProjects() ([]contracts.Project, error) {
 	m.Called()
-	if m.Projects == nil {
-		return nil, false
+	return m.Projects, m.Err
+}
+
+func (m *MockProjectsCache) GetProject(id int64) (contracts.Project, error) {
+	m.Called(id)
+	for _, project := range m.Projects {
+		if project.Id == id {
+			return project, nil
+		}
 	}
-	return m.Projects, true
+	return contracts.Project{}, m.Err
+}
+
+func (m *MockProjectsCache) Snapshot() ([]contracts.Project, uint64) {
+	m.Called()
+	return m.Projects, uint64(len(m.Calls))
+}
+
+func (m *MockProjectsCache) Reload() error {
+	m.Called()
+	return m.Err
 }
 
 func (m *MockProjectsCache) SetProjects(projects []contracts.Project) {
 	m.Called()
 }
 
-func (m *MockProjectsCache) UpdatePipeline(pipelinePush contracts.PipelinePush) error {
+func (m *MockProjectsCache) SetProject(project contracts.Project) {
+	m.Called(project)
+}
+
+func (m *MockProjectsCache) Invalidate(id int64) {
+	m.Called(id)
+}
+
+func (m *MockProjectsCache) Refresh(id int64) error {
+	m.Called(id)
+	return m.Err
+}
+
+func (m *MockProjectsCache) Clear() {
+	m.Called()
+}
+
+func (m *MockProjectsCache) Stats() contracts.CacheStats {
+	m.Called()
+	result := contracts.CacheStats{Entries: make([]contracts.CacheEntry, 0, len(m.Projects))}
+	for _, project := range m.Projects {
+		result.Entries = append(result.Entries, contracts.CacheEntry{
+			ProjectId: project.Id,
+			Project:   project.Name,
+			Namespace: project.Namespace,
+		})
+	}
+	return result
+}
+
+func (m *MockProjectsCache) UpdatePipeline(pipelinePush contracts.PipelinePush) (contracts.CacheChange, error) {
 	m.Called(pipelinePush)
+	return contracts.CacheChange{}, nil
+}
+
+type MockJournal struct {
+	mock.Mock
+	Events []contracts.JournalEvent
+	Err    error
+}
+
+func (m *MockJournal) Close() error {
+	m.Called()
+	return nil
+}
+
+func (m *MockJournal) Append(envelope broker.Envelope) (contracts.JournalEvent, error) {
+	m.Called(envelope)
+	push, _ := envelope.PipelinePush()
+	event := contracts.JournalEvent{Id: uint64(len(m.Events) + 1), Kind: envelope.Kind, Payload: push}
+	m.Events = append(m.Events, event)
+	return event, m.Err
+}
+
+func (m *MockJournal) Get(id uint64) (contracts.JournalEvent, error) {
+	m.Called(id)
+	for _, event := range m.Events {
+		if event.Id == id {
+			return event, m.Err
+		}
+	}
+	return contracts.JournalEvent{}, journal.ErrEventNotFound
+}
+
+func (m *MockJournal) List(query journal.Query) ([]contracts.JournalEvent, error) {
+	m.Called(query)
+	return m.Events, m.Err
+}
+
+func (m *MockJournal) Compact() error {
+	m.Called()
+	return m.Err
+}
+
+type MockHooksManager struct {
+	mock.Mock
+	SyncError error
+}
+
+func (m *MockHooksManager) Start(interval time.Duration) error {
+	m.Called(interval)
+	return nil
+}
+
+func (m *MockHooksManager) Close() error {
+	m.Called()
+	return nil
+}
+
+func (m *MockHooksManager) Sync() error {
+	m.Called()
+	return m.SyncError
+}
+
+func (m *MockHooksManager) Status() contracts.HooksResponse {
+	m.Called()
+	return contracts.HooksResponse{}
+}
+
+type MockDispatcher struct {
+	mock.Mock
+	Records []contracts.DeadLetter
+	Err     error
+}
+
+func (m *MockDispatcher) Close() error {
+	m.Called()
 	return nil
 }
+
+func (m *MockDispatcher) Dispatch(event contracts.PipelineEvent) {
+	m.Called(event)
+}
+
+func (m *MockDispatcher) DeadLetters() ([]contracts.DeadLetter, error) {
+	m.Called()
+	return m.Records, m.Err
+}
+
+type MockDeadLetterStore struct {
+	mock.Mock
+	Records     []broker.DeadLetterRecord
+	ReplayError error
+}
+
+func (m *MockDeadLetterStore) List() []broker.DeadLetterRecord {
+	m.Called()
+	return m.Records
+}
+
+func (m *MockDeadLetterStore) Replay(id string) error {
+	m.Called(id)
+	return m.ReplayError
+}
@@ -23,6 +23,8 @@ class ProjectList extends Component {
             isLoading: true,
             error: null
         };
+        // sequence number of the last received event, it's sent on reconnect to receive missed events
+        this.lastSeq = 0;
     }
 
     componentDidMount() {
@@ -42,45 +44,56 @@ class ProjectList extends Component {
         return body;
     };
 
-    handlePush(data) {
-        let gitlab_push = JSON.parse(data);
+    handleOpen() {
+        if (this.lastSeq > 0) {
+            this.refWebSocket.sendMessage(JSON.stringify({type: "subscribe", last_seq: this.lastSeq}));
+        }
+    }
+
+    handleMessage(data) {
+        let message = JSON.parse(data);
+        switch (message["type"]) {
+            case "snapshot":
+                this.lastSeq = message["seq"] || 0;
+                this.setState({projects: message["projects"]});
+                break;
+            case "project.added":
+            case "pipeline.created":
+            case "pipeline.updated":
+                this.lastSeq = message["seq"];
+                this.handleChange(message);
+                break;
+            case "pipeline.acknowledged":
+                this.lastSeq = message["seq"];
+                break;
+            default:
+        }
+    }
+
+    // Applies change of cached project, pipelines are replaced as a whole.
+    handleChange(change) {
         this.setState(state => {
-            let projects = [];
-            Object.assign(projects, state.projects);
-            for (let i = 0; i < projects.length; i++) {
-                if (projects[i]["id"] === gitlab_push["project"]["id"]) {
-                    let pipelines = projects[i]["pipelines"];
-                    let updated = false;
-                    if (pipelines) {
-                        for (let j = 0; j < pipelines.length; j++) {
-                            if (pipelines[j]["id"] === gitlab_push["object_attributes"]["id"]) {
-                                pipelines[j]["status"] = gitlab_push["object_attributes"]["status"];
-                                updated = true;
-                                break;
-                            }
-                        }
-                    }
-                    if (!updated) {
-                        let new_pipeline = {
-                            id: gitlab_push["object_attributes"]["id"],
-                            sha: gitlab_push["object_attributes"]["sha"],
-                            branch: gitlab_push["object_attributes"]["ref"],
-                            status: gitlab_push["object_attributes"]["status"],
-                            web_url: gitlab_push["commit"]["url"],
-                            commit: {
-                                author: gitlab_push["commit"]["author"]["name"],
-                                created_at: gitlab_push["commit"]["timestamp"],
-                                title: gitlab_push["commit"]["message"]
-                            }
-                        };
-                        pipelines.push(new_pipeline);
-                        pipelines.sort((a, b) => b["id"] - a["id"]);
-                        projects[i]["pipelines"] = pipelines
-                    }
-                    break;
+            let projects = state.projects.slice();
+            let i = projects.findIndex(project => project["id"] === change["project_id"]);
+            if (change["type"] === "project.added") {
+                if (i < 0) {
+                    projects.push(change["project"]);
+                } else {
+                    projects[i] = change["project"];
                 }
+                return {projects: projects};
+            }
+            if (i < 0) {
+                return null;
             }
-            return {projects: projects}
+            let removed = change["removed_pipelines"] || [];
+            let pipeline = change["pipeline"];
+            let pipelines = (projects[i]["pipelines"] || [])
+                .filter(p => p["id"] !== pipeline["id"] && !removed.includes(p["id"]));
+            pipelines.push(pipeline);
+            pipelines.sort((a, b) => b["id"] - a["id"]);
+            projects[i] = Object.assign({}, projects[i], {pipelines: pipelines});
+            return {projects: projects};
         })
     }
 
@@ -105,7 +118,11 @@ class ProjectList extends Component {
                     {/*<div className="row">*/}
                     <div className="list-group shrinked">
                         <Websocket url={ws_url}
-                                   onMessage={this.handlePush.bind(this)}/>
+                                   onOpen={this.handleOpen.bind(this)}
+                                   onMessage={this.handleMessage.bind(this)}
+                                   ref={Websocket => {
+                                       this.refWebSocket = Websocket;
+                                   }}/>
                         {projectsMap}
                     </div>
                     {/*</div>*/}